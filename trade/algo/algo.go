@@ -0,0 +1,385 @@
+package algo
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// Strategy enum
+type Strategy int
+
+const (
+	// TWAP slices the parent evenly over its duration
+	TWAP Strategy = iota + 1
+	// VWAP slices the parent as a share of the volume traded by others
+	VWAP
+)
+
+func (s Strategy) String() string {
+	switch s {
+	case TWAP:
+		return "twap"
+	case VWAP:
+		return "vwap"
+	}
+	return "unknown"
+}
+
+// Status enum
+type Status int
+
+const (
+	// Working parents are still submitting child orders
+	Working Status = iota + 1
+	// Finished parents reached the end of their schedule
+	Finished
+	// Completed parents have their full quantity executed
+	Completed
+)
+
+func (s Status) String() string {
+	switch s {
+	case Working:
+		return "working"
+	case Finished:
+		return "finished"
+	case Completed:
+		return "completed"
+	}
+	return "unknown"
+}
+
+// defaultSlices is the number of TWAP slices if none is given
+const defaultSlices = 10
+
+// retention is how long a parent that stopped working is still listed, and
+// the fills of its children still tracked
+const retention = time.Hour
+
+// Parent defines an order executed by a schedule of child orders. Duration
+// is in seconds.
+type Parent struct {
+	Id            uuid.UUID           `json:"id,omitempty"`
+	Symbol        string              `json:"symbol,omitempty"`
+	Account       string              `json:"account,omitempty"`
+	Strategy      Strategy            `json:"strategy,omitempty"`
+	Transaction   matcher.Transaction `json:"transaction,omitempty"`
+	OrderType     matcher.OrderType   `json:"order_type,omitempty"`
+	Quantity      int                 `json:"quantity,omitempty"`
+	Price         int                 `json:"price,omitempty"`
+	Duration      int                 `json:"duration,omitempty"`
+	Slices        int                 `json:"slices,omitempty"`
+	Participation float64             `json:"participation,omitempty"`
+	StartTime     time.Time           `json:"start_time,omitempty"`
+	Submitted     int                 `json:"submitted"`
+	Executed      int                 `json:"executed"`
+	Children      []uuid.UUID         `json:"children,omitempty"`
+	Status        Status              `json:"status,omitempty"`
+
+	// volume traded by others since the start, for VWAP
+	volume int
+	// stopped is the step that found the parent no longer working
+	stopped time.Time
+}
+
+func (p *Parent) validate() error {
+	if p.Transaction != matcher.Buy && p.Transaction != matcher.Sell {
+		return errors.New("transaction must be buy or sell")
+	}
+	if p.OrderType != matcher.Market && p.OrderType != matcher.Limit {
+		return errors.New("child order type must be market or limit")
+	}
+	if p.Quantity <= 0 || p.Price <= 0 || p.Duration <= 0 {
+		return errors.New("quantity, price and duration must be positive")
+	}
+	switch p.Strategy {
+	case TWAP:
+		if p.Slices < 0 || p.Slices > p.Quantity {
+			return errors.New("slices must be between 1 and quantity")
+		}
+	case VWAP:
+		if p.Participation <= 0 || p.Participation > 1 {
+			return errors.New("participation must be above 0 and at most 1")
+		}
+	default:
+		return errors.New("strategy must be twap or vwap")
+	}
+	return nil
+}
+
+// due returns the quantity the schedule wants submitted by now
+func (p *Parent) due(now time.Time) int {
+	end := p.StartTime.Add(time.Duration(p.Duration) * time.Second)
+	switch p.Strategy {
+	case TWAP:
+		if !now.Before(end) {
+			return p.Quantity
+		}
+		// A slice is due at the start of each of the equal intervals
+		interval := time.Duration(p.Duration) * time.Second / time.Duration(p.Slices)
+		slice := int(now.Sub(p.StartTime)/interval) + 1
+		return p.Quantity * slice / p.Slices
+	case VWAP:
+		due := int(p.Participation * float64(p.volume))
+		if due > p.Quantity {
+			due = p.Quantity
+		}
+		return due
+	}
+	return 0
+}
+
+// Algo executes parent orders by slicing them into child orders
+type Algo interface {
+	// Submit starts the schedule of a parent order and returns a copy of it.
+	Submit(p *Parent) (Parent, error)
+
+	// Step submits the child orders due at the given time. It lets the
+	// schedules run in simulated time.
+	Step(now time.Time)
+
+	// RunSchedules steps the schedules in real time until the context is
+	// done.
+	RunSchedules(ctx context.Context)
+
+	// ParentOrders returns a snapshot of the parent orders. A parent is
+	// listed until the retention has passed since it stopped working.
+	ParentOrders() []Parent
+}
+
+// child is a child order not yet filled
+type child struct {
+	parent    *Parent
+	remaining int
+}
+
+// algoService implements the parent order schedules
+type algoService struct {
+	match    matcher.Matcher
+	interval time.Duration
+	log      *logrus.Logger
+
+	mu       sync.Mutex
+	parents  []*Parent
+	children map[uuid.UUID]*child
+}
+
+// NewAlgoService instantiates the algo service, placing its child orders
+// with the matcher and tracking their fills through its trades.
+func NewAlgoService(
+	match matcher.Matcher,
+	interval time.Duration,
+	log *logrus.Logger,
+) Algo {
+	a := &algoService{
+		match:    match,
+		interval: interval,
+		log:      log,
+		children: make(map[uuid.UUID]*child),
+	}
+	match.Subscribe(a.onTrade)
+	return a
+}
+
+// Submit validates the parent order and starts its schedule, from now
+// unless the parent has a start time.
+func (a *algoService) Submit(p *Parent) (Parent, error) {
+	if p.Id == uuid.Nil {
+		p.Id = uuid.New()
+	}
+	if p.StartTime.IsZero() {
+		p.StartTime = time.Now().UTC()
+	}
+	if p.Strategy == TWAP && p.Slices == 0 {
+		p.Slices = defaultSlices
+		if p.Slices > p.Quantity {
+			p.Slices = p.Quantity
+		}
+	}
+	if err := p.validate(); err != nil {
+		return Parent{}, err
+	}
+	p.Submitted = 0
+	p.Executed = 0
+	p.Children = nil
+	p.Status = Working
+
+	a.log.WithFields(logrus.Fields{
+		"ParentId":    p.Id.String()[:10],
+		"Strategy":    p.Strategy,
+		"Transaction": p.Transaction,
+		"Quantity":    p.Quantity,
+		"Duration":    p.Duration,
+	}).Debug("Algo received parent order")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.parents = append(a.parents, p)
+	return *p, nil
+}
+
+// Step drops the parents stopped for longer than the retention, then works
+// out the child orders due on every working parent and places them through
+// the queue of the matcher, like the orders of the API. The lock is not held
+// while placing, as the matcher calls back into onTrade.
+func (a *algoService) Step(now time.Time) {
+	var orders []*matcher.Order
+
+	a.mu.Lock()
+	a.prune(now)
+	for _, p := range a.parents {
+		if p.Status != Working {
+			continue
+		}
+		if qty := p.due(now) - p.Submitted; qty > 0 {
+			o := &matcher.Order{
+				Symbol:         p.Symbol,
+				Account:        p.Account,
+				Id:             uuid.New(),
+				OrderTime:      now.UTC(),
+				Transaction:    p.Transaction,
+				PlacedQuantity: qty,
+				Quantity:       qty,
+				Price:          p.Price,
+				OrderType:      p.OrderType,
+				Status:         matcher.Placed,
+			}
+			p.Submitted += qty
+			p.Children = append(p.Children, o.Id)
+			a.children[o.Id] = &child{parent: p, remaining: qty}
+			orders = append(orders, o)
+		}
+		end := p.StartTime.Add(time.Duration(p.Duration) * time.Second)
+		if p.Submitted == p.Quantity || !now.Before(end) {
+			p.Status = Finished
+		}
+	}
+	a.mu.Unlock()
+
+	for _, o := range orders {
+		a.log.WithFields(logrus.Fields{
+			"OrderId":  o.Id.String()[:10],
+			"Quantity": o.Quantity,
+			"Price":    o.Price,
+		}).Debug("Algo child order")
+		// A child that does not get an acknowledgement in time is still
+		// entered
+		if _, err := a.match.PlaceOrder(o, a.interval); err == matcher.ErrQueueFull {
+			a.refused(o)
+		}
+	}
+}
+
+// refused takes back a child order the matcher queue had no room for, so
+// that the next step submits its quantity again
+func (a *algoService) refused(o *matcher.Order) {
+	a.log.WithFields(logrus.Fields{
+		"OrderId":  o.Id.String()[:10],
+		"Quantity": o.Quantity,
+	}).Warn("Algo child order refused, matcher queue is full")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	c, ok := a.children[o.Id]
+	if !ok {
+		return
+	}
+	delete(a.children, o.Id)
+	p := c.parent
+	p.Submitted -= o.Quantity
+	for i, id := range p.Children {
+		if id == o.Id {
+			p.Children = append(p.Children[:i], p.Children[i+1:]...)
+			break
+		}
+	}
+	p.Status = Working
+	p.stopped = time.Time{}
+}
+
+// prune drops the parents stopped for longer than the retention, with their
+// children, and starts the retention of the parents that just stopped
+func (a *algoService) prune(now time.Time) {
+	kept := a.parents[:0]
+	for _, p := range a.parents {
+		if p.Status != Working && p.stopped.IsZero() {
+			p.stopped = now
+		}
+		if p.stopped.IsZero() || now.Sub(p.stopped) < retention {
+			kept = append(kept, p)
+			continue
+		}
+		for _, id := range p.Children {
+			delete(a.children, id)
+		}
+	}
+	for i := len(kept); i < len(a.parents); i++ {
+		a.parents[i] = nil
+	}
+	a.parents = kept
+}
+
+// RunSchedules steps the schedules every interval
+func (a *algoService) RunSchedules(ctx context.Context) {
+	a.log.WithFields(logrus.Fields{
+		"Interval": a.interval}).Info("Starting to Run Algo Schedules")
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			a.log.Info("Stopped Running Algo Schedules")
+			return
+		case now := <-ticker.C:
+			a.Step(now)
+		}
+	}
+}
+
+// onTrade adds the fills of child orders to their parents, and the volume
+// traded by others to the VWAP parents.
+func (a *algoService) onTrade(t matcher.Trade) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	own := map[*Parent]bool{}
+	for _, id := range []uuid.UUID{t.BuyId, t.SellId} {
+		if c, ok := a.children[id]; ok {
+			p := c.parent
+			own[p] = true
+			p.Executed += t.Quantity
+			if p.Executed == p.Quantity {
+				p.Status = Completed
+			}
+			if c.remaining -= t.Quantity; c.remaining <= 0 {
+				delete(a.children, id)
+			}
+		}
+	}
+	for _, p := range a.parents {
+		if p.Strategy == VWAP && p.Status == Working && !own[p] {
+			p.volume += t.Quantity
+		}
+	}
+}
+
+// ParentOrders returns copies of the parent orders
+func (a *algoService) ParentOrders() []Parent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	parents := []Parent{}
+	for _, p := range a.parents {
+		c := *p
+		c.Children = append([]uuid.UUID(nil), p.Children...)
+		parents = append(parents, c)
+	}
+	return parents
+}
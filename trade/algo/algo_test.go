@@ -0,0 +1,190 @@
+package algo
+
+import (
+	"context"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+var t0 = time.Date(2022, 8, 14, 22, 0, 0, 0, time.UTC)
+
+func newTestAlgo() (Algo, matcher.Matcher, chan *matcher.Order) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	orders := make(chan *matcher.Order)
+	complete := make(chan *matcher.Order, 100)
+
+	match := matcher.NewMatcherService(orders, complete, nil, 600, 5*time.Second, 100, matcher.PersistResting, log)
+	go match.ExecuteOrders(context.Background())
+
+	return NewAlgoService(match, time.Second, log), match, orders
+}
+
+func newTestOrder(t matcher.Transaction, qty, price int) *matcher.Order {
+	return &matcher.Order{
+		Id:             uuid.New(),
+		OrderTime:      time.Now().UTC(),
+		Transaction:    t,
+		PlacedQuantity: qty,
+		Quantity:       qty,
+		Price:          price,
+		OrderType:      matcher.Limit,
+		Status:         matcher.Placed,
+	}
+}
+
+// progress waits for the matcher to process the orders sent so far and
+// returns the parent order
+func progress(a Algo, match matcher.Matcher) Parent {
+	match.LiveOrders()
+	return a.ParentOrders()[0]
+}
+
+func Test_Algo_TWAP(t *testing.T) {
+	a, match, orders := newTestAlgo()
+	_, err := a.Submit(&Parent{
+		Strategy:    TWAP,
+		Transaction: matcher.Buy,
+		OrderType:   matcher.Limit,
+		Quantity:    100,
+		Price:       50,
+		Duration:    100,
+		Slices:      4,
+		StartTime:   t0,
+	})
+	assert.NoError(t, err)
+
+	a.Step(t0)
+	a.Step(t0.Add(10 * time.Second))
+	p := progress(a, match)
+	assert.Equal(t, 25, p.Submitted)
+	assert.Len(t, p.Children, 1)
+
+	a.Step(t0.Add(25 * time.Second))
+	orders <- newTestOrder(matcher.Sell, 60, 50)
+	p = progress(a, match)
+	assert.Equal(t, 50, p.Submitted)
+	assert.Equal(t, 50, p.Executed)
+	assert.Equal(t, Working, p.Status)
+
+	// The end of the schedule submits the rest
+	a.Step(t0.Add(100 * time.Second))
+	p = progress(a, match)
+	assert.Equal(t, 100, p.Submitted)
+	assert.Equal(t, 60, p.Executed)
+	assert.Len(t, p.Children, 3)
+	assert.Equal(t, Finished, p.Status)
+
+	orders <- newTestOrder(matcher.Sell, 40, 50)
+	p = progress(a, match)
+	assert.Equal(t, 100, p.Executed)
+	assert.Equal(t, Completed, p.Status)
+	assert.Empty(t, a.(*algoService).children)
+
+	// A parent that stopped is listed, however often, until the retention
+	// has passed
+	a.Step(t0.Add(101 * time.Second))
+	a.ParentOrders()
+	a.Step(t0.Add(101*time.Second + retention/2))
+	assert.Len(t, a.ParentOrders(), 1)
+	a.Step(t0.Add(101*time.Second + retention))
+	assert.Empty(t, a.ParentOrders())
+}
+
+func Test_Algo_VWAP(t *testing.T) {
+	a, match, orders := newTestAlgo()
+	_, err := a.Submit(&Parent{
+		Strategy:      VWAP,
+		Transaction:   matcher.Sell,
+		OrderType:     matcher.Market,
+		Quantity:      10,
+		Price:         50,
+		Duration:      60,
+		Participation: 0.5,
+		StartTime:     t0,
+	})
+	assert.NoError(t, err)
+
+	// Nothing is due until others trade
+	a.Step(t0)
+	assert.Equal(t, 0, progress(a, match).Submitted)
+
+	orders <- newTestOrder(matcher.Buy, 8, 50)
+	orders <- newTestOrder(matcher.Sell, 8, 50)
+	match.LiveOrders()
+	a.Step(t0.Add(10 * time.Second))
+	p := progress(a, match)
+	assert.Equal(t, 4, p.Submitted)
+	assert.Equal(t, 0, p.Executed)
+
+	// Fills of its own children do not count as volume
+	orders <- newTestOrder(matcher.Buy, 30, 50)
+	match.LiveOrders()
+	a.Step(t0.Add(20 * time.Second))
+	p = progress(a, match)
+	assert.Equal(t, 4, p.Submitted)
+	assert.Equal(t, 4, p.Executed)
+
+	a.Step(t0.Add(60 * time.Second))
+	assert.Equal(t, Finished, progress(a, match).Status)
+}
+
+func Test_Algo_QueueFull(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	orders := make(chan *matcher.Order)
+	match := matcher.NewMatcherService(orders, make(chan *matcher.Order, 100), nil, 600, 5*time.Second, 0, matcher.PersistResting, log)
+	go match.ExecuteOrders(context.Background())
+	a := NewAlgoService(match, time.Second, log)
+
+	// A trade holds the matcher goroutine, so its queue has no room
+	release := make(chan struct{})
+	match.Subscribe(func(matcher.Trade) { <-release })
+	defer close(release)
+	orders <- newTestOrder(matcher.Buy, 5, 50)
+	orders <- newTestOrder(matcher.Sell, 5, 50)
+
+	// A child the matcher queue has no room for is submitted again
+	_, err := a.Submit(&Parent{
+		Strategy:    TWAP,
+		Transaction: matcher.Buy,
+		OrderType:   matcher.Limit,
+		Quantity:    10,
+		Price:       50,
+		Duration:    10,
+		Slices:      1,
+		StartTime:   t0,
+	})
+	assert.NoError(t, err)
+	a.Step(t0.Add(time.Hour))
+	p := a.ParentOrders()[0]
+	assert.Equal(t, 0, p.Submitted)
+	assert.Empty(t, p.Children)
+	assert.Equal(t, Working, p.Status)
+	assert.Empty(t, a.(*algoService).children)
+}
+
+func Test_Parent_Validate(t *testing.T) {
+	a, _, _ := newTestAlgo()
+	_, err := a.Submit(&Parent{Strategy: TWAP, Transaction: 3,
+		OrderType: matcher.Limit, Quantity: 10, Price: 50, Duration: 60})
+	assert.Error(t, err)
+	_, err = a.Submit(&Parent{Strategy: TWAP, Transaction: matcher.Buy,
+		OrderType: matcher.Stop, Quantity: 10, Price: 50, Duration: 60})
+	assert.Error(t, err)
+	_, err = a.Submit(&Parent{Strategy: VWAP, Transaction: matcher.Buy,
+		OrderType: matcher.Limit, Quantity: 10, Price: 50, Duration: 60})
+	assert.Error(t, err)
+	_, err = a.Submit(&Parent{Transaction: matcher.Buy,
+		OrderType: matcher.Limit, Quantity: 10, Price: 50, Duration: 60})
+	assert.Error(t, err)
+	assert.Empty(t, a.ParentOrders())
+}
@@ -1,60 +1,228 @@
 package api
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
-	"fmt"
+	"errors"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httputil"
+	"sync/atomic"
 	"time"
 
 	"github.com/golang/gddo/httputil/header"
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 
+	"github.com/nbasker/tools/trade/algo"
 	"github.com/nbasker/tools/trade/matcher"
 	"github.com/nbasker/tools/trade/store"
 )
 
 // Api REST Service
 type Api interface {
-	// Run the REST API service
-	Run()
+	// Run the REST API service until it is shut down
+	Run() error
+
+	// Shutdown stops accepting requests, ends the trade streams and waits
+	// for the requests in flight until the context is done.
+	Shutdown(ctx context.Context) error
+
+	// Handler returns the handler of the endpoints, to serve them from
+	// another server.
+	Handler() http.Handler
+
+	// Configure changes the acknowledgement timeout and the rate limits
+	// while the service runs.
+	Configure(ackTimeout time.Duration, limits Limits)
 }
 
 // apiService defines implementation of the REST Service
 type apiService struct {
-	endpoint string
-	och      chan<- *matcher.Order
-	retrieve store.Store
-	log      *logrus.Logger
+	// counters of the orders turned away and the acknowledgement timeout,
+	// changed while serving, first for 64-bit alignment
+	queueFull   uint64
+	rateLimited uint64
+	ackTimeout  int64
+
+	server    *http.Server
+	handler   http.Handler
+	stopping  chan struct{}
+	feed      tradeFeed
+	heartbeat time.Duration
+	sessions  *sessions
+	registry  *prometheus.Registry
+	latency   *prometheus.HistogramVec
+	endpoint  string
+	symbol    string
+	clientIds *clientOrders
+	match     matcher.Matcher
+	algos     algo.Algo
+	retrieve  store.Store
+	limiter   *rateLimiter
+	keys      map[string]*ApiKey
+	replays   replays
+	log       *logrus.Logger
 }
 
+// maxBody is the largest request body read, room for a batch of 100 orders
+// with every field set. A request with a larger one is answered 413.
+const maxBody = 64 << 10
+
+// bodyTooLarge is the error of a request body over maxBody
+const bodyTooLarge = "request body is too large"
+
 // NewApiService returns a new apiService
 func NewApiService(ep string,
-	och chan<- *matcher.Order,
+	symbol string,
+	ackTimeout time.Duration,
+	idempotencyWindow time.Duration,
+	heartbeat time.Duration,
+	match matcher.Matcher,
+	algos algo.Algo,
 	retrieve store.Store,
+	limits Limits,
+	keys []ApiKey,
 	log *logrus.Logger,
 ) Api {
-	return &apiService{
-		endpoint: ep,
-		och:      och,
-		retrieve: retrieve,
-		log:      log,
+	a := &apiService{
+		ackTimeout: int64(ackTimeout),
+		heartbeat:  heartbeat,
+		sessions:   newSessions(keys),
+		endpoint:   ep,
+		symbol:     symbol,
+		clientIds:  newClientOrders(idempotencyWindow),
+		match:      match,
+		algos:      algos,
+		retrieve:   retrieve,
+		limiter:    newRateLimiter(limits),
+		keys:       make(map[string]*ApiKey),
+		log:        log,
+	}
+	for i := range keys {
+		a.keys[keys[i].Key] = &keys[i]
 	}
+	a.registry = a.newRegistry()
+	a.handler = a.routes()
+	a.stopping = make(chan struct{})
+	a.server = &http.Server{Addr: ep, Handler: a.handler}
+	a.server.RegisterOnShutdown(func() { close(a.stopping) })
+	return a
 }
 
-func (a *apiService) Run() {
+// Run serves the API, returning nil once it is shut down
+func (a *apiService) Run() error {
 	a.log.WithFields(logrus.Fields{
 		"endpoint": a.endpoint,
+		"keys":     len(a.keys),
 	}).Info("Starting REST Api Service")
-	http.HandleFunc("/trade", a.PlaceOrder)
-	http.HandleFunc("/orders", a.GetOrders)
-	http.ListenAndServe(a.endpoint, nil)
+	if len(a.keys) == 0 {
+		a.log.Warn("No API keys, requests are not authenticated")
+	}
+	if err := a.server.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
 }
 
-func (a *apiService) PlaceOrder(w http.ResponseWriter, req *http.Request) {
+// Configure changes the settings the handlers read while serving
+func (a *apiService) Configure(ackTimeout time.Duration, limits Limits) {
+	atomic.StoreInt64(&a.ackTimeout, int64(ackTimeout))
+	a.limiter.setLimits(limits)
+}
+
+// Handler returns the endpoints with their authentication
+func (a *apiService) Handler() http.Handler {
+	return a.handler
+}
+
+// Shutdown stops the listener and waits for the handlers to return
+func (a *apiService) Shutdown(ctx context.Context) error {
+	a.log.Info("Stopping REST Api Service")
+	return a.server.Shutdown(ctx)
+}
 
+// route is an endpoint and its handler
+type route struct {
+	path    string
+	handler http.HandlerFunc
+}
+
+// v1Routes are the versioned endpoints
+func (a *apiService) v1Routes() []route {
+	return []route{
+		{"/v1/orders", a.Orders},
+		{"/v1/orders/batch", a.PlaceOrders},
+		{"/v1/orders/", a.Order},
+		{"/v1/orders/client/", a.ClientOrder},
+		{"/v1/stops", a.GetStopOrders},
+		{"/v1/book", a.GetBook},
+		{"/v1/groups", a.PlaceGroup},
+		{"/v1/algos", a.Algos},
+		{"/v1/metrics", a.GetMetrics},
+		{"/v1/trades/stream", a.StreamTrades},
+		{"/v1/accounts/", a.Account},
+	}
+}
+
+// routes maps the v1 endpoints to their handlers and the debug endpoints to
+// theirs for admins, behind the authentication, and the Prometheus metrics
+// and the OpenAPI document, which are left open
+func (a *apiService) routes() http.Handler {
+	mux := http.NewServeMux()
+	for _, r := range a.v1Routes() {
+		mux.Handle(r.path, a.instrument(r.path, a.authenticate(r.handler)))
+	}
+	for _, r := range a.debugRoutes() {
+		mux.Handle(r.path, a.instrument(r.path, a.authenticate(a.admin(r.handler))))
+	}
+	mux.Handle(metricsPath, promhttp.HandlerFor(a.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc(specPath, a.GetSpec)
+	return mux
+}
+
+// writeJSON writes v as the JSON response body with the status code
+func (a *apiService) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		a.log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to encode response")
+	}
+}
+
+// writeError writes an ErrorResponse with the status code
+func (a *apiService) writeError(w http.ResponseWriter, status int, msg string,
+	fields []FieldError) {
+	a.writeJSON(w, status, ErrorResponse{Error: msg, Fields: fields})
+}
+
+// allowMethod replies 405 unless the request uses one of the methods
+func (a *apiService) allowMethod(w http.ResponseWriter, req *http.Request,
+	methods ...string) bool {
+	for _, m := range methods {
+		if req.Method == m {
+			return true
+		}
+	}
+	for _, m := range methods {
+		w.Header().Add("Allow", m)
+	}
+	a.writeError(w, http.StatusMethodNotAllowed,
+		"method "+req.Method+" is not allowed", nil)
+	return false
+}
+
+// decodeBody validates the JSON request body against the schema of the
+// OpenAPI document named after the type of v, and decodes it into v. It
+// replies 415, 413 or 400 and returns false if it cannot.
+func (a *apiService) decodeBody(w http.ResponseWriter, req *http.Request, v interface{}) bool {
+	req.Body = http.MaxBytesReader(w, req.Body, maxBody)
 	dump, err := httputil.DumpRequest(req, true)
 	if err != nil {
 		a.log.WithFields(logrus.Fields{
@@ -67,45 +235,306 @@ func (a *apiService) PlaceOrder(w http.ResponseWriter, req *http.Request) {
 		value, _ := header.ParseValueAndParams(req.Header, "Content-Type")
 		if value != "application/json" {
 			a.log.Error("Unsupported Content-Type")
-			msg := "Content-Type header is not application/json"
-			http.Error(w, msg, http.StatusUnsupportedMediaType)
+			a.writeError(w, http.StatusUnsupportedMediaType,
+				"Content-Type header is not application/json", nil)
+			return false
+		}
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		if err.Error() == "http: request body too large" {
+			a.writeError(w, http.StatusRequestEntityTooLarge, bodyTooLarge, nil)
+		} else {
+			a.writeError(w, http.StatusBadRequest, "unable to read the request body", nil)
+		}
+		return false
+	}
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	err = dec.Decode(&doc)
+	if err == nil {
+		if errs := apiSpec.validate(schemaName(v), doc); len(errs) > 0 {
+			a.writeError(w, http.StatusBadRequest, "invalid request body", errs)
+			return false
+		}
+		dec = json.NewDecoder(bytes.NewReader(body))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(v)
+	}
+	if err != nil {
+		a.log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to decode request body")
+
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) {
+			a.writeError(w, http.StatusBadRequest, "invalid request body",
+				[]FieldError{{Field: typeErr.Field, Message: "must be a " + typeErr.Type.String()}})
+		} else if errors.Is(err, io.EOF) {
+			a.writeError(w, http.StatusBadRequest, "request body is empty", nil)
+		} else {
+			a.writeError(w, http.StatusBadRequest, "invalid request body: "+err.Error(), nil)
+		}
+		return false
+	}
+	return true
+}
+
+func (a *apiService) logRequest(req *http.Request) {
+	a.log.WithFields(logrus.Fields{
+		"Host":   req.URL.Host,
+		"Path":   req.URL.Path,
+		"Method": req.Method,
+	}).Info("Received")
+}
+
+// Orders places an order on POST, queries the orders on GET and cancels
+// them on DELETE
+func (a *apiService) Orders(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		a.GetOrders(w, req)
+	case http.MethodDelete:
+		a.CancelOrders(w, req)
+	default:
+		a.PlaceOrder(w, req)
+	}
+}
+
+// PlaceOrder replies with the state of the order after it matched on
+// arrival: resting, filled with its fills or rejected with the reason. If the
+// matcher does not acknowledge it in time, the order is accepted and its
+// state is left to be looked up. An order with a client order id, given in
+// the body or as the Idempotency-Key header, is placed once per account
+// within the idempotency window. Repeating it returns the original order.
+func (a *apiService) PlaceOrder(w http.ResponseWriter, req *http.Request) {
+	if !a.limitRate(w, req) {
+		return
+	}
+	var r OrderRequest
+	if !a.decodeBody(w, req, &r) {
+		return
+	}
+	var ok bool
+	if r.Account, ok = a.orderAccount(w, req, r.Account); !ok {
+		return
+	}
+	key := req.Header.Get("Idempotency-Key")
+	if r.ClientOrderId == "" {
+		r.ClientOrderId = key
+	}
+	errs := r.validate("", a.symbol)
+	if key != "" && r.ClientOrderId != key {
+		errs = append(errs, FieldError{"client_order_id", "must match the Idempotency-Key header"})
+	}
+	if len(errs) > 0 {
+		a.writeError(w, http.StatusBadRequest, "invalid order", errs)
+		return
+	}
+
+	order := r.order(a.symbol)
+	k := clientKey{r.Account, r.ClientOrderId}
+	if r.ClientOrderId != "" {
+		if co, ok := a.clientIds.reserve(k, r, order.Id, time.Now()); !ok {
+			a.replayOrder(w, co, r)
 			return
 		}
 	}
+	a.log.WithFields(logrus.Fields{
+		"OrderId":       order.Id.String(),
+		"ClientOrderId": order.ClientOrderId,
+		"Transaction":   order.Transaction,
+		"OrderType":     order.OrderType,
+		"Quantity":      order.Quantity,
+		"Price":         order.Price,
+	}).Debug("Order Received")
 
-	var order matcher.Order
-	if err := json.NewDecoder(req.Body).Decode(&order); err != nil {
-		a.log.Error("Unable to decode order")
-		http.Error(w, http.StatusText(http.StatusInternalServerError),
-			http.StatusInternalServerError)
+	resp := OrderResponse{Order: *order}
+	ack, err := a.match.PlaceOrder(order, time.Duration(atomic.LoadInt64(&a.ackTimeout)))
+	if r.ClientOrderId != "" {
+		if err == matcher.ErrQueueFull {
+			a.clientIds.release(k)
+		} else {
+			a.clientIds.placed(k)
+		}
+	}
+	switch err {
+	case nil:
+		resp = OrderResponse{Order: ack.Order, Fills: fillsFor(principal(req), ack.Fills)}
+	case matcher.ErrQueueFull:
+		a.refuseQueueFull(w)
+		return
+	case matcher.ErrAckTimeout:
+		a.log.WithFields(logrus.Fields{
+			"OrderId": order.Id.String(),
+		}).Info("Order not acknowledged in time")
+		w.Header().Set("Location", "/v1/orders/"+order.Id.String())
+		a.writeJSON(w, http.StatusAccepted, resp)
+		return
+	default:
+		a.log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to place order")
+		a.writeError(w, http.StatusInternalServerError, err.Error(), nil)
 		return
 	}
 
-	// allocate unique orderId
-	order.Id = uuid.New()
-	order.OrderTime = time.Now().UTC()
-	order.Executed = 0
-	order.PlacedQuantity = order.Quantity
-	order.Status = matcher.Placed
-	resp := fmt.Sprintf("Received Order [%s, %s, %d, %d], Id = %s\n",
-		order.Transaction.String(),
-		order.OrderType.String(),
-		order.Quantity,
-		order.Price,
-		order.Id.String())
+	w.Header().Set("Location", "/v1/orders/"+order.Id.String())
+	a.writeJSON(w, http.StatusCreated, resp)
+}
 
-	a.log.WithFields(logrus.Fields{"details": resp}).Debug("Order Received")
+// replayOrder answers a repeated submission of a client order id with the
+// current state of the original order
+func (a *apiService) replayOrder(w http.ResponseWriter, co clientOrder, r OrderRequest) {
+	res := a.replay(co, r)
+	if res.Order == nil {
+		a.writeError(w, res.Status, res.Error, nil)
+		return
+	}
+	w.Header().Set("Location", "/v1/orders/"+res.Order.Id.String())
+	w.Header().Set("Idempotent-Replayed", "true")
+	a.writeJSON(w, res.Status, OrderResponse{Order: *res.Order})
+}
 
-	a.och <- &order
+// replay returns the original order of a repeated client order id, or why
+// it cannot be returned
+func (a *apiService) replay(co clientOrder, r OrderRequest) BatchResult {
+	if co.req != r {
+		return BatchResult{Status: http.StatusUnprocessableEntity,
+			Error: "client order id " + r.ClientOrderId + " was used for a different order"}
+	}
+	o, ok := a.findOrder(co.id)
+	if co.pending || !ok {
+		return BatchResult{Status: http.StatusConflict,
+			Error: "order with client order id " + r.ClientOrderId + " is being placed"}
+	}
+	return BatchResult{Status: http.StatusOK, Order: &o}
+}
 
-	io.WriteString(w, resp)
+func (a *apiService) GetStopOrders(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	a.logRequest(req)
+
+	stops := []StopOrder{}
+	for _, o := range a.match.LiveOrders() {
+		if !o.IsStop() || !visible(req, o.Account) {
+			continue
+		}
+		state := "untriggered"
+		if o.Triggered {
+			state = "triggered"
+		}
+		stops = append(stops, StopOrder{Order: o, State: state})
+	}
+	a.writeJSON(w, http.StatusOK, StopOrdersResponse{Orders: stops})
 }
 
-func (a *apiService) GetOrders(w http.ResponseWriter, req *http.Request) {
+func (a *apiService) GetBook(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	a.logRequest(req)
+	a.writeJSON(w, http.StatusOK, BookResponse{Book: a.match.Depth()})
+}
+
+func (a *apiService) PlaceGroup(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	if !a.limitRate(w, req) {
+		return
+	}
+	var r GroupRequest
+	if !a.decodeBody(w, req, &r) {
+		return
+	}
+	for i := range r.Orders {
+		var ok bool
+		if r.Orders[i].Account, ok = a.orderAccount(w, req, r.Orders[i].Account); !ok {
+			return
+		}
+	}
+	if errs := r.validate(a.symbol); len(errs) > 0 {
+		a.writeError(w, http.StatusBadRequest, "invalid group", errs)
+		return
+	}
+
+	group := &matcher.Group{Id: uuid.New(), Type: r.Type}
+	for i := range r.Orders {
+		group.Orders = append(group.Orders, r.Orders[i].order(a.symbol))
+	}
+	placed, err := a.match.PlaceGroup(group)
+	if err == matcher.ErrQueueFull {
+		a.refuseQueueFull(w)
+		return
+	}
+	if err != nil {
+		a.log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to place group")
+		a.writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
 	a.log.WithFields(logrus.Fields{
-		"Host":   req.URL.Host,
-		"Path":   req.URL.Path,
-		"Method": req.Method,
-	}).Info("Received")
-	io.WriteString(w, a.retrieve.RetrieveExecutedOrders())
+		"GroupId": group.Id.String(),
+		"Type":    group.Type,
+		"Orders":  len(group.Orders),
+	}).Debug("Group Received")
+
+	a.writeJSON(w, http.StatusCreated, GroupResponse{
+		Id:     group.Id,
+		Type:   group.Type,
+		Orders: placed,
+	})
+}
+
+// Algos places a parent order on POST and returns the parent orders'
+// progress on GET
+func (a *apiService) Algos(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet, http.MethodPost) {
+		return
+	}
+	a.logRequest(req)
+
+	if req.Method == http.MethodGet {
+		algos := []algo.Parent{}
+		for _, p := range a.algos.ParentOrders() {
+			if visible(req, p.Account) {
+				algos = append(algos, p)
+			}
+		}
+		a.writeJSON(w, http.StatusOK, AlgosResponse{Algos: algos})
+		return
+	}
+
+	if !a.limitRate(w, req) {
+		return
+	}
+	var r AlgoRequest
+	if !a.decodeBody(w, req, &r) {
+		return
+	}
+	var ok bool
+	if r.Account, ok = a.orderAccount(w, req, r.Account); !ok {
+		return
+	}
+	if errs := r.validate(a.symbol); len(errs) > 0 {
+		a.writeError(w, http.StatusBadRequest, "invalid algo order", errs)
+		return
+	}
+
+	parent, err := a.algos.Submit(r.parent(a.symbol))
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	a.writeJSON(w, http.StatusCreated, AlgoResponse{Algo: parent})
 }
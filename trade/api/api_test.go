@@ -0,0 +1,1298 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nbasker/tools/trade/algo"
+	"github.com/nbasker/tools/trade/matcher"
+	"github.com/nbasker/tools/trade/store"
+)
+
+// newTestApi returns the api over a running matcher and store
+func newTestApi() *apiService {
+	return newLimitedTestApi(100, Limits{}, nil, true)
+}
+
+// newLimitedTestApi returns the api with the matcher queue depth, rate
+// limits and keys, over a matcher that may not be running
+func newLimitedTestApi(queueDepth int, limits Limits, keys []ApiKey, run bool) *apiService {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	orders := make(chan *matcher.Order)
+	complete := make(chan *matcher.Order)
+	events := make(chan matcher.Event)
+	st := store.NewStorageService(complete, events, nil, log)
+	go st.StoreCompletedOrders()
+	match := matcher.NewMatcherService(orders, complete, events, 600, 5*time.Second, queueDepth, matcher.PersistResting, log)
+	if run {
+		go match.ExecuteOrders(context.Background())
+	}
+	return NewApiService("", "SAMPLE", time.Second, time.Hour, time.Second, match, nil, st, limits, keys, log).(*apiService)
+}
+
+// asAdmin returns the request as authenticated with an admin key
+func asAdmin(req *http.Request) *http.Request {
+	return req.WithContext(context.WithValue(req.Context(), principalKey{}, &ApiKey{Key: "adm", Role: Admin}))
+}
+
+func Test_Api_PlaceOrder(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		wantStatus  int
+		wantFields  []string
+	}{
+		{
+			name:       "Valid",
+			method:     http.MethodPost,
+			body:       `{"transaction":1,"quantity":48,"price":534,"order_type":2}`,
+			wantStatus: http.StatusCreated,
+		},
+		{
+			name:       "TooLarge",
+			method:     http.MethodPost,
+			body:       `{"client_order_id":"` + strings.Repeat("x", maxBody) + `"}`,
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:       "InvalidFields",
+			method:     http.MethodPost,
+			body:       `{"transaction":3,"quantity":-1,"price":534,"order_type":9}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"transaction", "order_type", "quantity"},
+		},
+		{
+			name:       "StopWithoutTrigger",
+			method:     http.MethodPost,
+			body:       `{"transaction":1,"quantity":10,"order_type":3}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"trigger_price"},
+		},
+		{
+			name:       "PeggedMinQuantity",
+			method:     http.MethodPost,
+			body:       `{"transaction":1,"quantity":10,"order_type":6,"peg_reference":1,"min_quantity":5,"all_or_none":true}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"all_or_none", "min_quantity"},
+		},
+		{
+			name:       "WrongType",
+			method:     http.MethodPost,
+			body:       `{"transaction":"buy","quantity":10,"price":5,"order_type":2}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"transaction"},
+		},
+		{
+			name:       "UnknownField",
+			method:     http.MethodPost,
+			body:       `{"transaction":1,"quantity":10,"price":5,"order_type":2,"id":"x"}`,
+			wantStatus: http.StatusBadRequest,
+			wantFields: []string{"id"},
+		},
+		{
+			name:       "MalformedBody",
+			method:     http.MethodPost,
+			body:       `{"transaction":1,`,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:        "UnsupportedContentType",
+			method:      http.MethodPost,
+			contentType: "text/plain",
+			body:        `{"transaction":1,"quantity":48,"price":534,"order_type":2}`,
+			wantStatus:  http.StatusUnsupportedMediaType,
+		},
+		{
+			name:       "MethodNotAllowed",
+			method:     http.MethodPut,
+			wantStatus: http.StatusMethodNotAllowed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApi()
+
+			req := httptest.NewRequest(tt.method, "/v1/orders", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			rec := httptest.NewRecorder()
+			a.routes().ServeHTTP(rec, req)
+
+			assert.Equal(t, tt.wantStatus, rec.Code)
+			assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+
+			if tt.wantStatus == http.StatusCreated {
+				var resp OrderResponse
+				assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+				o, ok := a.match.LiveOrder(resp.Order.Id)
+				assert.True(t, ok)
+				assert.Equal(t, o, resp.Order)
+				assert.Equal(t, matcher.Placed, resp.Order.Status)
+				assert.Equal(t, 48, resp.Order.PlacedQuantity)
+				return
+			}
+
+			var resp ErrorResponse
+			assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+			assert.NotEmpty(t, resp.Error)
+			var fields []string
+			for _, f := range resp.Fields {
+				fields = append(fields, f.Field)
+			}
+			assert.Equal(t, tt.wantFields, fields)
+			assert.Empty(t, a.match.LiveOrders())
+		})
+	}
+}
+
+func Test_GroupRequest_Validate(t *testing.T) {
+	r := GroupRequest{
+		Type: matcher.Bracket,
+		Orders: []OrderRequest{
+			{Transaction: matcher.Buy, OrderType: matcher.Limit, Quantity: 10, Price: 100},
+			{Transaction: matcher.Sell, OrderType: matcher.Iceberg, Quantity: 10, Price: 110},
+		},
+	}
+	assert.Equal(t, []FieldError{{
+		Field:   "orders[1].display_quantity",
+		Message: "must be between 1 and quantity",
+	}}, r.validate("SAMPLE"))
+}
+
+func Test_OrderQuery_Page(t *testing.T) {
+	t0 := time.Date(2022, 8, 14, 22, 0, 0, 0, time.UTC)
+	var orders []matcher.Order
+	for i := 0; i < 5; i++ {
+		orders = append(orders, matcher.Order{
+			Id:          uuid.New(),
+			OrderTime:   t0.Add(time.Duration(i) * time.Minute),
+			Transaction: matcher.Buy,
+			Status:      matcher.Completed,
+			Account:     "acc1",
+		})
+	}
+	orders[1].Transaction = matcher.Sell
+	orders[3].Account = "acc2"
+
+	f, errs := parseOrderQuery(url.Values{"side": {"buy"}, "limit": {"2"}})
+	assert.Empty(t, errs)
+	page, next := store.Page(append([]matcher.Order(nil), orders...), f)
+	assert.Equal(t, []matcher.Order{orders[0], orders[2]}, page)
+	assert.NotNil(t, next)
+
+	f, errs = parseOrderQuery(url.Values{"side": {"buy"}, "limit": {"2"}, "cursor": {next.String()}})
+	assert.Empty(t, errs)
+	page, next = store.Page(append([]matcher.Order(nil), orders...), f)
+	assert.Equal(t, []matcher.Order{orders[3], orders[4]}, page)
+	assert.Nil(t, next)
+
+	f, errs = parseOrderQuery(url.Values{
+		"account": {"acc1"},
+		"status":  {"completed"},
+		"from":    {t0.Add(time.Minute).Format(time.RFC3339)},
+		"to":      {t0.Add(4 * time.Minute).Format(time.RFC3339)},
+	})
+	assert.Empty(t, errs)
+	page, _ = store.Page(append([]matcher.Order(nil), orders...), f)
+	assert.Equal(t, []matcher.Order{orders[1], orders[2]}, page)
+
+	_, errs = parseOrderQuery(url.Values{
+		"status": {"done"}, "side": {"long"}, "limit": {"0"}, "cursor": {"x"},
+	})
+	assert.Len(t, errs, 4)
+}
+
+func Test_Api_QueryOrders(t *testing.T) {
+	a := newTestApi()
+	place := func(body string) {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/v1/orders", strings.NewReader(body)))
+		assert.Equal(t, http.StatusCreated, rec.Code)
+	}
+	for i := 0; i < 3; i++ {
+		place(`{"transaction":1,"quantity":10,"price":90,"order_type":2}`)
+		place(`{"transaction":1,"quantity":10,"price":100,"order_type":2}`)
+		place(`{"transaction":2,"quantity":10,"price":100,"order_type":2}`)
+	}
+	assert.Eventually(t, func() bool { return a.retrieve.Summary().Orders == 6 }, time.Second, time.Millisecond)
+
+	all, next := a.queryOrders(store.Query{})
+	assert.Nil(t, next)
+	assert.Len(t, all, 9)
+
+	// The pages interleave the live and the stored orders
+	var paged []matcher.Order
+	q := store.Query{Limit: 2}
+	for {
+		page, next := a.queryOrders(q)
+		paged = append(paged, page...)
+		if next == nil {
+			break
+		}
+		q.After = next
+	}
+	assert.Equal(t, all, paged)
+}
+
+func Test_Api_GetOrder(t *testing.T) {
+	a := newTestApi()
+
+	place := func(body string) matcher.Order {
+		req := httptest.NewRequest(http.MethodPost, "/v1/orders", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var resp OrderResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, "/v1/orders/"+resp.Order.Id.String(), rec.Header().Get("Location"))
+		return resp.Order
+	}
+	get := func(path string) (int, matcher.Order) {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		var resp OrderResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp.Order
+	}
+
+	sell := place(`{"transaction":2,"quantity":10,"price":100,"order_type":2}`)
+	code, o := get("/v1/orders/" + sell.Id.String())
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, matcher.Placed, o.Status)
+	assert.Equal(t, "SAMPLE", o.Symbol)
+
+	place(`{"transaction":1,"quantity":10,"price":100,"order_type":2}`)
+	assert.Eventually(t, func() bool {
+		_, o = get("/v1/orders/" + sell.Id.String())
+		return o.Status == matcher.Completed
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 10, o.Executed)
+
+	code, _ = get("/v1/orders/" + uuid.New().String())
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = get("/v1/orders/abc")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
+
+func Test_Api_OrderHistory(t *testing.T) {
+	a := newTestApi()
+	do := func(method, uri, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, httptest.NewRequest(method, uri, strings.NewReader(body)))
+		return rec
+	}
+	history := func(uri string) (int, HistoryResponse) {
+		rec := do(http.MethodGet, uri, "")
+		var resp HistoryResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	var sell OrderResponse
+	assert.NoError(t, json.Unmarshal(do(http.MethodPost, "/v1/orders",
+		`{"transaction":2,"quantity":10,"price":100,"order_type":2}`).Body.Bytes(), &sell))
+	uri := "/v1/orders/" + sell.Order.Id.String() + "/history"
+	do(http.MethodPost, "/v1/orders", `{"transaction":1,"quantity":4,"price":100,"order_type":2}`)
+	assert.Eventually(t, func() bool {
+		_, h := history(uri)
+		return len(h.Events) == 2
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, http.StatusOK, do(http.MethodPatch, "/v1/orders/"+sell.Order.Id.String(), `{"price":101}`).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodDelete, "/v1/orders/"+sell.Order.Id.String(), "").Code)
+
+	var h HistoryResponse
+	assert.Eventually(t, func() bool {
+		_, h = history(uri)
+		return len(h.Events) == 4
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, sell.Order.Id, h.OrderId)
+	var types []matcher.EventType
+	var causes []string
+	for _, e := range h.Events {
+		assert.Equal(t, sell.Order.Id, e.OrderId)
+		types = append(types, e.Type)
+		causes = append(causes, e.Cause)
+	}
+	assert.Equal(t, []matcher.EventType{
+		matcher.EventPlaced, matcher.EventPartiallyFilled, matcher.EventAmended, matcher.EventCancelled,
+	}, types)
+	assert.Equal(t, "new order", causes[0])
+	assert.Equal(t, "cancel request", causes[3])
+	assert.Equal(t, 6, h.Events[3].Quantity)
+	assert.Equal(t, 4, h.Events[3].Executed)
+
+	code, _ := history("/v1/orders/" + uuid.New().String() + "/history")
+	assert.Equal(t, http.StatusNotFound, code)
+	code, _ = history("/v1/orders/abc/history")
+	assert.Equal(t, http.StatusBadRequest, code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodDelete, uri, "").Code)
+}
+
+func Test_Api_PlaceOrder_Ack(t *testing.T) {
+	a := newTestApi()
+	place := func(body string) (int, OrderResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/orders", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, req)
+		var resp OrderResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return rec.Code, resp
+	}
+
+	code, rest := place(`{"transaction":2,"quantity":10,"price":100,"order_type":2}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, matcher.Placed, rest.Order.Status)
+	assert.Empty(t, rest.Fills)
+
+	code, fill := place(`{"transaction":1,"quantity":4,"price":100,"order_type":2}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, matcher.Completed, fill.Order.Status)
+	assert.Equal(t, 4, fill.Order.Executed)
+	if assert.Len(t, fill.Fills, 1) {
+		assert.Equal(t, fill.Order.Id, fill.Fills[0].BuyId)
+		assert.Equal(t, rest.Order.Id, fill.Fills[0].SellId)
+		assert.Equal(t, 4, fill.Fills[0].Quantity)
+	}
+
+	code, rej := place(`{"transaction":1,"quantity":10,"price":100,"order_type":2,"all_or_none":true}`)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, matcher.Rejected, rej.Order.Status)
+	assert.NotEmpty(t, rej.Order.RejectReason)
+	assert.Empty(t, rej.Fills)
+}
+
+func Test_RateLimiter_Allow(t *testing.T) {
+	l := newRateLimiter(Limits{Rate: 2, Burst: 3})
+	now := time.Date(2022, 8, 14, 22, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 3; i++ {
+		ok, _ := l.allow("a", now)
+		assert.True(t, ok)
+	}
+	ok, wait := l.allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	// Other clients have their own bucket
+	ok, _ = l.allow("b", now)
+	assert.True(t, ok)
+
+	ok, _ = l.allow("a", now.Add(500*time.Millisecond))
+	assert.True(t, ok)
+	ok, _ = l.allow("a", now.Add(500*time.Millisecond))
+	assert.False(t, ok)
+
+	ok, _ = newRateLimiter(Limits{}).allow("a", now)
+	assert.True(t, ok)
+}
+
+func Test_Api_Overload(t *testing.T) {
+	body := `{"transaction":1,"quantity":10,"price":100,"order_type":2}`
+	post := func(a *apiService) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/orders", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, req)
+		return rec
+	}
+	metrics := func(a *apiService) MetricsResponse {
+		rec := httptest.NewRecorder()
+		a.GetMetrics(rec, asAdmin(httptest.NewRequest(http.MethodGet, "/v1/metrics", nil)))
+		var resp MetricsResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+
+	// The matcher is not running, so its queue has no room
+	a := newLimitedTestApi(0, Limits{}, nil, false)
+	rec := post(a)
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	assert.Equal(t, MetricsResponse{RejectedQueueFull: 1}, metrics(a))
+
+	a = newLimitedTestApi(10, Limits{Rate: 0.5, Burst: 2}, nil, true)
+	assert.Equal(t, http.StatusCreated, post(a).Code)
+	assert.Equal(t, http.StatusCreated, post(a).Code)
+	rec = post(a)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "2", rec.Header().Get("Retry-After"))
+	assert.Equal(t, MetricsResponse{QueueCapacity: 10, RejectedRateLimited: 1}, metrics(a))
+}
+
+func Test_Api_Configure(t *testing.T) {
+	body := `{"transaction":1,"quantity":10,"price":100,"order_type":2}`
+	post := func(a *apiService) int {
+		req := httptest.NewRequest(http.MethodPost, "/v1/orders", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	a := newTestApi()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, http.StatusCreated, post(a))
+	}
+
+	a.Configure(time.Minute, Limits{Rate: 0.5, Burst: 1})
+	assert.Equal(t, time.Minute, time.Duration(a.ackTimeout))
+	assert.Equal(t, http.StatusCreated, post(a))
+	assert.Equal(t, http.StatusTooManyRequests, post(a))
+
+	a.Configure(time.Second, Limits{})
+	assert.Equal(t, http.StatusCreated, post(a))
+}
+
+func Test_ClientOrders_Expire(t *testing.T) {
+	c := newClientOrders(time.Minute)
+	now := time.Date(2022, 8, 14, 22, 0, 0, 0, time.UTC)
+	k := clientKey{"acc1", "c1"}
+	id := uuid.New()
+
+	_, ok := c.reserve(k, OrderRequest{}, id, now)
+	assert.True(t, ok)
+	co, ok := c.reserve(k, OrderRequest{}, uuid.New(), now)
+	assert.False(t, ok)
+	assert.Equal(t, id, co.id)
+
+	// Pending orders are not found until placed
+	_, ok = c.lookup(k, now)
+	assert.False(t, ok)
+	c.placed(k)
+	found, ok := c.lookup(k, now)
+	assert.True(t, ok)
+	assert.Equal(t, id, found)
+
+	// The same id in another account is another order
+	_, ok = c.reserve(clientKey{"acc2", "c1"}, OrderRequest{}, uuid.New(), now)
+	assert.True(t, ok)
+
+	_, ok = c.lookup(k, now.Add(time.Minute))
+	assert.False(t, ok)
+	_, ok = c.reserve(k, OrderRequest{}, uuid.New(), now.Add(time.Minute))
+	assert.True(t, ok)
+
+	// A released key reserved again does not expire with its first entry
+	c.release(k)
+	_, ok = c.reserve(k, OrderRequest{}, uuid.New(), now.Add(90*time.Second))
+	assert.True(t, ok)
+	_, ok = c.reserve(k, OrderRequest{}, uuid.New(), now.Add(2*time.Minute))
+	assert.False(t, ok)
+}
+
+func Test_Api_ClientOrderId(t *testing.T) {
+	a := newTestApi()
+	do := func(method, path, key, body string) (int, OrderResponse, http.Header) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if key != "" {
+			req.Header.Set("Idempotency-Key", key)
+		}
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, req)
+		var resp OrderResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp, rec.Header()
+	}
+	body := `{"client_order_id":"c-1","account":"acc1","transaction":2,"quantity":10,"price":100,"order_type":2}`
+
+	code, first, _ := do(http.MethodPost, "/v1/orders", "", body)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "c-1", first.Order.ClientOrderId)
+
+	code, again, h := do(http.MethodPost, "/v1/orders", "", body)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, first.Order.Id, again.Order.Id)
+	assert.Equal(t, "true", h.Get("Idempotent-Replayed"))
+
+	code, _, _ = do(http.MethodPost, "/v1/orders", "",
+		`{"client_order_id":"c-1","account":"acc1","transaction":2,"quantity":20,"price":100,"order_type":2}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, code)
+
+	// The Idempotency-Key header is the client order id if the body has none
+	keyed := `{"account":"acc1","transaction":2,"quantity":5,"price":101,"order_type":2}`
+	code, byKey, _ := do(http.MethodPost, "/v1/orders", "k-1", keyed)
+	assert.Equal(t, http.StatusCreated, code)
+	assert.Equal(t, "k-1", byKey.Order.ClientOrderId)
+	code, again, _ = do(http.MethodPost, "/v1/orders", "k-1", keyed)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, byKey.Order.Id, again.Order.Id)
+	code, _, _ = do(http.MethodPost, "/v1/orders", "k-2", body)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, amended, _ := do(http.MethodPatch, "/v1/orders/client/c-1?account=acc1", "", `{"quantity":6}`)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, first.Order.Id, amended.Order.Id)
+	assert.Equal(t, 6, amended.Order.Quantity)
+
+	code, _, _ = do(http.MethodGet, "/v1/orders/client/c-1?account=acc2", "", "")
+	assert.Equal(t, http.StatusNotFound, code)
+
+	code, cancelled, _ := do(http.MethodDelete, "/v1/orders/client/c-1?account=acc1", "", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, matcher.Cancelled, cancelled.Order.Status)
+
+	assert.Eventually(t, func() bool {
+		code, _, _ = do(http.MethodDelete, "/v1/orders/"+first.Order.Id.String(), "", "")
+		return code == http.StatusConflict
+	}, time.Second, 10*time.Millisecond)
+	code, _, _ = do(http.MethodDelete, "/v1/orders/"+uuid.New().String(), "", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func Test_Api_PlaceOrders(t *testing.T) {
+	a := newLimitedTestApi(100, Limits{Rate: 1, Burst: 5}, nil, true)
+	post := func(body string) (int, BatchResponse) {
+		req := httptest.NewRequest(http.MethodPost, "/v1/orders/batch", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, req)
+		var resp BatchResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+
+	code, resp := post(`{"orders":[` +
+		`{"transaction":2,"quantity":10,"price":100,"order_type":2},` +
+		`{"transaction":1,"quantity":4,"price":100,"order_type":2},` +
+		`{"transaction":1,"quantity":4,"order_type":2},` +
+		`{"client_order_id":"b-1","transaction":1,"quantity":1,"price":90,"order_type":2},` +
+		`{"client_order_id":"b-1","transaction":1,"quantity":1,"price":90,"order_type":2},` +
+		`{"transaction":1,"quantity":1,"price":90,"order_type":2}]}`)
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, resp.Results, 6) {
+		var statuses []int
+		for _, r := range resp.Results {
+			statuses = append(statuses, r.Status)
+		}
+		assert.Equal(t, []int{http.StatusCreated, http.StatusCreated, http.StatusBadRequest,
+			http.StatusCreated, http.StatusConflict, http.StatusTooManyRequests}, statuses)
+		assert.Equal(t, matcher.Placed, resp.Results[0].Order.Status)
+		assert.Equal(t, matcher.Completed, resp.Results[1].Order.Status)
+		if assert.Len(t, resp.Results[1].Fills, 1) {
+			assert.Equal(t, resp.Results[0].Order.Id, resp.Results[1].Fills[0].SellId)
+		}
+		assert.Nil(t, resp.Results[2].Order)
+		assert.Equal(t, "price", resp.Results[2].Fields[0].Field)
+	}
+
+	code, _ = post(`{"orders":[]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = post(`{"orders":[` + strings.Repeat(`{"transaction":1,"quantity":1,"price":90,"order_type":2},`, 100) +
+		`{"transaction":1,"quantity":1,"price":90,"order_type":2}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	// A batch of the most orders with every field set fits in the body limit
+	full := `{"client_order_id":"` + strings.Repeat("c", 64) + `","symbol":"SAMPLE","account":"` +
+		strings.Repeat("a", 64) + `","transaction":1,"order_type":2,"quantity":1000000,"price":1000000,` +
+		`"trigger_price":1000000,"display_quantity":1000000,"post_only":1,"all_or_none":true,` +
+		`"min_quantity":1000000,"peg_reference":1,"peg_offset":-1000000,"peg_limit":1000000}`
+	assert.Less(t, len(`{"orders":[`+strings.Repeat(full+",", 99)+full+`]}`), maxBody)
+
+	// The matcher is not running, so its queue has no room for the batch
+	a = newLimitedTestApi(0, Limits{}, nil, false)
+	code, _ = post(`{"orders":[{"transaction":1,"quantity":1,"price":90,"order_type":2}]}`)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+}
+
+func Test_Api_CancelOrders(t *testing.T) {
+	keys := []ApiKey{
+		{Key: "k1", Secret: "s1", Account: "acc1", Role: Trader},
+		{Key: "k2", Secret: "s2", Account: "acc2", Role: Trader},
+		{Key: "adm", Secret: "s3", Role: Admin},
+	}
+	a := newLimitedTestApi(100, Limits{}, keys, true)
+	do := func(k *ApiKey, method, uri, body string) (int, OrdersResponse) {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, newSignedRequest(k, time.Now(), method, uri, body))
+		var resp OrdersResponse
+		json.Unmarshal(rec.Body.Bytes(), &resp)
+		return rec.Code, resp
+	}
+	for _, k := range []*ApiKey{&keys[0], &keys[0], &keys[1]} {
+		code, _ := do(k, http.MethodPost, "/v1/orders", `{"transaction":1,"quantity":10,"price":100,"order_type":2}`)
+		assert.Equal(t, http.StatusCreated, code)
+	}
+	code, _ := do(&keys[0], http.MethodPost, "/v1/orders", `{"transaction":2,"quantity":10,"price":110,"order_type":2}`)
+	assert.Equal(t, http.StatusCreated, code)
+
+	code, _ = do(&keys[0], http.MethodDelete, "/v1/orders?account=acc2", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, _ = do(&keys[2], http.MethodDelete, "/v1/orders", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = do(&keys[0], http.MethodDelete, "/v1/orders?side=long", "")
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, resp := do(&keys[0], http.MethodDelete, "/v1/orders?side=buy", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, resp.Orders, 2)
+	for _, o := range resp.Orders {
+		assert.Equal(t, "acc1", o.Account)
+		assert.Equal(t, matcher.Buy, o.Transaction)
+		assert.Equal(t, matcher.Cancelled, o.Status)
+	}
+	assert.Equal(t, []matcher.PriceLevel{{Price: 100, Quantity: 10, Orders: 1}}, a.match.Depth().Buy)
+
+	code, resp = do(&keys[2], http.MethodDelete, "/v1/orders?account=acc1", "")
+	assert.Equal(t, http.StatusOK, code)
+	if assert.Len(t, resp.Orders, 1) {
+		assert.Equal(t, matcher.Sell, resp.Orders[0].Transaction)
+	}
+	code, resp = do(&keys[0], http.MethodDelete, "/v1/orders", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.NotNil(t, resp.Orders)
+	assert.Empty(t, resp.Orders)
+
+	// Without keys the account must be named too
+	open := newTestApi()
+	for _, uri := range []string{"/v1/orders", "/v1/orders?side=buy"} {
+		rec := httptest.NewRecorder()
+		open.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, uri, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, uri)
+		assert.Contains(t, rec.Body.String(), "is required without an API key")
+	}
+	rec := httptest.NewRecorder()
+	open.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/v1/orders?account=acc1", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func Test_Api_KillSwitch(t *testing.T) {
+	keys := []ApiKey{
+		{Key: "k1", Secret: "s1", Account: "acc1", Role: Trader},
+		{Key: "adm", Secret: "s3", Role: Admin},
+	}
+	a := newLimitedTestApi(100, Limits{}, keys, true)
+	do := func(k *ApiKey, method, uri, body string) (int, []byte) {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, newSignedRequest(k, time.Now(), method, uri, body))
+		return rec.Code, rec.Body.Bytes()
+	}
+	place := func() OrderResponse {
+		code, body := do(&keys[0], http.MethodPost, "/v1/orders", `{"transaction":1,"quantity":10,"price":100,"order_type":2}`)
+		assert.Equal(t, http.StatusCreated, code)
+		var resp OrderResponse
+		assert.NoError(t, json.Unmarshal(body, &resp))
+		return resp
+	}
+	resting := place()
+
+	code, _ := do(&keys[0], http.MethodPut, "/v1/accounts/acc1/kill-switch", "")
+	assert.Equal(t, http.StatusForbidden, code)
+	code, body := do(&keys[1], http.MethodPut, "/v1/accounts/acc1/kill-switch", "")
+	assert.Equal(t, http.StatusOK, code)
+	var state AccountResponse
+	assert.NoError(t, json.Unmarshal(body, &state))
+	assert.True(t, state.Disabled)
+	if assert.Len(t, state.Cancelled, 1) {
+		assert.Equal(t, resting.Order.Id, state.Cancelled[0].Id)
+		assert.Equal(t, matcher.Cancelled, state.Cancelled[0].Status)
+	}
+
+	rejected := place()
+	assert.Equal(t, matcher.Rejected, rejected.Order.Status)
+	assert.Equal(t, "account acc1 is disabled", rejected.Order.RejectReason)
+
+	code, body = do(&keys[0], http.MethodGet, "/v1/accounts/acc1", "")
+	assert.Equal(t, http.StatusOK, code)
+	var got AccountResponse
+	assert.NoError(t, json.Unmarshal(body, &got))
+	assert.Equal(t, AccountResponse{Account: "acc1", Disabled: true}, got)
+	code, _ = do(&keys[0], http.MethodGet, "/v1/accounts/acc2", "")
+	assert.Equal(t, http.StatusForbidden, code)
+
+	code, _ = do(&keys[1], http.MethodDelete, "/v1/accounts/acc1/kill-switch", "")
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, matcher.Placed, place().Order.Status)
+
+	code, _ = do(&keys[1], http.MethodGet, "/v1/accounts/acc1/orders", "")
+	assert.Equal(t, http.StatusNotFound, code)
+}
+
+func Test_Api_CancelOnDisconnect(t *testing.T) {
+	keys := []ApiKey{
+		{Key: "k1", Secret: "s1", Account: "acc1", Role: Trader, CancelOnDisconnect: true},
+		{Key: "k2", Secret: "s2", Account: "acc2", Role: Trader},
+	}
+	a := newLimitedTestApi(100, Limits{}, keys, true)
+	a.heartbeat = 10 * time.Millisecond
+	srv := httptest.NewServer(a.routes())
+	defer srv.Close()
+
+	send := func(k *ApiKey, ctx context.Context, method, uri, body string) *http.Response {
+		req := newSignedRequest(k, time.Now(), method, uri, body)
+		req.RequestURI = ""
+		req.URL, _ = url.Parse(srv.URL + uri)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		assert.NoError(t, err)
+		return resp
+	}
+	place := func(k *ApiKey) uuid.UUID {
+		resp := send(k, context.Background(), http.MethodPost, "/v1/orders", `{"transaction":1,"quantity":10,"price":100,"order_type":2}`)
+		defer resp.Body.Close()
+		var placed OrderResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&placed))
+		return placed.Order.Id
+	}
+	stream := func(k *ApiKey) (context.CancelFunc, *bufio.Reader) {
+		ctx, cancel := context.WithCancel(context.Background())
+		resp := send(k, ctx, http.MethodGet, "/v1/trades/stream", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		return cancel, bufio.NewReader(resp.Body)
+	}
+
+	// Heartbeats are sent while there are no trades
+	stop1, events := stream(&keys[0])
+	line, err := events.ReadString('\n')
+	assert.NoError(t, err)
+	assert.Equal(t, "event: heartbeat\n", line)
+	stop2, _ := stream(&keys[0])
+	stopOther, _ := stream(&keys[1])
+	assert.Eventually(t, func() bool { return a.sessions.count("acc1") == 2 }, time.Second, time.Millisecond)
+
+	id := place(&keys[0])
+	other := place(&keys[1])
+
+	// The orders are cancelled once the last session of the account drops
+	stop1()
+	assert.Eventually(t, func() bool { return a.sessions.count("acc1") == 1 }, time.Second, time.Millisecond)
+	_, ok := a.match.LiveOrder(id)
+	assert.True(t, ok)
+	stop2()
+	assert.Eventually(t, func() bool {
+		_, ok := a.match.LiveOrder(id)
+		return !ok
+	}, time.Second, time.Millisecond)
+	o, _ := a.findOrder(id)
+	assert.Equal(t, matcher.Cancelled, o.Status)
+
+	// The account of a key without cancel on disconnect keeps its orders
+	stopOther()
+	assert.Eventually(t, func() bool { return a.sessions.count("acc2") == 0 }, time.Second, time.Millisecond)
+	_, ok = a.match.LiveOrder(other)
+	assert.True(t, ok)
+}
+
+func Test_Api_StreamTrades(t *testing.T) {
+	keys := []ApiKey{
+		{Key: "k1", Secret: "s1", Account: "acc1", Role: Trader},
+		{Key: "k2", Secret: "s2", Account: "acc2", Role: Trader},
+		{Key: "adm", Secret: "s3", Role: Admin},
+	}
+	a := newLimitedTestApi(100, Limits{}, keys, true)
+	srv := httptest.NewServer(a.routes())
+	defer srv.Close()
+
+	send := func(k *ApiKey, ctx context.Context, method, uri, body string) *http.Response {
+		req := newSignedRequest(k, time.Now(), method, uri, body)
+		req.RequestURI = ""
+		req.URL, _ = url.Parse(srv.URL + uri)
+		resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+		assert.NoError(t, err)
+		return resp
+	}
+	place := func(k *ApiKey, body string) uuid.UUID {
+		resp := send(k, context.Background(), http.MethodPost, "/v1/orders", body)
+		defer resp.Body.Close()
+		var placed OrderResponse
+		assert.NoError(t, json.NewDecoder(resp.Body).Decode(&placed))
+		return placed.Order.Id
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	trade := func(k *ApiKey) func() matcher.Trade {
+		resp := send(k, ctx, http.MethodGet, "/v1/trades/stream", "")
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		events := bufio.NewReader(resp.Body)
+		return func() matcher.Trade {
+			var t0 matcher.Trade
+			for {
+				line, err := events.ReadString('\n')
+				if !assert.NoError(t, err) {
+					return t0
+				}
+				if strings.HasPrefix(line, "data: ") {
+					assert.NoError(t, json.Unmarshal([]byte(line[len("data: "):]), &t0))
+					return t0
+				}
+			}
+		}
+	}
+	trader, admin := trade(&keys[0]), trade(&keys[2])
+
+	buy := place(&keys[0], `{"transaction":1,"quantity":10,"price":100,"order_type":2}`)
+	sell := place(&keys[1], `{"transaction":2,"quantity":10,"price":100,"order_type":2}`)
+
+	// A trader sees the id of its own order only, an admin both
+	got := trader()
+	assert.Equal(t, buy, got.BuyId)
+	assert.Equal(t, uuid.Nil, got.SellId)
+	assert.Equal(t, 10, got.Quantity)
+	got = admin()
+	assert.Equal(t, buy, got.BuyId)
+	assert.Equal(t, sell, got.SellId)
+}
+
+func Test_LoadKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keys")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"Valid", `[{"key":"k1","secret":"s1","account":"acc1","role":1},{"key":"k2","secret":"s2","role":2}]`, false},
+		{"NoSecret", `[{"key":"k1","account":"acc1","role":1}]`, true},
+		{"TraderWithoutAccount", `[{"key":"k1","secret":"s1","role":1}]`, true},
+		{"UnknownRole", `[{"key":"k1","secret":"s1","account":"acc1","role":3}]`, true},
+		{"CancelOnDisconnectWithoutAccount", `[{"key":"k1","secret":"s1","role":2,"cancel_on_disconnect":true}]`, true},
+		{"Malformed", `{"key":"k1"`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, tt.name+".json")
+			assert.NoError(t, ioutil.WriteFile(path, []byte(tt.content), 0600))
+			keys, err := LoadKeys(path)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, keys, 2)
+		})
+	}
+}
+
+// newSignedRequest returns a request signed with the key at the time, or an
+// unsigned one without a key
+func newSignedRequest(k *ApiKey, ts time.Time, method, uri, body string) *http.Request {
+	req := httptest.NewRequest(method, uri, strings.NewReader(body))
+	if k != nil {
+		stamp, nonce := strconv.FormatInt(ts.Unix(), 10), uuid.New().String()
+		req.Header.Set("X-Api-Key", k.Key)
+		req.Header.Set("X-Timestamp", stamp)
+		req.Header.Set("X-Nonce", nonce)
+		req.Header.Set("X-Signature", Sign(k.Secret, stamp, nonce, method, uri, []byte(body)))
+	}
+	return req
+}
+
+func Test_Api_Auth(t *testing.T) {
+	keys := []ApiKey{
+		{Key: "k1", Secret: "s1", Account: "acc1", Role: Trader},
+		{Key: "k2", Secret: "s2", Account: "acc2", Role: Trader},
+		{Key: "adm", Secret: "s3", Role: Admin},
+	}
+	a := newLimitedTestApi(100, Limits{}, keys, true)
+	do := func(k *ApiKey, ts time.Time, method, uri, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, newSignedRequest(k, ts, method, uri, body))
+		return rec
+	}
+	now := time.Now()
+	body := `{"transaction":1,"quantity":10,"price":100,"order_type":2}`
+
+	assert.Equal(t, http.StatusUnauthorized, do(nil, now, http.MethodPost, "/v1/orders", body).Code)
+	assert.Equal(t, http.StatusUnauthorized,
+		do(&keys[0], now.Add(-time.Minute), http.MethodPost, "/v1/orders", body).Code)
+	forged := httptest.NewRequest(http.MethodPost, "/v1/orders", strings.NewReader(body))
+	forged.Header.Set("X-Api-Key", "k1")
+	forged.Header.Set("X-Timestamp", strconv.FormatInt(now.Unix(), 10))
+	forged.Header.Set("X-Signature", Sign("s1", strconv.FormatInt(now.Unix(), 10), "",
+		http.MethodPost, "/v1/orders", []byte(`{"transaction":2}`)))
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, forged)
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, do(&keys[0], now, http.MethodPost, "/v1/orders",
+		`{"client_order_id":"`+strings.Repeat("x", maxBody)+`"}`).Code)
+
+	// A signed request is accepted once, with or without a nonce
+	replayed := func(nonce string) {
+		stamp := strconv.FormatInt(now.Unix(), 10)
+		var rec *httptest.ResponseRecorder
+		for i, want := range []int{http.StatusOK, http.StatusUnauthorized} {
+			req := httptest.NewRequest(http.MethodGet, "/v1/orders", nil)
+			req.Header.Set("X-Api-Key", "k1")
+			req.Header.Set("X-Timestamp", stamp)
+			req.Header.Set("X-Nonce", nonce)
+			req.Header.Set("X-Signature", Sign("s1", stamp, nonce, http.MethodGet, "/v1/orders", nil))
+			rec = httptest.NewRecorder()
+			a.routes().ServeHTTP(rec, req)
+			assert.Equal(t, want, rec.Code, i)
+		}
+		assert.Contains(t, rec.Body.String(), "replayed X-Signature")
+	}
+	replayed("")
+	replayed("n1")
+	var r replays
+	assert.True(t, r.add("sig", now.Add(maxClockSkew), now))
+	assert.False(t, r.add("sig", now.Add(maxClockSkew), now.Add(time.Second)))
+	assert.True(t, r.add("other", now.Add(3*maxClockSkew), now.Add(2*maxClockSkew)))
+	assert.NotContains(t, r.seen, "sig")
+
+	// Orders are stamped with the account of the key
+	rec = do(&keys[0], now, http.MethodPost, "/v1/orders", body)
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var placed OrderResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &placed))
+	assert.Equal(t, "acc1", placed.Order.Account)
+	assert.Equal(t, http.StatusForbidden, do(&keys[0], now, http.MethodPost, "/v1/orders",
+		`{"account":"acc2","transaction":1,"quantity":10,"price":100,"order_type":2}`).Code)
+
+	orders := func(k *ApiKey, uri string) []matcher.Order {
+		rec := do(k, now, http.MethodGet, uri, "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		var resp OrdersResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp.Orders
+	}
+	path := "/v1/orders/" + placed.Order.Id.String()
+	assert.Len(t, orders(&keys[0], "/v1/orders"), 1)
+	assert.Empty(t, orders(&keys[1], "/v1/orders"))
+	assert.Len(t, orders(&keys[2], "/v1/orders"), 1)
+	assert.Equal(t, http.StatusForbidden, do(&keys[1], now, http.MethodGet, "/v1/orders?account=acc1", "").Code)
+	assert.Equal(t, http.StatusNotFound, do(&keys[1], now, http.MethodGet, path, "").Code)
+	assert.Equal(t, http.StatusNotFound, do(&keys[1], now, http.MethodDelete, path, "").Code)
+	assert.Equal(t, http.StatusOK, do(&keys[2], now, http.MethodGet, path, "").Code)
+
+	assert.Equal(t, http.StatusForbidden, do(&keys[0], now, http.MethodGet, "/v1/metrics", "").Code)
+	assert.Equal(t, http.StatusOK, do(&keys[2], now, http.MethodGet, "/v1/metrics", "").Code)
+	assert.Equal(t, http.StatusOK, do(&keys[0], now, http.MethodDelete, path, "").Code)
+
+	// An amendment that crosses shows its fills as the key sees them
+	do(&keys[0], now, http.MethodPost, "/v1/orders", `{"transaction":1,"quantity":5,"price":100,"order_type":2}`)
+	rec = do(&keys[1], now, http.MethodPost, "/v1/orders", `{"transaction":2,"quantity":5,"price":101,"order_type":2}`)
+	var resting OrderResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resting))
+	rec = do(&keys[1], now, http.MethodPatch, "/v1/orders/"+resting.Order.Id.String(), `{"price":100}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var amended OrderResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &amended))
+	if assert.Len(t, amended.Fills, 1) {
+		assert.Equal(t, uuid.Nil, amended.Fills[0].BuyId)
+		assert.Equal(t, resting.Order.Id, amended.Fills[0].SellId)
+	}
+
+	// A trader sees the id of the other order of a fill only if it is its own
+	fill := func(k *ApiKey, body string) matcher.Trade {
+		rec := do(k, now, http.MethodPost, "/v1/orders", body)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		var resp OrderResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Len(t, resp.Fills, 1)
+		return resp.Fills[0]
+	}
+	sell := `{"transaction":2,"quantity":5,"price":100,"order_type":2}`
+	do(&keys[0], now, http.MethodPost, "/v1/orders", `{"transaction":1,"quantity":15,"price":100,"order_type":2}`)
+	trade := fill(&keys[1], sell)
+	assert.Equal(t, uuid.Nil, trade.BuyId)
+	assert.NotEqual(t, uuid.Nil, trade.SellId)
+	trade = fill(&keys[0], sell)
+	assert.NotEqual(t, uuid.Nil, trade.BuyId)
+	assert.NotEqual(t, uuid.Nil, trade.SellId)
+	trade = fill(&keys[2], `{"account":"acc2","transaction":2,"quantity":5,"price":100,"order_type":2}`)
+	assert.NotEqual(t, uuid.Nil, trade.BuyId)
+
+	// The same goes for the fills of a batch
+	do(&keys[0], now, http.MethodPost, "/v1/orders", `{"transaction":1,"quantity":5,"price":100,"order_type":2}`)
+	rec = do(&keys[1], now, http.MethodPost, "/v1/orders/batch", `{"orders":[`+sell+`]}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var batch BatchResponse
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &batch))
+	if assert.Len(t, batch.Results, 1) && assert.Len(t, batch.Results[0].Fills, 1) {
+		assert.Equal(t, uuid.Nil, batch.Results[0].Fills[0].BuyId)
+		assert.NotEqual(t, uuid.Nil, batch.Results[0].Fills[0].SellId)
+	}
+
+	// Without keys the admin endpoints are closed
+	a = newLimitedTestApi(100, Limits{}, nil, true)
+	rec = httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/metrics", nil))
+	assert.Equal(t, http.StatusForbidden, rec.Code)
+}
+
+func Test_Api_PrometheusMetrics(t *testing.T) {
+	keys := []ApiKey{{Key: "k1", Secret: "s1", Account: "acc1", Role: Trader}}
+	a := newLimitedTestApi(100, Limits{}, keys, true)
+
+	// A rejected order is still measured, and the scrape needs no signature
+	req := httptest.NewRequest(http.MethodGet, "/v1/book", nil)
+	a.routes().ServeHTTP(httptest.NewRecorder(), req)
+	_, err := a.match.PlaceOrder(&matcher.Order{
+		Id: uuid.New(), Transaction: matcher.Buy, OrderType: matcher.Limit,
+		Quantity: 10, PlacedQuantity: 10, Price: 100, Status: matcher.Placed,
+	}, time.Second)
+	assert.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	a.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	body := rec.Body.String()
+	for _, want := range []string{
+		`trade_orders_received_total{side="buy",type="limit"} 1`,
+		`trade_book_levels{side="buy"} 1`,
+		`trade_book_quantity{side="buy"} 10`,
+		`trade_open_orders 1`,
+		`trade_matcher_queue_depth 0`,
+		`trade_matcher_lag_seconds_count 1`,
+		`trade_orders_refused_queue_full_total 0`,
+		`trade_api_request_duration_seconds_count{code="401",method="GET",route="/v1/book"}`,
+		`go_goroutines`,
+	} {
+		assert.Contains(t, body, want)
+	}
+}
+
+func Test_Api_Debug(t *testing.T) {
+	keys := []ApiKey{
+		{Key: "k1", Secret: "s1", Account: "acc1", Role: Trader},
+		{Key: "adm", Secret: "s2", Role: Admin},
+	}
+	a := newLimitedTestApi(100, Limits{}, keys, true)
+	do := func(k *ApiKey, method, uri, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		a.routes().ServeHTTP(rec, newSignedRequest(k, time.Now(), method, uri, body))
+		return rec
+	}
+	trader, admin := &keys[0], &keys[1]
+
+	assert.Equal(t, http.StatusCreated, do(trader, http.MethodPost, "/v1/orders",
+		`{"transaction":1,"quantity":10,"price":100,"order_type":2}`).Code)
+
+	for _, uri := range []string{"/debug/matcher", "/debug/store", "/debug/loglevel", "/debug/pprof/goroutine"} {
+		assert.Equal(t, http.StatusForbidden, do(trader, http.MethodGet, uri, "").Code, uri)
+		assert.Equal(t, http.StatusOK, do(admin, http.MethodGet, uri, "").Code, uri)
+	}
+
+	var dump matcher.Dump
+	assert.NoError(t, json.Unmarshal(do(admin, http.MethodGet, "/debug/matcher", "").Body.Bytes(), &dump))
+	if assert.Len(t, dump.Buy, 1) {
+		assert.Equal(t, 100, dump.Buy[0].Price)
+		assert.Equal(t, "acc1", dump.Buy[0].Orders[0].Account)
+	}
+	assert.Equal(t, 1, dump.Live)
+	assert.Equal(t, 100, dump.Channels.IngressCapacity)
+
+	rec := do(admin, http.MethodPut, "/debug/loglevel", `{"level":"debug"}`)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, logrus.DebugLevel, a.log.GetLevel())
+	assert.Equal(t, http.StatusBadRequest, do(admin, http.MethodPut, "/debug/loglevel", `{"level":"loud"}`).Code)
+
+	// Without keys there is no admin, so the debug endpoints are closed
+	a = newLimitedTestApi(100, Limits{}, nil, true)
+	for _, uri := range []string{"/debug/matcher", "/debug/loglevel", "/debug/pprof/", "/debug/pprof/cmdline"} {
+		assert.Equal(t, http.StatusForbidden, do(nil, http.MethodGet, uri, "").Code, uri)
+	}
+}
+
+// specResponse is the part of an OpenAPI response the spec test checks
+type specResponse struct {
+	Ref     string `json:"$ref"`
+	Content map[string]struct {
+		Schema schema `json:"schema"`
+	} `json:"content"`
+}
+
+// specOperation is the part of an OpenAPI operation the spec test checks
+type specOperation struct {
+	RequestBody *struct {
+		Content map[string]struct {
+			Schema schema `json:"schema"`
+		} `json:"content"`
+	} `json:"requestBody"`
+	Responses map[string]specResponse `json:"responses"`
+}
+
+var specMethods = []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete}
+
+// Test_OpenAPI_Spec fails when the handlers and the OpenAPI document diverge:
+// a route without a path, an operation without a handler, a method allowed
+// but not documented, or a status, content type or body not documented.
+func Test_OpenAPI_Spec(t *testing.T) {
+	var doc struct {
+		Paths      map[string]map[string]json.RawMessage `json:"paths"`
+		Components struct {
+			Responses map[string]specResponse `json:"responses"`
+		} `json:"components"`
+	}
+	assert.NoError(t, json.Unmarshal(openapiJSON, &doc))
+	operations := map[string]specOperation{}
+	for path, item := range doc.Paths {
+		for _, method := range specMethods {
+			if raw, ok := item[strings.ToLower(method)]; ok {
+				var op specOperation
+				assert.NoError(t, json.Unmarshal(raw, &op))
+				operations[method+" "+path] = op
+			}
+		}
+	}
+
+	a := newTestApi()
+	a.algos = algo.NewAlgoService(a.match, time.Second, a.log)
+	mux := a.routes().(*http.ServeMux)
+	do := func(method, uri, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(method, uri, strings.NewReader(body))
+		if body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if uri == "/v1/trades/stream" {
+			ctx, cancel := context.WithTimeout(req.Context(), 20*time.Millisecond)
+			defer cancel()
+			req = req.WithContext(ctx)
+		}
+		mux.ServeHTTP(rec, asAdmin(req))
+		return rec
+	}
+	place := func(body string) OrderResponse {
+		var resp OrderResponse
+		rec := do(http.MethodPost, "/v1/orders", body)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		return resp
+	}
+	byId := place(`{"transaction":1,"quantity":10,"price":100,"order_type":2}`).Order.Id.String()
+	place(`{"client_order_id":"spec-1","transaction":1,"quantity":10,"price":99,"order_type":2}`)
+	place(`{"transaction":2,"quantity":5,"trigger_price":90,"order_type":3}`)
+
+	requests := []struct {
+		operation string
+		uri       string
+		body      string
+	}{
+		{"POST /v1/orders", "/v1/orders", `{"transaction":2,"quantity":4,"price":100,"order_type":2}`},
+		{"GET /v1/orders", "/v1/orders?status=completed", ""},
+		{"GET /v1/orders/{id}", "/v1/orders/" + byId, ""},
+		{"GET /v1/orders/{id}/history", "/v1/orders/" + byId + "/history", ""},
+		{"PATCH /v1/orders/{id}", "/v1/orders/" + byId, `{"quantity":5}`},
+		{"DELETE /v1/orders/{id}", "/v1/orders/" + byId, ""},
+		{"GET /v1/orders/client/{client_order_id}", "/v1/orders/client/spec-1", ""},
+		{"PATCH /v1/orders/client/{client_order_id}", "/v1/orders/client/spec-1", `{"price":98}`},
+		{"DELETE /v1/orders/client/{client_order_id}", "/v1/orders/client/spec-1", ""},
+		{"GET /v1/stops", "/v1/stops", ""},
+		{"GET /v1/book", "/v1/book", ""},
+		{"POST /v1/groups", "/v1/groups", `{"type":1,"orders":[` +
+			`{"transaction":1,"quantity":1,"price":50,"order_type":2},` +
+			`{"transaction":1,"quantity":1,"trigger_price":150,"order_type":3}]}`},
+		{"POST /v1/algos", "/v1/algos", `{"strategy":1,"transaction":1,"order_type":2,"quantity":10,"price":50,"duration":60}`},
+		{"GET /v1/algos", "/v1/algos", ""},
+		{"GET /v1/metrics", "/v1/metrics", ""},
+		{"GET /v1/trades/stream", "/v1/trades/stream", ""},
+		{"GET /metrics", "/metrics", ""},
+		{"GET /openapi.json", "/openapi.json", ""},
+		{"GET /debug/matcher", "/debug/matcher", ""},
+		{"GET /debug/store", "/debug/store", ""},
+		{"GET /debug/loglevel", "/debug/loglevel", ""},
+		{"PUT /debug/loglevel", "/debug/loglevel", `{"level":"info"}`},
+		{"GET /debug/pprof/{profile}", "/debug/pprof/heap", ""},
+		{"POST /v1/orders/batch", "/v1/orders/batch", `{"orders":[` +
+			`{"transaction":2,"quantity":4,"price":100,"order_type":2},` +
+			`{"transaction":2,"quantity":4,"order_type":2},` +
+			`{"client_order_id":"spec-1","transaction":1,"quantity":10,"price":99,"order_type":2}]}`},
+		{"DELETE /v1/orders", "/v1/orders?side=buy&account=acc1", ""},
+		{"GET /v1/accounts/{account}", "/v1/accounts/acc1", ""},
+		{"PUT /v1/accounts/{account}/kill-switch", "/v1/accounts/acc1/kill-switch", ""},
+		{"DELETE /v1/accounts/{account}/kill-switch", "/v1/accounts/acc1/kill-switch", ""},
+	}
+
+	tested := map[string]bool{}
+	for _, r := range requests {
+		tested[r.operation] = true
+		op, ok := operations[r.operation]
+		if !assert.True(t, ok, "%s is not in the spec", r.operation) {
+			continue
+		}
+		method := strings.SplitN(r.operation, " ", 2)[0]
+		rec := do(method, r.uri, r.body)
+
+		resp, ok := op.Responses[strconv.Itoa(rec.Code)]
+		if !assert.True(t, ok, "%s answered %d: %s", r.operation, rec.Code, rec.Body) {
+			continue
+		}
+		if resp.Ref != "" {
+			resp = doc.Components.Responses[strings.TrimPrefix(resp.Ref, "#/components/responses/")]
+		}
+		mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+		content, ok := resp.Content[mediaType]
+		if !assert.True(t, ok, "%s answered %s", r.operation, mediaType) || mediaType != "application/json" {
+			continue
+		}
+		var body interface{}
+		dec := json.NewDecoder(rec.Body)
+		dec.UseNumber()
+		assert.NoError(t, dec.Decode(&body))
+		assert.Empty(t, apiSpec.check(&content.Schema, body, ""), r.operation)
+	}
+	for operation := range operations {
+		assert.True(t, tested[operation], "%s is not tested", operation)
+	}
+
+	// Every route serves a path of the spec
+	served := map[string]bool{}
+	for path := range doc.Paths {
+		uri := regexp.MustCompile(`\{[^}]*\}`).ReplaceAllString(path, "x")
+		_, pattern := mux.Handler(httptest.NewRequest(http.MethodGet, uri, nil))
+		served[pattern] = true
+	}
+	for _, r := range append(a.v1Routes(), a.debugRoutes()...) {
+		if !strings.HasPrefix(r.path, "/debug/pprof/") {
+			assert.True(t, served[r.path], "%s is not in the spec", r.path)
+		}
+	}
+
+	// Methods that are not documented are not allowed, except by the
+	// Prometheus and pprof handlers which answer every method
+	for path, item := range doc.Paths {
+		if path == metricsPath || strings.HasPrefix(path, "/debug/pprof/") {
+			continue
+		}
+		uri := regexp.MustCompile(`\{[^}]*\}`).ReplaceAllString(path, "x")
+		for _, method := range specMethods {
+			if _, ok := item[strings.ToLower(method)]; !ok {
+				assert.Equal(t, http.StatusMethodNotAllowed, do(method, uri, "").Code, method+" "+path)
+			}
+		}
+	}
+
+	// Request bodies are validated against the schema of the operation
+	for operation, op := range operations {
+		if op.RequestBody == nil {
+			continue
+		}
+		body := op.RequestBody.Content["application/json"].Schema
+		s := apiSpec.resolve(&body)
+		parts := strings.SplitN(operation, " ", 2)
+		uri := strings.NewReplacer("{id}", byId, "{client_order_id}", "spec-1").Replace(parts[1])
+		rec := do(parts[0], uri, `{"not_a_field":1}`)
+		assert.Equal(t, http.StatusBadRequest, rec.Code, operation)
+
+		var resp ErrorResponse
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &resp))
+		want := append(append([]string{}, s.Required...), "not_a_field")
+		var fields []string
+		for _, f := range resp.Fields {
+			fields = append(fields, f.Field)
+		}
+		assert.Equal(t, want, fields, operation)
+	}
+}
@@ -0,0 +1,294 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// Role enum
+type Role int
+
+const (
+	// Trader keys act on the orders of their own account
+	Trader Role = iota + 1
+	// Admin keys act on the orders of every account
+	Admin
+)
+
+func (r Role) String() string {
+	switch r {
+	case Trader:
+		return "trader"
+	case Admin:
+		return "admin"
+	}
+	return "unknown"
+}
+
+// ApiKey is a key a client signs its requests with, and the account its
+// orders belong to. The working orders of an account with a key that
+// cancels on disconnect are cancelled when the last trade stream of the
+// account drops.
+type ApiKey struct {
+	Key                string `json:"key"`
+	Secret             string `json:"secret"`
+	Account            string `json:"account"`
+	Role               Role   `json:"role"`
+	CancelOnDisconnect bool   `json:"cancel_on_disconnect,omitempty"`
+}
+
+// Headers of a signed request
+const (
+	keyHeader       = "X-Api-Key"
+	timestampHeader = "X-Timestamp"
+	nonceHeader     = "X-Nonce"
+	signatureHeader = "X-Signature"
+)
+
+// maxClockSkew is how far the timestamp of a signed request can be from now
+const maxClockSkew = 30 * time.Second
+
+// replays remembers the signatures accepted while their timestamps are
+// within the clock skew, so that a captured request is not accepted again.
+// The zero value is ready to use.
+type replays struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	pruned time.Time
+}
+
+// add reports false if the signature was seen, and otherwise remembers it
+// until expires. The expired signatures are forgotten once every clock
+// skew.
+func (r *replays) add(signature string, expires, now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.seen == nil {
+		r.seen = make(map[string]time.Time)
+	}
+	if now.Sub(r.pruned) >= maxClockSkew {
+		for sig, exp := range r.seen {
+			if now.After(exp) {
+				delete(r.seen, sig)
+			}
+		}
+		r.pruned = now
+	}
+	if _, ok := r.seen[signature]; ok {
+		return false
+	}
+	r.seen[signature] = expires
+	return true
+}
+
+// LoadKeys reads the API keys from a JSON file holding an array of keys
+func LoadKeys(path string) ([]ApiKey, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var keys []ApiKey
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	for i, k := range keys {
+		if k.Key == "" || k.Secret == "" {
+			return nil, fmt.Errorf("%s: key %d needs a key and a secret", path, i)
+		}
+		if k.Role != Trader && k.Role != Admin {
+			return nil, fmt.Errorf("%s: key %s role must be 1 (trader) or 2 (admin)", path, k.Key)
+		}
+		if k.Role == Trader && k.Account == "" {
+			return nil, fmt.Errorf("%s: trader key %s needs an account", path, k.Key)
+		}
+		if k.CancelOnDisconnect && k.Account == "" {
+			return nil, fmt.Errorf("%s: key %s needs an account to cancel on disconnect", path, k.Key)
+		}
+	}
+	return keys, nil
+}
+
+// Sign returns the signature of a request: the hex HMAC-SHA256 with the
+// secret of the timestamp, the nonce if there is one, method, request URI
+// and body, each on a line.
+func Sign(secret, timestamp, nonce, method, uri string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n", timestamp)
+	if nonce != "" {
+		fmt.Fprintf(mac, "%s\n", nonce)
+	}
+	fmt.Fprintf(mac, "%s\n%s\n", method, uri)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// principalKey is the context key of the authenticated key
+type principalKey struct{}
+
+// principal returns the key the request was authenticated with, nil if the
+// service runs without keys. A nil key is never an admin.
+func principal(req *http.Request) *ApiKey {
+	k, _ := req.Context().Value(principalKey{}).(*ApiKey)
+	return k
+}
+
+// authenticate verifies the signature of every request before passing it
+// on with its key. Without keys every request is let through.
+func (a *apiService) authenticate(next http.Handler) http.Handler {
+	if len(a.keys) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		k, status, reason := a.verify(w, req, time.Now())
+		if k == nil {
+			a.log.WithFields(logrus.Fields{
+				"Path":   req.URL.Path,
+				"Key":    req.Header.Get(keyHeader),
+				"Reason": reason,
+			}).Info("Unauthenticated request")
+			a.writeError(w, status, reason, nil)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), principalKey{}, k)))
+	})
+}
+
+// verify returns the key that signed the request, or the status and why it
+// is not signed. A signature is accepted once, so a request sent again
+// within the clock skew needs another timestamp or nonce. The body, up to
+// maxBody, is read and put back for the handler.
+func (a *apiService) verify(w http.ResponseWriter, req *http.Request, now time.Time) (*ApiKey, int, string) {
+	k, ok := a.keys[req.Header.Get(keyHeader)]
+	if !ok {
+		return nil, http.StatusUnauthorized, "unknown or missing " + keyHeader
+	}
+	ts := req.Header.Get(timestampHeader)
+	secs, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return nil, http.StatusUnauthorized, timestampHeader + " must be unix seconds"
+	}
+	if skew := now.Sub(time.Unix(secs, 0)); skew > maxClockSkew || skew < -maxClockSkew {
+		return nil, http.StatusUnauthorized, timestampHeader + " is too far from the current time"
+	}
+
+	var body []byte
+	if req.Body != nil {
+		if body, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxBody)); err != nil {
+			return nil, http.StatusRequestEntityTooLarge, bodyTooLarge
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	want := Sign(k.Secret, ts, req.Header.Get(nonceHeader), req.Method, req.URL.RequestURI(), body)
+	if !hmac.Equal([]byte(want), []byte(req.Header.Get(signatureHeader))) {
+		return nil, http.StatusUnauthorized, "invalid " + signatureHeader
+	}
+	if !a.replays.add(k.Key+" "+want, time.Unix(secs, 0).Add(maxClockSkew), now) {
+		return nil, http.StatusUnauthorized, "replayed " + signatureHeader
+	}
+	return k, 0, ""
+}
+
+// readAccount returns the account whose orders the request reads. A trader
+// reads its own account, an admin the account asked for or every account if
+// none is. It replies 403 and returns false if a trader asks for another
+// account.
+func (a *apiService) readAccount(w http.ResponseWriter, req *http.Request, asked string) (string, bool) {
+	account, ok := accountFor(req, asked)
+	if !ok {
+		a.writeError(w, http.StatusForbidden, "key cannot act for account "+asked, nil)
+	}
+	return account, ok
+}
+
+// orderAccount returns the account an order is placed for, which is the
+// account of the key unless an admin asks for another one
+func (a *apiService) orderAccount(w http.ResponseWriter, req *http.Request, asked string) (string, bool) {
+	account, ok := placeAccount(req, asked)
+	if !ok {
+		a.writeError(w, http.StatusForbidden, "key cannot act for account "+asked, nil)
+	}
+	return account, ok
+}
+
+// accountFor is the account of readAccount, false if a trader asks for
+// another account
+func accountFor(req *http.Request, asked string) (string, bool) {
+	k := principal(req)
+	if k == nil || k.Role == Admin {
+		return asked, true
+	}
+	if asked != "" && asked != k.Account {
+		return "", false
+	}
+	return k.Account, true
+}
+
+// placeAccount is the account of orderAccount, false if a trader asks for
+// another account
+func placeAccount(req *http.Request, asked string) (string, bool) {
+	account, ok := accountFor(req, asked)
+	if ok && account == "" {
+		if k := principal(req); k != nil {
+			account = k.Account
+		}
+	}
+	return account, ok
+}
+
+// visible reports if the request can see the orders of the account
+func visible(req *http.Request, account string) bool {
+	k := principal(req)
+	return k == nil || k.Role == Admin || k.Account == account
+}
+
+// requireAdmin replies 403 unless the request is from an admin key, so the
+// admin endpoints are closed when the service runs without keys
+func (a *apiService) requireAdmin(w http.ResponseWriter, req *http.Request) bool {
+	if k := principal(req); k == nil || k.Role != Admin {
+		a.writeError(w, http.StatusForbidden, "admin key required", nil)
+		return false
+	}
+	return true
+}
+
+// tradeFor returns the trade as the key sees it: for a trader key the id of
+// an order of another account is the nil UUID
+func tradeFor(k *ApiKey, t matcher.Trade) matcher.Trade {
+	if k == nil || k.Role == Admin {
+		return t
+	}
+	if t.BuyAccount != k.Account {
+		t.BuyId = uuid.Nil
+	}
+	if t.SellAccount != k.Account {
+		t.SellId = uuid.Nil
+	}
+	return t
+}
+
+// fillsFor returns the fills as the key sees them
+func fillsFor(k *ApiKey, fills []matcher.Trade) []matcher.Trade {
+	if len(fills) == 0 {
+		return nil
+	}
+	seen := make([]matcher.Trade, len(fills))
+	for i, t := range fills {
+		seen[i] = tradeFor(k, t)
+	}
+	return seen
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// PlaceOrders places the orders of a batch together and replies with the
+// result of each. An order over the rate limit, for another account or
+// invalid is left out with the error it would have been answered with on
+// its own, and the others are entered one after another with no other order
+// in between. The batch is refused as a whole if the matcher queue is full.
+func (a *apiService) PlaceOrders(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodPost) {
+		return
+	}
+	var r BatchRequest
+	if !a.decodeBody(w, req, &r) {
+		return
+	}
+
+	results := make([]BatchResult, len(r.Orders))
+	var orders []*matcher.Order
+	// placing holds the index of the result of each order entered
+	var placing []int
+	client, now := clientOf(req), time.Now()
+	for i := range r.Orders {
+		o := &r.Orders[i]
+		if ok, _ := a.limiter.allow(client, now); !ok {
+			atomic.AddUint64(&a.rateLimited, 1)
+			results[i] = BatchResult{Status: http.StatusTooManyRequests, Error: "rate limit exceeded"}
+			continue
+		}
+		account, ok := placeAccount(req, o.Account)
+		if !ok {
+			results[i] = BatchResult{Status: http.StatusForbidden,
+				Error: "key cannot act for account " + o.Account}
+			continue
+		}
+		o.Account = account
+		if errs := o.validate("", a.symbol); len(errs) > 0 {
+			results[i] = BatchResult{Status: http.StatusBadRequest, Error: "invalid order", Fields: errs}
+			continue
+		}
+
+		order := o.order(a.symbol)
+		if o.ClientOrderId != "" {
+			k := clientKey{o.Account, o.ClientOrderId}
+			if co, ok := a.clientIds.reserve(k, *o, order.Id, now); !ok {
+				results[i] = a.replay(co, *o)
+				continue
+			}
+		}
+		// The order as placed, answered if the matcher does not acknowledge
+		// the batch in time
+		placed := *order
+		results[i] = BatchResult{Status: http.StatusAccepted, Order: &placed}
+		orders = append(orders, order)
+		placing = append(placing, i)
+	}
+
+	a.log.WithFields(logrus.Fields{
+		"Orders":  len(r.Orders),
+		"Placing": len(orders),
+	}).Debug("Batch Received")
+
+	if len(orders) > 0 {
+		acks, err := a.match.PlaceOrders(orders, time.Duration(atomic.LoadInt64(&a.ackTimeout)))
+		for j, i := range placing {
+			if o := &r.Orders[i]; o.ClientOrderId != "" {
+				k := clientKey{o.Account, o.ClientOrderId}
+				if err == matcher.ErrQueueFull {
+					a.clientIds.release(k)
+				} else {
+					a.clientIds.placed(k)
+				}
+			}
+			if err == nil {
+				results[i] = BatchResult{Status: http.StatusCreated,
+					Order: &acks[j].Order, Fills: fillsFor(principal(req), acks[j].Fills)}
+			}
+		}
+		switch err {
+		case nil:
+		case matcher.ErrQueueFull:
+			a.refuseQueueFull(w)
+			return
+		case matcher.ErrAckTimeout:
+			a.log.WithFields(logrus.Fields{
+				"Orders": len(orders),
+			}).Info("Batch not acknowledged in time")
+		default:
+			a.log.WithFields(logrus.Fields{
+				"Error": err.Error(),
+			}).Error("Unable to place batch")
+			a.writeError(w, http.StatusInternalServerError, err.Error(), nil)
+			return
+		}
+	}
+	a.writeJSON(w, http.StatusOK, BatchResponse{Results: results})
+}
+
+// CancelOrders cancels the working orders of an account at once, those of a
+// symbol or a side if the query asks, and replies with the orders
+// cancelled. No order is matched while they are cancelled. A trader cancels
+// the orders of its own account and an admin names the account, without
+// keys every account's orders are cancelled unless one is named.
+func (a *apiService) CancelOrders(w http.ResponseWriter, req *http.Request) {
+	a.logRequest(req)
+
+	q := req.URL.Query()
+	f := matcher.CancelFilter{Symbol: q.Get("symbol")}
+	var errs []FieldError
+	if s := q.Get("side"); s != "" {
+		var ok bool
+		if f.Transaction, ok = parseSide(s); !ok {
+			errs = append(errs, FieldError{"side", "must be buy or sell"})
+		}
+	}
+	// Only a trader key names the account by itself, so that a request
+	// cannot clear the whole book
+	if k := principal(req); q.Get("account") == "" {
+		switch {
+		case k == nil:
+			errs = append(errs, FieldError{"account", "is required without an API key"})
+		case k.Role == Admin:
+			errs = append(errs, FieldError{"account", "is required for an admin key"})
+		}
+	}
+	if len(errs) > 0 {
+		a.writeError(w, http.StatusBadRequest, "invalid query", errs)
+		return
+	}
+	var ok bool
+	if f.Account, ok = a.readAccount(w, req, q.Get("account")); !ok {
+		return
+	}
+
+	orders := a.match.CancelOrders(f)
+	if orders == nil {
+		orders = []matcher.Order{}
+	}
+	a.log.WithFields(logrus.Fields{
+		"Account": f.Account,
+		"Symbol":  f.Symbol,
+		"Side":    f.Transaction,
+		"Orders":  len(orders),
+	}).Info("Orders Cancelled")
+	a.writeJSON(w, http.StatusOK, OrdersResponse{Orders: orders})
+}
@@ -0,0 +1,85 @@
+package api
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/sirupsen/logrus"
+)
+
+// LogLevelRequest is the body to change the log level, and is returned with
+// the current level
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// debugRoutes are the admin-only endpoints to look into the running service
+func (a *apiService) debugRoutes() []route {
+	return []route{
+		{"/debug/matcher", a.DumpMatcher},
+		{"/debug/store", a.StoreSummary},
+		{"/debug/loglevel", a.LogLevel},
+		{"/debug/pprof/", pprof.Index},
+		{"/debug/pprof/cmdline", pprof.Cmdline},
+		{"/debug/pprof/profile", pprof.Profile},
+		{"/debug/pprof/symbol", pprof.Symbol},
+		{"/debug/pprof/trace", pprof.Trace},
+	}
+}
+
+// admin lets only admin keys through to the handler. A request without a
+// key is refused, so the endpoints are closed when the service runs without
+// keys.
+func (a *apiService) admin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if a.requireAdmin(w, req) {
+			h(w, req)
+		}
+	}
+}
+
+// DumpMatcher returns the book, the held orders, the groups and the channel
+// depths of the matcher, as they stood at one moment
+func (a *apiService) DumpMatcher(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	a.logRequest(req)
+	a.writeJSON(w, http.StatusOK, a.match.Dump())
+}
+
+// StoreSummary returns the number of stored orders by status
+func (a *apiService) StoreSummary(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	a.logRequest(req)
+	a.writeJSON(w, http.StatusOK, a.retrieve.Summary())
+}
+
+// LogLevel returns the log level on GET and changes it on PUT
+func (a *apiService) LogLevel(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet, http.MethodPut) {
+		return
+	}
+	a.logRequest(req)
+
+	if req.Method == http.MethodPut {
+		var r LogLevelRequest
+		if !a.decodeBody(w, req, &r) {
+			return
+		}
+		level, err := logrus.ParseLevel(r.Level)
+		if err != nil {
+			a.writeError(w, http.StatusBadRequest, "invalid log level",
+				[]FieldError{{"level", "must be one of panic, fatal, error, warn, info, debug or trace"}})
+			return
+		}
+		a.log.WithFields(logrus.Fields{
+			"From": a.log.GetLevel().String(),
+			"To":   level.String(),
+		}).Info("Changing log level")
+		a.log.SetLevel(level)
+	}
+	a.writeJSON(w, http.StatusOK, LogLevelRequest{Level: a.log.GetLevel().String()})
+}
@@ -0,0 +1,110 @@
+package api
+
+import (
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// clientKey scopes a client order id to its account
+type clientKey struct {
+	account       string
+	clientOrderId string
+}
+
+// clientOrder is the order placed for a client order id. It is pending until
+// the matcher has taken the order.
+type clientOrder struct {
+	id      uuid.UUID
+	req     OrderRequest
+	created time.Time
+	pending bool
+}
+
+// clientOrders remembers the orders placed with a client order id for the
+// retention window, so that a repeated submission finds the original order.
+type clientOrders struct {
+	window time.Duration
+
+	mu     sync.Mutex
+	orders map[clientKey]*clientOrder
+	// keys in the order they were created, to expire them
+	keys []createdKey
+}
+
+// createdKey is a key with the creation time of its order, which tells a
+// released key that was reserved again apart from the new reservation.
+type createdKey struct {
+	clientKey
+	created time.Time
+}
+
+func newClientOrders(window time.Duration) *clientOrders {
+	return &clientOrders{
+		window: window,
+		orders: make(map[clientKey]*clientOrder),
+	}
+}
+
+// reserve records the order id for the key unless the key already has an
+// order within the window, which is returned instead.
+func (c *clientOrders) reserve(k clientKey, r OrderRequest, id uuid.UUID,
+	now time.Time) (clientOrder, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+	if co, ok := c.orders[k]; ok {
+		return *co, false
+	}
+	c.orders[k] = &clientOrder{id: id, req: r, created: now, pending: true}
+	c.keys = append(c.keys, createdKey{k, now})
+	return clientOrder{}, true
+}
+
+// placed marks the reserved order as taken by the matcher
+func (c *clientOrders) placed(k clientKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if co, ok := c.orders[k]; ok {
+		co.pending = false
+	}
+}
+
+// release forgets the reserved order as it was not placed, so that the
+// submission can be retried
+func (c *clientOrders) release(k clientKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.orders, k)
+}
+
+// lookup returns the id of the order placed for the key within the window
+func (c *clientOrders) lookup(k clientKey, now time.Time) (uuid.UUID, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.expire(now)
+	co, ok := c.orders[k]
+	if !ok || co.pending {
+		return uuid.Nil, false
+	}
+	return co.id, true
+}
+
+// expire drops the orders created before the window
+func (c *clientOrders) expire(now time.Time) {
+	n := 0
+	for ; n < len(c.keys); n++ {
+		k := c.keys[n]
+		if now.Sub(k.created) < c.window {
+			break
+		}
+		// The order may have been released, and reserved again later on
+		if co, ok := c.orders[k.clientKey]; ok && co.created.Equal(k.created) {
+			delete(c.orders, k.clientKey)
+		}
+	}
+	c.keys = c.keys[n:]
+}
@@ -0,0 +1,149 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits bounds the rate at which each client can place orders. A zero Rate
+// places no limit.
+type Limits struct {
+	// Rate is the number of orders per second a client can place
+	Rate float64
+	// Burst is the number of orders a client can place at once
+	Burst int
+}
+
+// maxIdleBuckets is the number of client buckets kept before the full ones
+// are dropped
+const maxIdleBuckets = 10000
+
+// bucket holds the tokens of a client, refilled at the limit rate
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per client
+type rateLimiter struct {
+	mu      sync.Mutex
+	limits  Limits
+	buckets map[string]*bucket
+}
+
+func newRateLimiter(limits Limits) *rateLimiter {
+	return &rateLimiter{
+		limits:  limits,
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow takes a token from the client's bucket, or returns how long until
+// one is available
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limits.Rate <= 0 {
+		return true, 0
+	}
+	burst := float64(l.limits.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+
+	b, ok := l.buckets[client]
+	if !ok {
+		if len(l.buckets) >= maxIdleBuckets {
+			l.dropFull(now, burst)
+		}
+		b = &bucket{tokens: burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limits.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.limits.Rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+// setLimits changes the limits. The buckets keep their tokens, up to the
+// new burst.
+func (l *rateLimiter) setLimits(limits Limits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// dropFull removes the buckets that have refilled, as their clients are
+// back to a fresh bucket anyway
+func (l *rateLimiter) dropFull(now time.Time, burst float64) {
+	for c, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limits.Rate >= burst {
+			delete(l.buckets, c)
+		}
+	}
+}
+
+// clientOf identifies the client by its API key, or by its remote address
+// if the service runs without keys
+func clientOf(req *http.Request) string {
+	if k := principal(req); k != nil {
+		return k.Key
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// retryAfter sets the Retry-After header to the wait in whole seconds
+func retryAfter(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+}
+
+// limitRate replies 429 if the client is over its rate limit
+func (a *apiService) limitRate(w http.ResponseWriter, req *http.Request) bool {
+	ok, wait := a.limiter.allow(clientOf(req), time.Now())
+	if ok {
+		return true
+	}
+	atomic.AddUint64(&a.rateLimited, 1)
+	retryAfter(w, wait)
+	a.writeError(w, http.StatusTooManyRequests, "rate limit exceeded", nil)
+	return false
+}
+
+// refuseQueueFull replies 503 as the matcher queue has no room for the order
+func (a *apiService) refuseQueueFull(w http.ResponseWriter) {
+	atomic.AddUint64(&a.queueFull, 1)
+	retryAfter(w, time.Second)
+	a.writeError(w, http.StatusServiceUnavailable, "matcher is overloaded, retry later", nil)
+}
+
+// GetMetrics returns the matcher queue depth and the orders turned away
+func (a *apiService) GetMetrics(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet) || !a.requireAdmin(w, req) {
+		return
+	}
+	depth, capacity := a.match.Queue()
+	a.writeJSON(w, http.StatusOK, MetricsResponse{
+		QueueDepth:          depth,
+		QueueCapacity:       capacity,
+		RejectedQueueFull:   atomic.LoadUint64(&a.queueFull),
+		RejectedRateLimited: atomic.LoadUint64(&a.rateLimited),
+	})
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// metricsPath is where the Prometheus metrics are served
+const metricsPath = "/metrics"
+
+// newRegistry registers the metrics of the api, the matcher and the process
+func (a *apiService) newRegistry() *prometheus.Registry {
+	a.latency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "trade_api_request_duration_seconds",
+		Help:    "Time to answer API requests by route, method and status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		a.latency,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "trade_orders_refused_queue_full_total",
+			Help: "Orders refused with 503 as the matcher queue was full.",
+		}, func() float64 { return float64(atomic.LoadUint64(&a.queueFull)) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "trade_orders_refused_rate_limited_total",
+			Help: "Orders refused with 429 as the client was over its rate limit.",
+		}, func() float64 { return float64(atomic.LoadUint64(&a.rateLimited)) }),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	if a.match != nil {
+		reg.MustRegister(a.match.Collectors()...)
+	}
+	return reg
+}
+
+// statusRecorder keeps the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Flush lets the streams flush through the recorder
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrument observes the time the handler of the route takes
+func (a *apiService) instrument(route string, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h.ServeHTTP(rec, req)
+		a.latency.WithLabelValues(route, req.Method, strconv.Itoa(rec.code)).
+			Observe(time.Since(start).Seconds())
+	})
+}
@@ -0,0 +1,354 @@
+package api
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+)
+
+// specPath serves the OpenAPI document
+const specPath = "/openapi.json"
+
+// openapiJSON is the OpenAPI document of the endpoints. Request bodies are
+// validated against its schemas before they are decoded.
+//
+//go:embed openapi.json
+var openapiJSON []byte
+
+// apiSpec is the OpenAPI document loaded at start up
+var apiSpec = mustLoadSpec(openapiJSON)
+
+// openAPI is the part of the OpenAPI document requests are validated with
+type openAPI struct {
+	Components struct {
+		Schemas map[string]*schema `json:"schemas"`
+	} `json:"components"`
+}
+
+// schema is the subset of the OpenAPI schema object the document uses
+type schema struct {
+	Ref                  string          `json:"$ref"`
+	Type                 string          `json:"type"`
+	Format               string          `json:"format"`
+	Enum                 []interface{}   `json:"enum"`
+	EnumNames            []string        `json:"x-enum-varnames"`
+	Minimum              *float64        `json:"minimum"`
+	Maximum              *float64        `json:"maximum"`
+	MaxLength            *int            `json:"maxLength"`
+	Pattern              string          `json:"pattern"`
+	MinItems             int             `json:"minItems"`
+	MaxItems             *int            `json:"maxItems"`
+	Nullable             bool            `json:"nullable"`
+	Required             []string        `json:"required"`
+	Properties           properties      `json:"properties"`
+	AdditionalProperties json.RawMessage `json:"additionalProperties"`
+	Items                *schema         `json:"items"`
+	AllOf                []*schema       `json:"allOf"`
+
+	pattern *regexp.Regexp
+	// closed objects have no properties but their own, otherwise the other
+	// properties are checked against additional if it is set
+	closed     bool
+	additional *schema
+}
+
+// properties keeps the properties of an object schema in the order of the
+// document, the order their errors are reported in
+type properties struct {
+	names   []string
+	schemas map[string]*schema
+}
+
+func (p *properties) UnmarshalJSON(b []byte) error {
+	if err := json.Unmarshal(b, &p.schemas); err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	if _, err := dec.Token(); err != nil {
+		return err
+	}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		p.names = append(p.names, t.(string))
+		var skip json.RawMessage
+		if err := dec.Decode(&skip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const schemaRef = "#/components/schemas/"
+
+func mustLoadSpec(b []byte) *openAPI {
+	var o openAPI
+	if err := json.Unmarshal(b, &o); err != nil {
+		panic("openapi.json: " + err.Error())
+	}
+	for name, s := range o.Components.Schemas {
+		if err := o.compile(s); err != nil {
+			panic(fmt.Sprintf("openapi.json: schema %s: %v", name, err))
+		}
+	}
+	return &o
+}
+
+// resolve follows the reference of the schema
+func (o *openAPI) resolve(s *schema) *schema {
+	for s.Ref != "" {
+		s = o.Components.Schemas[strings.TrimPrefix(s.Ref, schemaRef)]
+	}
+	return s
+}
+
+// compile checks the references, compiles the pattern and merges the
+// schemas of allOf into the schema
+func (o *openAPI) compile(s *schema) error {
+	if s.Ref != "" {
+		if _, ok := o.Components.Schemas[strings.TrimPrefix(s.Ref, schemaRef)]; !ok {
+			return fmt.Errorf("unknown reference %s", s.Ref)
+		}
+		return nil
+	}
+	if s.Pattern != "" {
+		var err error
+		if s.pattern, err = regexp.Compile(s.Pattern); err != nil {
+			return err
+		}
+	}
+	switch a := s.AdditionalProperties; {
+	case a == nil, string(a) == "true":
+	case string(a) == "false":
+		s.closed = true
+	default:
+		s.additional = &schema{}
+		if err := json.Unmarshal(a, s.additional); err != nil {
+			return err
+		}
+	}
+
+	for _, part := range s.AllOf {
+		if err := o.compile(part); err != nil {
+			return err
+		}
+		part = o.resolve(part)
+		s.Type = part.Type
+		s.Required = append(s.Required, part.Required...)
+		if s.Properties.schemas == nil {
+			s.Properties.schemas = make(map[string]*schema)
+		}
+		for _, name := range part.Properties.names {
+			s.Properties.names = append(s.Properties.names, name)
+			s.Properties.schemas[name] = part.Properties.schemas[name]
+		}
+		s.closed = s.closed || part.closed
+	}
+	for _, name := range s.Properties.names {
+		if err := o.compile(s.Properties.schemas[name]); err != nil {
+			return err
+		}
+	}
+	for _, sub := range []*schema{s.Items, s.additional} {
+		if sub != nil {
+			if err := o.compile(sub); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// validate returns the fields of the decoded JSON document v that do not
+// match the named schema
+func (o *openAPI) validate(name string, v interface{}) []FieldError {
+	s, ok := o.Components.Schemas[name]
+	if !ok {
+		return nil
+	}
+	return o.check(s, v, "")
+}
+
+// fieldName is the name of the property under the field
+func fieldName(field, name string) string {
+	if field == "" {
+		return name
+	}
+	return field + "." + name
+}
+
+func (o *openAPI) check(s *schema, v interface{}, field string) []FieldError {
+	s = o.resolve(s)
+	var errs []FieldError
+	invalid := func(field, format string, args ...interface{}) []FieldError {
+		return append(errs, FieldError{field, fmt.Sprintf(format, args...)})
+	}
+
+	if v == nil {
+		if s.Nullable {
+			return nil
+		}
+		return invalid(field, "must not be null")
+	}
+	switch s.Type {
+	case "object":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return invalid(field, "must be an object")
+		}
+		for _, name := range s.Required {
+			if _, ok := m[name]; !ok {
+				errs = invalid(fieldName(field, name), "is required")
+			}
+		}
+		for _, name := range s.Properties.names {
+			if pv, ok := m[name]; ok {
+				errs = append(errs, o.check(s.Properties.schemas[name], pv, fieldName(field, name))...)
+			}
+		}
+		var others []string
+		for name := range m {
+			if _, ok := s.Properties.schemas[name]; !ok {
+				others = append(others, name)
+			}
+		}
+		sort.Strings(others)
+		for _, name := range others {
+			switch {
+			case s.closed:
+				errs = invalid(fieldName(field, name), "is not a known field")
+			case s.additional != nil:
+				errs = append(errs, o.check(s.additional, m[name], fieldName(field, name))...)
+			}
+		}
+		return errs
+
+	case "array":
+		items, ok := v.([]interface{})
+		if !ok {
+			return invalid(field, "must be an array")
+		}
+		if len(items) < s.MinItems {
+			errs = invalid(field, "must have at least %d items", s.MinItems)
+		}
+		if s.MaxItems != nil && len(items) > *s.MaxItems {
+			errs = invalid(field, "must have at most %d items", *s.MaxItems)
+		}
+		for i, item := range items {
+			errs = append(errs, o.check(s.Items, item, fmt.Sprintf("%s[%d]", field, i))...)
+		}
+		return errs
+
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return invalid(field, "must be a string")
+		}
+		if s.MaxLength != nil && utf8.RuneCountInString(str) > *s.MaxLength {
+			errs = invalid(field, "must be at most %d characters", *s.MaxLength)
+		}
+		if s.pattern != nil && !s.pattern.MatchString(str) {
+			errs = invalid(field, "must match %s", s.Pattern)
+		}
+		switch s.Format {
+		case "uuid":
+			if _, err := uuid.Parse(str); err != nil {
+				errs = invalid(field, "must be a UUID")
+			}
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				errs = invalid(field, "must be an RFC 3339 time")
+			}
+		}
+		if !s.allows(str) {
+			errs = invalid(field, "must be %s", s.choices())
+		}
+		return errs
+
+	case "integer", "number":
+		n, ok := v.(json.Number)
+		if !ok {
+			return invalid(field, "must be a %s", s.Type)
+		}
+		f, err := n.Float64()
+		if s.Type == "integer" {
+			var i int64
+			i, err = n.Int64()
+			f = float64(i)
+		}
+		if err != nil {
+			return invalid(field, "must be a %s", s.Type)
+		}
+		if !s.allows(f) {
+			return invalid(field, "must be %s", s.choices())
+		}
+		if s.Minimum != nil && f < *s.Minimum {
+			errs = invalid(field, "must be at least %v", *s.Minimum)
+		}
+		if s.Maximum != nil && f > *s.Maximum {
+			errs = invalid(field, "must be at most %v", *s.Maximum)
+		}
+		return errs
+
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return invalid(field, "must be a boolean")
+		}
+	}
+	return nil
+}
+
+// allows reports if the value is one of the enum, when the schema has one
+func (s *schema) allows(v interface{}) bool {
+	if len(s.Enum) == 0 {
+		return true
+	}
+	for _, e := range s.Enum {
+		if e == v {
+			return true
+		}
+	}
+	return false
+}
+
+// choices lists the enum values, with their names if they have them
+func (s *schema) choices() string {
+	values := make([]string, len(s.Enum))
+	for i, e := range s.Enum {
+		values[i] = fmt.Sprint(e)
+		if i < len(s.EnumNames) {
+			values[i] += " (" + s.EnumNames[i] + ")"
+		}
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	return strings.Join(values[:len(values)-1], ", ") + " or " + values[len(values)-1]
+}
+
+// schemaName is the name of the schema of the request body decoded into v,
+// the name of its type
+func schemaName(v interface{}) string {
+	return reflect.TypeOf(v).Elem().Name()
+}
+
+// GetSpec returns the OpenAPI document of the endpoints
+func (a *apiService) GetSpec(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openapiJSON)
+}
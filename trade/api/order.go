@@ -0,0 +1,169 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// Order gets, cancels or amends an order by id, or gets its history
+func (a *apiService) Order(w http.ResponseWriter, req *http.Request) {
+	if strings.HasSuffix(req.URL.Path, "/history") {
+		a.orderHistory(w, req)
+		return
+	}
+	if !a.allowMethod(w, req, http.MethodGet, http.MethodDelete, http.MethodPatch) {
+		return
+	}
+	a.logRequest(req)
+
+	id, err := uuid.Parse(strings.TrimPrefix(req.URL.Path, "/v1/orders/"))
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, "invalid order id",
+			[]FieldError{{"id", "must be a UUID"}})
+		return
+	}
+	a.orderAction(w, req, id)
+}
+
+// orderHistory gets the events of an order, oldest first
+func (a *apiService) orderHistory(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	a.logRequest(req)
+
+	path := strings.TrimSuffix(strings.TrimPrefix(req.URL.Path, "/v1/orders/"), "/history")
+	id, err := uuid.Parse(path)
+	if err != nil {
+		a.writeError(w, http.StatusBadRequest, "invalid order id",
+			[]FieldError{{"id", "must be a UUID"}})
+		return
+	}
+	o, ok := a.findOrder(id)
+	if !ok || !visible(req, o.Account) {
+		a.writeError(w, http.StatusNotFound, "order "+id.String()+" not found", nil)
+		return
+	}
+	events := a.retrieve.History(id)
+	if events == nil {
+		events = []matcher.Event{}
+	}
+	a.writeJSON(w, http.StatusOK, HistoryResponse{OrderId: id, Events: events})
+}
+
+// ClientOrder gets, cancels or amends an order by the client order id it was
+// placed with, in the account of the key or the account query parameter for
+// an admin
+func (a *apiService) ClientOrder(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet, http.MethodDelete, http.MethodPatch) {
+		return
+	}
+	a.logRequest(req)
+
+	account, ok := a.readAccount(w, req, req.URL.Query().Get("account"))
+	if !ok {
+		return
+	}
+	k := clientKey{
+		account:       account,
+		clientOrderId: strings.TrimPrefix(req.URL.Path, "/v1/orders/client/"),
+	}
+	id, ok := a.clientIds.lookup(k, time.Now())
+	if !ok {
+		// Past the idempotency window the order can still be working
+		for _, o := range a.match.LiveOrders() {
+			if o.Account == k.account && o.ClientOrderId == k.clientOrderId {
+				id, ok = o.Id, true
+				break
+			}
+		}
+	}
+	if !ok {
+		a.writeError(w, http.StatusNotFound,
+			"order with client order id "+k.clientOrderId+" not found", nil)
+		return
+	}
+	a.orderAction(w, req, id)
+}
+
+// orderAction acts on the order if the request can see its account, and
+// replies 404 otherwise so as not to tell which ids exist
+func (a *apiService) orderAction(w http.ResponseWriter, req *http.Request, id uuid.UUID) {
+	o, ok := a.findOrder(id)
+	if !ok || !visible(req, o.Account) {
+		a.writeError(w, http.StatusNotFound, "order "+id.String()+" not found", nil)
+		return
+	}
+	switch req.Method {
+	case http.MethodGet:
+		a.writeJSON(w, http.StatusOK, OrderResponse{Order: o})
+	case http.MethodDelete:
+		a.cancelOrder(w, id)
+	case http.MethodPatch:
+		a.amendOrder(w, req, id)
+	}
+}
+
+// findOrder returns the current state of an order, from the matcher while it
+// is working and from the store once it is closed
+func (a *apiService) findOrder(id uuid.UUID) (matcher.Order, bool) {
+	if o, ok := a.match.LiveOrder(id); ok {
+		return o, true
+	}
+	return a.retrieve.Order(id)
+}
+
+func (a *apiService) cancelOrder(w http.ResponseWriter, id uuid.UUID) {
+	o, err := a.match.CancelOrder(id)
+	if err != nil {
+		a.orderError(w, id, err)
+		return
+	}
+	a.log.WithFields(logrus.Fields{
+		"OrderId": id.String(),
+	}).Debug("Order Cancelled")
+	a.writeJSON(w, http.StatusOK, OrderResponse{Order: o})
+}
+
+func (a *apiService) amendOrder(w http.ResponseWriter, req *http.Request, id uuid.UUID) {
+	var r AmendRequest
+	if !a.decodeBody(w, req, &r) {
+		return
+	}
+	if errs := r.validate(); len(errs) > 0 {
+		a.writeError(w, http.StatusBadRequest, "invalid amendment", errs)
+		return
+	}
+
+	ack, err := a.match.AmendOrder(id, r.Quantity, r.Price)
+	if err != nil {
+		a.orderError(w, id, err)
+		return
+	}
+	a.log.WithFields(logrus.Fields{
+		"OrderId":  id.String(),
+		"Quantity": r.Quantity,
+		"Price":    r.Price,
+	}).Debug("Order Amended")
+	a.writeJSON(w, http.StatusOK, OrderResponse{Order: ack.Order, Fills: fillsFor(principal(req), ack.Fills)})
+}
+
+// orderError replies 404 for an unknown order and 409 for an order that is
+// closed or cannot be changed
+func (a *apiService) orderError(w http.ResponseWriter, id uuid.UUID, err error) {
+	if err != matcher.ErrOrderNotFound {
+		a.writeError(w, http.StatusConflict, err.Error(), nil)
+		return
+	}
+	if _, ok := a.retrieve.Order(id); ok {
+		a.writeError(w, http.StatusConflict, "order "+id.String()+" is closed", nil)
+		return
+	}
+	a.writeError(w, http.StatusNotFound, "order "+id.String()+" not found", nil)
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/nbasker/tools/trade/matcher"
+	"github.com/nbasker/tools/trade/store"
+)
+
+const (
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
+)
+
+func parseStatus(s string) (matcher.Status, bool) {
+	for st := matcher.Placed; st <= matcher.Cancelled; st++ {
+		if st.String() == s {
+			return st, true
+		}
+	}
+	return 0, false
+}
+
+func parseSide(s string) (matcher.Transaction, bool) {
+	for t := matcher.Buy; t <= matcher.Sell; t++ {
+		if t.String() == s {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+// parseOrderQuery reads the order query from the URL query, returning the
+// invalid parameters
+func parseOrderQuery(q url.Values) (store.Query, []FieldError) {
+	f := store.Query{
+		Symbol:  q.Get("symbol"),
+		Account: q.Get("account"),
+		Limit:   defaultPageLimit,
+	}
+	var errs []FieldError
+	invalid := func(field, msg string) {
+		errs = append(errs, FieldError{field, msg})
+	}
+
+	if s := q.Get("status"); s != "" {
+		var ok bool
+		if f.Status, ok = parseStatus(s); !ok {
+			invalid("status", "must be placed, timedout, completed, rejected or cancelled")
+		}
+	}
+	if s := q.Get("side"); s != "" {
+		var ok bool
+		if f.Side, ok = parseSide(s); !ok {
+			invalid("side", "must be buy or sell")
+		}
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &f.From}, {"to", &f.To}} {
+		if s := q.Get(p.name); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				invalid(p.name, "must be an RFC 3339 time")
+			}
+			*p.t = t
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxPageLimit {
+			invalid("limit", fmt.Sprintf("must be between 1 and %d", maxPageLimit))
+		}
+		f.Limit = n
+	}
+	if s := q.Get("cursor"); s != "" {
+		c, err := store.ParseCursor(s)
+		if err != nil {
+			invalid("cursor", "is not a cursor returned by a previous page")
+		}
+		f.After = c
+	}
+	return f, errs
+}
+
+// GetOrders returns the live orders of the matcher and the executed orders
+// of the store, filtered by the query and a page at a time.
+func (a *apiService) GetOrders(w http.ResponseWriter, req *http.Request) {
+	a.logRequest(req)
+
+	q, errs := parseOrderQuery(req.URL.Query())
+	if len(errs) > 0 {
+		a.writeError(w, http.StatusBadRequest, "invalid query", errs)
+		return
+	}
+	var ok bool
+	if q.Account, ok = a.readAccount(w, req, q.Account); !ok {
+		return
+	}
+
+	page, next := a.queryOrders(q)
+	resp := OrdersResponse{Orders: page}
+	if next != nil {
+		resp.NextCursor = next.String()
+	}
+	a.writeJSON(w, http.StatusOK, resp)
+}
+
+// queryOrders returns a page of the live and the stored orders. The first
+// orders of the page are among the first of the store, so a page of the
+// store is merged with the live orders, and there is a next page if either
+// has more.
+func (a *apiService) queryOrders(q store.Query) ([]matcher.Order, *store.Cursor) {
+	stored, more := a.retrieve.Orders(q)
+	page, next := store.Page(append(a.match.LiveOrders(), stored...), q)
+	if next == nil && more != nil {
+		next = store.CursorOf(&page[len(page)-1])
+	}
+	return page, next
+}
@@ -0,0 +1,144 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// killSwitch is the path under an account of its kill switch
+const killSwitch = "/kill-switch"
+
+// sessions counts the open trade streams of each account, the sessions of
+// its clients, and knows the accounts whose working orders are cancelled
+// when their last session drops
+type sessions struct {
+	mu   sync.Mutex
+	open map[string]int
+	// cancelOnDisconnect is set from the keys at start up and only read
+	cancelOnDisconnect map[string]bool
+}
+
+func newSessions(keys []ApiKey) *sessions {
+	s := &sessions{
+		open:               make(map[string]int),
+		cancelOnDisconnect: make(map[string]bool),
+	}
+	for _, k := range keys {
+		if k.CancelOnDisconnect {
+			s.cancelOnDisconnect[k.Account] = true
+		}
+	}
+	return s
+}
+
+// connect opens a session of the account
+func (s *sessions) connect(account string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open[account]++
+}
+
+// disconnect closes a session of the account and reports if it was the
+// last one of an account that cancels on disconnect
+func (s *sessions) disconnect(account string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.open[account]--
+	if s.open[account] > 0 {
+		return false
+	}
+	delete(s.open, account)
+	return s.cancelOnDisconnect[account]
+}
+
+// count returns the open sessions of the account
+func (s *sessions) count(account string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.open[account]
+}
+
+// endSession closes a session of the account, and cancels the working
+// orders of the account if it was its last session and the account cancels
+// on disconnect. The sessions ended by a shutdown leave the orders to the
+// shutdown policy.
+func (a *apiService) endSession(account string) {
+	if !a.sessions.disconnect(account) {
+		return
+	}
+	select {
+	case <-a.stopping:
+		return
+	default:
+	}
+	orders := a.match.CancelOrders(matcher.CancelFilter{Account: account, Reason: "session dropped"})
+	a.log.WithFields(logrus.Fields{
+		"Account": account,
+		"Orders":  len(orders),
+	}).Warn("Session dropped, orders cancelled")
+}
+
+// accountState returns the trading state of the account
+func (a *apiService) accountState(account string) AccountResponse {
+	return AccountResponse{
+		Account:            account,
+		Disabled:           a.match.AccountDisabled(account),
+		CancelOnDisconnect: a.sessions.cancelOnDisconnect[account],
+		Sessions:           a.sessions.count(account),
+	}
+}
+
+// Account returns the trading state of an account. Its kill switch, for
+// admins, cancels the working orders of the account and rejects its new
+// orders when engaged with PUT, until it is released with DELETE.
+func (a *apiService) Account(w http.ResponseWriter, req *http.Request) {
+	a.logRequest(req)
+
+	path := strings.TrimPrefix(req.URL.Path, "/v1/accounts/")
+	account := strings.TrimSuffix(path, killSwitch)
+	if account == "" || strings.Contains(account, "/") {
+		a.writeError(w, http.StatusNotFound, req.URL.Path+" not found", nil)
+		return
+	}
+	if account == path {
+		if !a.allowMethod(w, req, http.MethodGet) {
+			return
+		}
+		if _, ok := a.readAccount(w, req, account); !ok {
+			return
+		}
+		a.writeJSON(w, http.StatusOK, a.accountState(account))
+		return
+	}
+
+	if !a.allowMethod(w, req, http.MethodPut, http.MethodDelete) || !a.requireAdmin(w, req) {
+		return
+	}
+	var by string
+	if k := principal(req); k != nil {
+		by = k.Key
+	}
+	if req.Method == http.MethodPut {
+		cancelled := a.match.DisableAccount(account)
+		a.log.WithFields(logrus.Fields{
+			"Account": account,
+			"Key":     by,
+			"Orders":  len(cancelled),
+		}).Warn("Kill switch engaged")
+		resp := a.accountState(account)
+		resp.Cancelled = cancelled
+		a.writeJSON(w, http.StatusOK, resp)
+		return
+	}
+	a.match.EnableAccount(account)
+	a.log.WithFields(logrus.Fields{
+		"Account": account,
+		"Key":     by,
+	}).Warn("Kill switch released")
+	a.writeJSON(w, http.StatusOK, a.accountState(account))
+}
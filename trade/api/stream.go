@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// streamBuffer is the number of trades a stream can fall behind by before
+// trades are dropped for it
+const streamBuffer = 256
+
+// tradeFeed fans the trades of the matcher out to the streams. The matcher
+// never waits on a stream, a stream too slow to keep up misses trades.
+type tradeFeed struct {
+	once sync.Once
+
+	mu   sync.Mutex
+	subs map[chan matcher.Trade]struct{}
+}
+
+func (f *tradeFeed) publish(t matcher.Trade) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		select {
+		case ch <- t:
+		default:
+		}
+	}
+}
+
+func (f *tradeFeed) subscribe() chan matcher.Trade {
+	ch := make(chan matcher.Trade, streamBuffer)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.subs == nil {
+		f.subs = make(map[chan matcher.Trade]struct{})
+	}
+	f.subs[ch] = struct{}{}
+	return ch
+}
+
+func (f *tradeFeed) unsubscribe(ch chan matcher.Trade) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subs, ch)
+}
+
+// StreamTrades streams the trades as server-sent events until the client
+// goes away or the service shuts down. A heartbeat is sent at every
+// interval, so that a client that is gone fails a write and ends its
+// stream. The stream of a key is a session of its account, and a trader
+// sees the ids of the orders of its account only.
+func (a *apiService) StreamTrades(w http.ResponseWriter, req *http.Request) {
+	if !a.allowMethod(w, req, http.MethodGet) {
+		return
+	}
+	a.logRequest(req)
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		a.writeError(w, http.StatusInternalServerError, "streaming is not supported", nil)
+		return
+	}
+
+	// The feed subscribes to the matcher with the first stream
+	a.feed.once.Do(func() { a.match.Subscribe(a.feed.publish) })
+	ch := a.feed.subscribe()
+	defer a.feed.unsubscribe(ch)
+	k := principal(req)
+	if k != nil && k.Account != "" {
+		a.sessions.connect(k.Account)
+		defer a.endSession(k.Account)
+	}
+	heartbeat := time.NewTicker(a.heartbeat)
+	defer heartbeat.Stop()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-req.Context().Done():
+			return
+		case <-a.stopping:
+			return
+		case t := <-ch:
+			if !a.sendEvent(w, flusher, "trade", tradeFor(k, t)) {
+				return
+			}
+		case now := <-heartbeat.C:
+			if !a.sendEvent(w, flusher, "heartbeat", Heartbeat{Time: now.UTC()}) {
+				return
+			}
+		}
+	}
+}
+
+// sendEvent writes v as a server-sent event, reporting false if the client
+// is gone
+func (a *apiService) sendEvent(w http.ResponseWriter, flusher http.Flusher, event string, v interface{}) bool {
+	b, err := json.Marshal(v)
+	if err != nil {
+		a.log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to encode " + event)
+		return true
+	}
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return false
+	}
+	flusher.Flush()
+	return true
+}
@@ -0,0 +1,341 @@
+package api
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nbasker/tools/trade/algo"
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// FieldError describes why a request field is invalid
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ErrorResponse is the body of every error response
+type ErrorResponse struct {
+	Error  string       `json:"error"`
+	Fields []FieldError `json:"fields,omitempty"`
+}
+
+// OrderRequest is the body to place an order
+type OrderRequest struct {
+	ClientOrderId   string               `json:"client_order_id,omitempty"`
+	Symbol          string               `json:"symbol,omitempty"`
+	Account         string               `json:"account,omitempty"`
+	Transaction     matcher.Transaction  `json:"transaction"`
+	OrderType       matcher.OrderType    `json:"order_type"`
+	Quantity        int                  `json:"quantity"`
+	Price           int                  `json:"price,omitempty"`
+	TriggerPrice    int                  `json:"trigger_price,omitempty"`
+	DisplayQuantity int                  `json:"display_quantity,omitempty"`
+	PostOnly        matcher.PostOnly     `json:"post_only,omitempty"`
+	AllOrNone       bool                 `json:"all_or_none,omitempty"`
+	MinQuantity     int                  `json:"min_quantity,omitempty"`
+	PegReference    matcher.PegReference `json:"peg_reference,omitempty"`
+	PegOffset       int                  `json:"peg_offset,omitempty"`
+	PegLimit        int                  `json:"peg_limit,omitempty"`
+}
+
+// AmendRequest is the body to amend an order. Fields left out are unchanged.
+type AmendRequest struct {
+	Quantity int `json:"quantity,omitempty"`
+	Price    int `json:"price,omitempty"`
+}
+
+// OrderResponse is returned for a single order, with the fills it made on
+// arrival when it is placed
+type OrderResponse struct {
+	Order matcher.Order   `json:"order"`
+	Fills []matcher.Trade `json:"fills,omitempty"`
+}
+
+// BatchRequest is the body to place several orders at once
+type BatchRequest struct {
+	Orders []OrderRequest `json:"orders"`
+}
+
+// BatchResult is the outcome of an order of a batch, with the status code
+// it would have been answered with on its own: the order and its fills, or
+// the error and the invalid fields
+type BatchResult struct {
+	Status int             `json:"status"`
+	Order  *matcher.Order  `json:"order,omitempty"`
+	Fills  []matcher.Trade `json:"fills,omitempty"`
+	Error  string          `json:"error,omitempty"`
+	Fields []FieldError    `json:"fields,omitempty"`
+}
+
+// BatchResponse is returned for a batch, with a result for each order in
+// the order they were given
+type BatchResponse struct {
+	Results []BatchResult `json:"results"`
+}
+
+// HistoryResponse is returned for the events of an order, oldest first
+type HistoryResponse struct {
+	OrderId uuid.UUID       `json:"order_id"`
+	Events  []matcher.Event `json:"events"`
+}
+
+// AccountResponse is returned for the trading state of an account, with
+// the orders cancelled when its kill switch is engaged
+type AccountResponse struct {
+	Account            string          `json:"account"`
+	Disabled           bool            `json:"disabled"`
+	CancelOnDisconnect bool            `json:"cancel_on_disconnect"`
+	Sessions           int             `json:"sessions"`
+	Cancelled          []matcher.Order `json:"cancelled,omitempty"`
+}
+
+// Heartbeat is sent on the trade streams while there are no trades
+type Heartbeat struct {
+	Time time.Time `json:"time"`
+}
+
+// OrdersResponse is returned for a page of orders, with the cursor of the
+// next page if there is one
+type OrdersResponse struct {
+	Orders     []matcher.Order `json:"orders"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// StopOrder is a stop or stop-limit order with its trigger state
+type StopOrder struct {
+	matcher.Order
+	State string `json:"state"`
+}
+
+// StopOrdersResponse is returned for the stop orders held by the matcher
+type StopOrdersResponse struct {
+	Orders []StopOrder `json:"orders"`
+}
+
+// BookResponse is returned for the market depth
+type BookResponse struct {
+	Book matcher.Book `json:"book"`
+}
+
+// GroupRequest is the body to place an OCO or bracket group
+type GroupRequest struct {
+	Type   matcher.GroupType `json:"type"`
+	Orders []OrderRequest    `json:"orders"`
+}
+
+// GroupResponse is returned for a placed group
+type GroupResponse struct {
+	Id     uuid.UUID         `json:"id"`
+	Type   matcher.GroupType `json:"type"`
+	Orders []matcher.Order   `json:"orders"`
+}
+
+// MetricsResponse is returned for the matcher queue and the orders turned
+// away by the overload protection
+type MetricsResponse struct {
+	QueueDepth          int    `json:"queue_depth"`
+	QueueCapacity       int    `json:"queue_capacity"`
+	RejectedQueueFull   uint64 `json:"rejected_queue_full"`
+	RejectedRateLimited uint64 `json:"rejected_rate_limited"`
+}
+
+// AlgoRequest is the body to place an algo parent order
+type AlgoRequest struct {
+	Symbol        string              `json:"symbol,omitempty"`
+	Account       string              `json:"account,omitempty"`
+	Strategy      algo.Strategy       `json:"strategy"`
+	Transaction   matcher.Transaction `json:"transaction"`
+	OrderType     matcher.OrderType   `json:"order_type"`
+	Quantity      int                 `json:"quantity"`
+	Price         int                 `json:"price"`
+	Duration      int                 `json:"duration"`
+	Slices        int                 `json:"slices,omitempty"`
+	Participation float64             `json:"participation,omitempty"`
+}
+
+// AlgoResponse is returned for a single algo parent order
+type AlgoResponse struct {
+	Algo algo.Parent `json:"algo"`
+}
+
+// AlgosResponse is returned for the algo parent orders
+type AlgosResponse struct {
+	Algos []algo.Parent `json:"algos"`
+}
+
+// validate returns the invalid fields of the order, named under prefix, that
+// the schema cannot tell: the fields that depend on the order type and on
+// each other. The symbol is optional, but must be the one traded if given.
+// The client order id is checked here too as it may come from a header.
+func (r *OrderRequest) validate(prefix, symbol string) []FieldError {
+	var errs []FieldError
+	invalid := func(field, format string, args ...interface{}) {
+		errs = append(errs, FieldError{
+			Field:   prefix + field,
+			Message: fmt.Sprintf(format, args...),
+		})
+	}
+
+	if r.ClientOrderId != "" && !validClientOrderId(r.ClientOrderId) {
+		invalid("client_order_id", "must be up to %d letters, digits or -_.:", maxClientOrderId)
+	}
+	if r.Symbol != "" && r.Symbol != symbol {
+		invalid("symbol", "must be %s", symbol)
+	}
+	switch r.OrderType {
+	case matcher.Stop, matcher.Pegged:
+		// The price is set when the stop triggers or by the peg
+		if r.Price != 0 {
+			invalid("price", "must not be set for %s orders", r.OrderType)
+		}
+	default:
+		if r.Price <= 0 {
+			invalid("price", "must be positive")
+		}
+	}
+
+	if r.OrderType == matcher.Stop || r.OrderType == matcher.StopLimit {
+		if r.TriggerPrice <= 0 {
+			invalid("trigger_price", "must be positive")
+		}
+	} else if r.TriggerPrice != 0 {
+		invalid("trigger_price", "is only for stop and stop-limit orders")
+	}
+
+	if r.OrderType == matcher.Iceberg {
+		if r.DisplayQuantity <= 0 || (r.Quantity > 0 && r.DisplayQuantity > r.Quantity) {
+			invalid("display_quantity", "must be between 1 and quantity")
+		}
+	} else if r.DisplayQuantity != 0 {
+		invalid("display_quantity", "is only for iceberg orders")
+	}
+
+	if r.MinQuantity > r.Quantity {
+		invalid("min_quantity", "must be between 0 and quantity")
+	}
+
+	if r.OrderType == matcher.Pegged {
+		if r.PegReference == 0 {
+			invalid("peg_reference", "is required for pegged orders")
+		}
+		// A pegged order is priced where nothing is on the other side, so
+		// it could never meet an arrival-only instruction
+		if r.AllOrNone {
+			invalid("all_or_none", "is not for pegged orders")
+		}
+		if r.MinQuantity > 0 {
+			invalid("min_quantity", "is not for pegged orders")
+		}
+	} else if r.PegReference != 0 || r.PegOffset != 0 || r.PegLimit != 0 {
+		invalid("peg_reference", "peg fields are only for pegged orders")
+	}
+	return errs
+}
+
+// order returns a new order for the request, with a unique orderId and the
+// initial status
+func (r *OrderRequest) order(symbol string) *matcher.Order {
+	return &matcher.Order{
+		ClientOrderId:   r.ClientOrderId,
+		Symbol:          symbol,
+		Account:         r.Account,
+		Id:              uuid.New(),
+		OrderTime:       time.Now().UTC(),
+		Transaction:     r.Transaction,
+		PlacedQuantity:  r.Quantity,
+		Quantity:        r.Quantity,
+		Price:           r.Price,
+		OrderType:       r.OrderType,
+		Status:          matcher.Placed,
+		TriggerPrice:    r.TriggerPrice,
+		DisplayQuantity: r.DisplayQuantity,
+		PostOnly:        r.PostOnly,
+		AllOrNone:       r.AllOrNone,
+		MinQuantity:     r.MinQuantity,
+		PegReference:    r.PegReference,
+		PegOffset:       r.PegOffset,
+		PegLimit:        r.PegLimit,
+	}
+}
+
+// validate returns the invalid fields of the orders of the group
+func (r *GroupRequest) validate(symbol string) []FieldError {
+	var errs []FieldError
+	for i := range r.Orders {
+		prefix := fmt.Sprintf("orders[%d].", i)
+		errs = append(errs, r.Orders[i].validate(prefix, symbol)...)
+		if r.Orders[i].ClientOrderId != "" {
+			errs = append(errs, FieldError{prefix + "client_order_id",
+				"is only for single orders"})
+		}
+	}
+	return errs
+}
+
+// maxClientOrderId is the longest client order id
+const maxClientOrderId = 64
+
+func validClientOrderId(id string) bool {
+	if len(id) > maxClientOrderId {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// validate returns the invalid fields of the amendment
+func (r *AmendRequest) validate() []FieldError {
+	var errs []FieldError
+	if r.Quantity == 0 && r.Price == 0 {
+		errs = append(errs, FieldError{"quantity", "quantity or price must be set"})
+	}
+	return errs
+}
+
+// validate returns the invalid fields of the algo parent order that depend
+// on each other
+func (r *AlgoRequest) validate(symbol string) []FieldError {
+	var errs []FieldError
+	invalid := func(field, msg string) {
+		errs = append(errs, FieldError{field, msg})
+	}
+
+	if r.Symbol != "" && r.Symbol != symbol {
+		invalid("symbol", "must be "+symbol)
+	}
+	if r.Slices > r.Quantity {
+		invalid("slices", "must be between 0 and quantity")
+	}
+	if r.Strategy == algo.VWAP && r.Participation == 0 {
+		invalid("participation", "must be above 0 and at most 1")
+	}
+	return errs
+}
+
+// parent returns a new algo parent order for the request
+func (r *AlgoRequest) parent(symbol string) *algo.Parent {
+	return &algo.Parent{
+		Symbol:        symbol,
+		Account:       r.Account,
+		Id:            uuid.New(),
+		Strategy:      r.Strategy,
+		Transaction:   r.Transaction,
+		OrderType:     r.OrderType,
+		Quantity:      r.Quantity,
+		Price:         r.Price,
+		Duration:      r.Duration,
+		Slices:        r.Slices,
+		Participation: r.Participation,
+		StartTime:     time.Now().UTC(),
+	}
+}
@@ -0,0 +1,554 @@
+// Package client calls the trade REST API with typed requests and results.
+// Requests are signed when a key is given, and requests refused by the rate
+// limit or a full matcher queue are retried after the wait the service asks
+// for.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nbasker/tools/trade/algo"
+	"github.com/nbasker/tools/trade/api"
+	"github.com/nbasker/tools/trade/matcher"
+	"github.com/nbasker/tools/trade/store"
+)
+
+// Client calls the operations of the trade REST API
+type Client interface {
+	// PlaceOrder places the order. An order without a client order id is
+	// given one, so that a retried submission is placed only once.
+	PlaceOrder(ctx context.Context, r api.OrderRequest) (Placed, error)
+
+	// PlaceOrders places the orders together and returns the result of each
+	// in the same order. Orders without a client order id are given one.
+	PlaceOrders(ctx context.Context, orders []api.OrderRequest) ([]api.BatchResult, error)
+
+	// GetOrder returns the order by its id
+	GetOrder(ctx context.Context, id uuid.UUID) (matcher.Order, error)
+
+	// OrderHistory returns the events of the order, oldest first
+	OrderHistory(ctx context.Context, id uuid.UUID) ([]matcher.Event, error)
+
+	// CancelOrder cancels the order and returns it cancelled
+	CancelOrder(ctx context.Context, id uuid.UUID) (matcher.Order, error)
+
+	// CancelOrders cancels the working orders of the account that pass the
+	// filter at once and returns them cancelled
+	CancelOrders(ctx context.Context, f matcher.CancelFilter) ([]matcher.Order, error)
+
+	// AmendOrder changes the quantity or price of the order and returns it
+	// with the fills the change caused
+	AmendOrder(ctx context.Context, id uuid.UUID, r api.AmendRequest) (api.OrderResponse, error)
+
+	// GetClientOrder returns the order by the account's client order id
+	GetClientOrder(ctx context.Context, account, clientOrderId string) (matcher.Order, error)
+
+	// CancelClientOrder cancels the order by the account's client order id
+	CancelClientOrder(ctx context.Context, account, clientOrderId string) (matcher.Order, error)
+
+	// AmendClientOrder amends the order by the account's client order id
+	AmendClientOrder(ctx context.Context, account, clientOrderId string, r api.AmendRequest) (api.OrderResponse, error)
+
+	// ListOrders returns a page of the orders matching the query
+	ListOrders(ctx context.Context, q Query) (api.OrdersResponse, error)
+
+	// StopOrders returns the stop orders with their state
+	StopOrders(ctx context.Context) ([]api.StopOrder, error)
+
+	// Book returns the market depth
+	Book(ctx context.Context) (matcher.Book, error)
+
+	// PlaceGroup places the linked orders of the group
+	PlaceGroup(ctx context.Context, r api.GroupRequest) (api.GroupResponse, error)
+
+	// PlaceAlgo places a parent order for the algo to work
+	PlaceAlgo(ctx context.Context, r api.AlgoRequest) (algo.Parent, error)
+
+	// Algos returns the parent orders with their progress
+	Algos(ctx context.Context) ([]algo.Parent, error)
+
+	// Account returns the kill switch and the sessions of the account
+	Account(ctx context.Context, account string) (api.AccountResponse, error)
+
+	// KillSwitch disables the account and cancels its open orders, an
+	// admin only
+	KillSwitch(ctx context.Context, account string) (api.AccountResponse, error)
+
+	// ReleaseKillSwitch takes orders of the account again, an admin only
+	ReleaseKillSwitch(ctx context.Context, account string) (api.AccountResponse, error)
+
+	// Metrics returns the matcher queue and the refused requests
+	Metrics(ctx context.Context) (api.MetricsResponse, error)
+
+	// DumpMatcher returns the state of the matcher
+	DumpMatcher(ctx context.Context) (matcher.Dump, error)
+
+	// StoreSummary returns the number of stored orders by status
+	StoreSummary(ctx context.Context) (store.Summary, error)
+
+	// LogLevel returns the log level of the service
+	LogLevel(ctx context.Context) (string, error)
+
+	// SetLogLevel changes the log level of the service
+	SetLogLevel(ctx context.Context, level string) error
+
+	// WatchTrades calls fn with every trade until the context is done or
+	// the service ends the stream
+	WatchTrades(ctx context.Context, fn func(matcher.Trade)) error
+}
+
+// Options of the client. Zero values leave requests unsigned and use the
+// defaults.
+type Options struct {
+	// Key and Secret sign the requests
+	Key    string
+	Secret string
+
+	// Retries is the number of times a refused request is retried, 3 if
+	// zero and none if negative
+	Retries int
+
+	// Backoff is the first wait before a retry when the service does not
+	// ask for one, doubled at each retry
+	Backoff time.Duration
+
+	// HTTPClient sends the requests
+	HTTPClient *http.Client
+}
+
+const (
+	defaultRetries = 3
+	defaultBackoff = 100 * time.Millisecond
+)
+
+// Error is a request the service did not carry out
+type Error struct {
+	StatusCode int
+	api.ErrorResponse
+
+	// RetryAfter is the wait the service asked for before a retry
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s", e.StatusCode, e.ErrorResponse.Error)
+	for _, f := range e.Fields {
+		fmt.Fprintf(&b, ", %s %s", f.Field, f.Message)
+	}
+	return b.String()
+}
+
+// IsNotFound reports if the error is for an order or resource not found
+func IsNotFound(err error) bool {
+	var e *Error
+	return errors.As(err, &e) && e.StatusCode == http.StatusNotFound
+}
+
+// Placed is the result of placing an order
+type Placed struct {
+	api.OrderResponse
+
+	// Acknowledged is false if the matcher did not acknowledge the order in
+	// time. The order is accepted and its state is left to be looked up.
+	Acknowledged bool
+
+	// Replayed is true if the client order id was placed before, and the
+	// original order is returned
+	Replayed bool
+}
+
+// Query selects the orders to list. Zero values match every order.
+type Query struct {
+	Status  matcher.Status
+	Side    matcher.Transaction
+	Symbol  string
+	Account string
+	From    time.Time
+	To      time.Time
+	Limit   int
+	Cursor  string
+}
+
+func (q Query) values() url.Values {
+	v := url.Values{}
+	if q.Status != 0 {
+		v.Set("status", q.Status.String())
+	}
+	if q.Side != 0 {
+		v.Set("side", q.Side.String())
+	}
+	if q.Symbol != "" {
+		v.Set("symbol", q.Symbol)
+	}
+	if q.Account != "" {
+		v.Set("account", q.Account)
+	}
+	if !q.From.IsZero() {
+		v.Set("from", q.From.Format(time.RFC3339))
+	}
+	if !q.To.IsZero() {
+		v.Set("to", q.To.Format(time.RFC3339))
+	}
+	if q.Limit != 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+	if q.Cursor != "" {
+		v.Set("cursor", q.Cursor)
+	}
+	return v
+}
+
+// client defines implementation of the Client
+type client struct {
+	endpoint string
+	opts     Options
+	http     *http.Client
+}
+
+// NewClient returns the client of the service at the endpoint, such as
+// http://localhost:8080
+func NewClient(endpoint string, opts Options) Client {
+	if opts.Retries == 0 {
+		opts.Retries = defaultRetries
+	}
+	if opts.Backoff == 0 {
+		opts.Backoff = defaultBackoff
+	}
+	c := &client{
+		endpoint: strings.TrimSuffix(endpoint, "/"),
+		opts:     opts,
+		http:     opts.HTTPClient,
+	}
+	if c.http == nil {
+		c.http = http.DefaultClient
+	}
+	return c
+}
+
+func (c *client) PlaceOrder(ctx context.Context, r api.OrderRequest) (Placed, error) {
+	if r.ClientOrderId == "" {
+		r.ClientOrderId = uuid.New().String()
+	}
+	var p Placed
+	resp, err := c.call(ctx, http.MethodPost, "/v1/orders", r, &p.OrderResponse, true)
+	if err != nil {
+		return Placed{}, err
+	}
+	p.Acknowledged = resp.StatusCode != http.StatusAccepted
+	p.Replayed = resp.Header.Get("Idempotent-Replayed") == "true"
+	return p, nil
+}
+
+func (c *client) PlaceOrders(ctx context.Context, orders []api.OrderRequest) ([]api.BatchResult, error) {
+	r := api.BatchRequest{Orders: make([]api.OrderRequest, len(orders))}
+	for i, o := range orders {
+		if o.ClientOrderId == "" {
+			o.ClientOrderId = uuid.New().String()
+		}
+		r.Orders[i] = o
+	}
+	var resp api.BatchResponse
+	_, err := c.call(ctx, http.MethodPost, "/v1/orders/batch", r, &resp, true)
+	return resp.Results, err
+}
+
+func (c *client) GetOrder(ctx context.Context, id uuid.UUID) (matcher.Order, error) {
+	var r api.OrderResponse
+	_, err := c.call(ctx, http.MethodGet, "/v1/orders/"+id.String(), nil, &r, true)
+	return r.Order, err
+}
+
+func (c *client) OrderHistory(ctx context.Context, id uuid.UUID) ([]matcher.Event, error) {
+	var r api.HistoryResponse
+	_, err := c.call(ctx, http.MethodGet, "/v1/orders/"+id.String()+"/history", nil, &r, true)
+	return r.Events, err
+}
+
+func (c *client) CancelOrder(ctx context.Context, id uuid.UUID) (matcher.Order, error) {
+	var r api.OrderResponse
+	_, err := c.call(ctx, http.MethodDelete, "/v1/orders/"+id.String(), nil, &r, false)
+	return r.Order, err
+}
+
+func (c *client) CancelOrders(ctx context.Context, f matcher.CancelFilter) ([]matcher.Order, error) {
+	v := url.Values{}
+	if f.Account != "" {
+		v.Set("account", f.Account)
+	}
+	if f.Symbol != "" {
+		v.Set("symbol", f.Symbol)
+	}
+	if f.Transaction != 0 {
+		v.Set("side", f.Transaction.String())
+	}
+	p := "/v1/orders"
+	if len(v) > 0 {
+		p += "?" + v.Encode()
+	}
+	var r api.OrdersResponse
+	_, err := c.call(ctx, http.MethodDelete, p, nil, &r, true)
+	return r.Orders, err
+}
+
+func (c *client) AmendOrder(ctx context.Context, id uuid.UUID, r api.AmendRequest) (api.OrderResponse, error) {
+	var resp api.OrderResponse
+	_, err := c.call(ctx, http.MethodPatch, "/v1/orders/"+id.String(), r, &resp, false)
+	return resp, err
+}
+
+// clientPath is the path of the order by the account's client order id
+func clientPath(account, clientOrderId string) string {
+	p := "/v1/orders/client/" + url.PathEscape(clientOrderId)
+	if account != "" {
+		p += "?" + url.Values{"account": {account}}.Encode()
+	}
+	return p
+}
+
+func (c *client) GetClientOrder(ctx context.Context, account, clientOrderId string) (matcher.Order, error) {
+	var r api.OrderResponse
+	_, err := c.call(ctx, http.MethodGet, clientPath(account, clientOrderId), nil, &r, true)
+	return r.Order, err
+}
+
+func (c *client) CancelClientOrder(ctx context.Context, account, clientOrderId string) (matcher.Order, error) {
+	var r api.OrderResponse
+	_, err := c.call(ctx, http.MethodDelete, clientPath(account, clientOrderId), nil, &r, false)
+	return r.Order, err
+}
+
+func (c *client) AmendClientOrder(ctx context.Context, account, clientOrderId string, r api.AmendRequest) (api.OrderResponse, error) {
+	var resp api.OrderResponse
+	_, err := c.call(ctx, http.MethodPatch, clientPath(account, clientOrderId), r, &resp, false)
+	return resp, err
+}
+
+func (c *client) ListOrders(ctx context.Context, q Query) (api.OrdersResponse, error) {
+	p := "/v1/orders"
+	if v := q.values(); len(v) > 0 {
+		p += "?" + v.Encode()
+	}
+	var r api.OrdersResponse
+	_, err := c.call(ctx, http.MethodGet, p, nil, &r, true)
+	return r, err
+}
+
+func (c *client) StopOrders(ctx context.Context) ([]api.StopOrder, error) {
+	var r api.StopOrdersResponse
+	_, err := c.call(ctx, http.MethodGet, "/v1/stops", nil, &r, true)
+	return r.Orders, err
+}
+
+func (c *client) Book(ctx context.Context) (matcher.Book, error) {
+	var r api.BookResponse
+	_, err := c.call(ctx, http.MethodGet, "/v1/book", nil, &r, true)
+	return r.Book, err
+}
+
+func (c *client) PlaceGroup(ctx context.Context, r api.GroupRequest) (api.GroupResponse, error) {
+	var resp api.GroupResponse
+	_, err := c.call(ctx, http.MethodPost, "/v1/groups", r, &resp, false)
+	return resp, err
+}
+
+func (c *client) PlaceAlgo(ctx context.Context, r api.AlgoRequest) (algo.Parent, error) {
+	var resp api.AlgoResponse
+	_, err := c.call(ctx, http.MethodPost, "/v1/algos", r, &resp, false)
+	return resp.Algo, err
+}
+
+func (c *client) Algos(ctx context.Context) ([]algo.Parent, error) {
+	var r api.AlgosResponse
+	_, err := c.call(ctx, http.MethodGet, "/v1/algos", nil, &r, true)
+	return r.Algos, err
+}
+
+func (c *client) Account(ctx context.Context, account string) (api.AccountResponse, error) {
+	var r api.AccountResponse
+	_, err := c.call(ctx, http.MethodGet, "/v1/accounts/"+url.PathEscape(account), nil, &r, true)
+	return r, err
+}
+
+func (c *client) KillSwitch(ctx context.Context, account string) (api.AccountResponse, error) {
+	var r api.AccountResponse
+	_, err := c.call(ctx, http.MethodPut, "/v1/accounts/"+url.PathEscape(account)+"/kill-switch", nil, &r, true)
+	return r, err
+}
+
+func (c *client) ReleaseKillSwitch(ctx context.Context, account string) (api.AccountResponse, error) {
+	var r api.AccountResponse
+	_, err := c.call(ctx, http.MethodDelete, "/v1/accounts/"+url.PathEscape(account)+"/kill-switch", nil, &r, true)
+	return r, err
+}
+
+func (c *client) Metrics(ctx context.Context) (api.MetricsResponse, error) {
+	var r api.MetricsResponse
+	_, err := c.call(ctx, http.MethodGet, "/v1/metrics", nil, &r, true)
+	return r, err
+}
+
+func (c *client) DumpMatcher(ctx context.Context) (matcher.Dump, error) {
+	var d matcher.Dump
+	_, err := c.call(ctx, http.MethodGet, "/debug/matcher", nil, &d, true)
+	return d, err
+}
+
+func (c *client) StoreSummary(ctx context.Context) (store.Summary, error) {
+	var s store.Summary
+	_, err := c.call(ctx, http.MethodGet, "/debug/store", nil, &s, true)
+	return s, err
+}
+
+func (c *client) LogLevel(ctx context.Context) (string, error) {
+	var r api.LogLevelRequest
+	_, err := c.call(ctx, http.MethodGet, "/debug/loglevel", nil, &r, true)
+	return r.Level, err
+}
+
+func (c *client) SetLogLevel(ctx context.Context, level string) error {
+	_, err := c.call(ctx, http.MethodPut, "/debug/loglevel", api.LogLevelRequest{Level: level}, nil, true)
+	return err
+}
+
+func (c *client) WatchTrades(ctx context.Context, fn func(matcher.Trade)) error {
+	resp, err := c.send(ctx, http.MethodGet, "/v1/trades/stream", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return readError(resp)
+	}
+
+	// Each event is an event line and a data line, ended by a blank line.
+	// The heartbeats between trades are skipped.
+	scanner := bufio.NewScanner(resp.Body)
+	event := ""
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "event: ") {
+			event = strings.TrimPrefix(line, "event: ")
+			continue
+		}
+		if event != "trade" || !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		var t matcher.Trade
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &t); err != nil {
+			return fmt.Errorf("malformed trade: %w", err)
+		}
+		fn(t)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return scanner.Err()
+}
+
+// call sends the request with the JSON body, retrying it while the service
+// refuses it for the rate limit or a full queue, and decodes the response
+// into out. A request that may have reached the service is retried after
+// a connection error only if it is safe to repeat.
+func (c *client) call(ctx context.Context, method, path string, body, out interface{}, safe bool) (*http.Response, error) {
+	var b []byte
+	if body != nil {
+		var err error
+		if b, err = json.Marshal(body); err != nil {
+			return nil, err
+		}
+	}
+
+	wait := c.opts.Backoff
+	for attempt := 0; ; attempt++ {
+		resp, err := c.send(ctx, method, path, b)
+		retry := attempt < c.opts.Retries
+		if err != nil {
+			if !retry || !safe || ctx.Err() != nil {
+				return nil, err
+			}
+		} else {
+			if resp.StatusCode < 300 {
+				defer resp.Body.Close()
+				if out == nil {
+					return resp, nil
+				}
+				if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+					return resp, fmt.Errorf("malformed response: %w", err)
+				}
+				return resp, nil
+			}
+			e := readError(resp)
+			refused := resp.StatusCode == http.StatusTooManyRequests ||
+				resp.StatusCode == http.StatusServiceUnavailable
+			if !retry || !refused {
+				return resp, e
+			}
+			if e.RetryAfter > 0 {
+				wait = e.RetryAfter
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		wait *= 2
+	}
+}
+
+// send sends the request, signed if the client has a key
+func (c *client) send(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.opts.Key != "" {
+		// The nonce keeps a retry within the second from being a replay
+		ts, nonce := strconv.FormatInt(time.Now().Unix(), 10), uuid.New().String()
+		req.Header.Set("X-Api-Key", c.opts.Key)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Nonce", nonce)
+		req.Header.Set("X-Signature", api.Sign(c.opts.Secret, ts, nonce, method, req.URL.RequestURI(), body))
+	}
+	return c.http.Do(req)
+}
+
+// readError reads the error response and closes its body
+func readError(resp *http.Response) *Error {
+	defer resp.Body.Close()
+	e := &Error{StatusCode: resp.StatusCode}
+	b, _ := ioutil.ReadAll(resp.Body)
+	if json.Unmarshal(b, &e.ErrorResponse) != nil || e.ErrorResponse.Error == "" {
+		e.ErrorResponse.Error = strings.TrimSpace(string(b))
+		if e.ErrorResponse.Error == "" {
+			e.ErrorResponse.Error = http.StatusText(resp.StatusCode)
+		}
+	}
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return e
+}
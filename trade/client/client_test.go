@@ -0,0 +1,251 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/nbasker/tools/trade/api"
+	"github.com/nbasker/tools/trade/matcher"
+	"github.com/nbasker/tools/trade/store"
+)
+
+var testKeys = []api.ApiKey{
+	{Key: "alice", Secret: "alice-secret", Account: "alice", Role: api.Trader},
+	{Key: "ops", Secret: "ops-secret", Role: api.Admin},
+}
+
+// newTestServer serves the api over a running matcher and store
+func newTestServer(t *testing.T) *httptest.Server {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	orders := make(chan *matcher.Order)
+	complete := make(chan *matcher.Order)
+	events := make(chan matcher.Event)
+	st := store.NewStorageService(complete, events, nil, log)
+	go st.StoreCompletedOrders()
+	match := matcher.NewMatcherService(orders, complete, events, 600, 5*time.Second, 100, matcher.PersistResting, log)
+	ctx, cancel := context.WithCancel(context.Background())
+	go match.ExecuteOrders(ctx)
+	a := api.NewApiService("", "SAMPLE", time.Second, time.Hour, time.Second, match, nil, st, api.Limits{}, testKeys, log)
+
+	srv := httptest.NewServer(a.Handler())
+	t.Cleanup(func() {
+		srv.Close()
+		cancel()
+	})
+	return srv
+}
+
+func limitOrder(side matcher.Transaction, quantity, price int) api.OrderRequest {
+	return api.OrderRequest{
+		Transaction: side,
+		OrderType:   matcher.Limit,
+		Quantity:    quantity,
+		Price:       price,
+	}
+}
+
+func Test_Client_Orders(t *testing.T) {
+	srv := newTestServer(t)
+	c := NewClient(srv.URL, Options{Key: "alice", Secret: "alice-secret"})
+	ctx := context.Background()
+
+	buy, err := c.PlaceOrder(ctx, limitOrder(matcher.Buy, 10, 100))
+	assert.NoError(t, err)
+	assert.True(t, buy.Acknowledged)
+	assert.Equal(t, "alice", buy.Order.Account)
+	assert.NotEmpty(t, buy.Order.ClientOrderId, "a client order id is generated")
+
+	book, err := c.Book(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []matcher.PriceLevel{{Price: 100, Quantity: 10, Orders: 1}}, book.Buy)
+
+	amended, err := c.AmendOrder(ctx, buy.Order.Id, api.AmendRequest{Quantity: 8})
+	assert.NoError(t, err)
+	assert.Equal(t, 8, amended.Order.Quantity)
+
+	o, err := c.GetClientOrder(ctx, "", buy.Order.ClientOrderId)
+	assert.NoError(t, err)
+	assert.Equal(t, buy.Order.Id, o.Id)
+
+	sell, err := c.PlaceOrder(ctx, limitOrder(matcher.Sell, 3, 100))
+	assert.NoError(t, err)
+	assert.Len(t, sell.Fills, 1)
+	assert.Equal(t, matcher.Completed, sell.Order.Status)
+
+	again, err := c.PlaceOrder(ctx, api.OrderRequest{
+		ClientOrderId: sell.Order.ClientOrderId,
+		Transaction:   matcher.Sell,
+		OrderType:     matcher.Limit,
+		Quantity:      3,
+		Price:         100,
+	})
+	assert.NoError(t, err)
+	assert.True(t, again.Replayed)
+	assert.Equal(t, sell.Order.Id, again.Order.Id)
+
+	cancelled, err := c.CancelOrder(ctx, buy.Order.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, matcher.Cancelled, cancelled.Status)
+
+	assert.Eventually(t, func() bool {
+		page, err := c.ListOrders(ctx, Query{Status: matcher.Cancelled})
+		return err == nil && len(page.Orders) == 1 && page.Orders[0].Id == buy.Order.Id
+	}, time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		events, err := c.OrderHistory(ctx, buy.Order.Id)
+		return err == nil && len(events) == 4 && events[3].Type == matcher.EventCancelled
+	}, time.Second, 10*time.Millisecond)
+
+	results, err := c.PlaceOrders(ctx, []api.OrderRequest{
+		limitOrder(matcher.Buy, 5, 90),
+		limitOrder(matcher.Buy, 5, 0),
+		limitOrder(matcher.Sell, 5, 120),
+	})
+	assert.NoError(t, err)
+	if assert.Len(t, results, 3) {
+		assert.Equal(t, http.StatusCreated, results[0].Status)
+		assert.NotEmpty(t, results[0].Order.ClientOrderId)
+		assert.Equal(t, http.StatusBadRequest, results[1].Status)
+		assert.Equal(t, http.StatusCreated, results[2].Status)
+	}
+	pulled, err := c.CancelOrders(ctx, matcher.CancelFilter{Transaction: matcher.Buy})
+	assert.NoError(t, err)
+	if assert.Len(t, pulled, 1) {
+		assert.Equal(t, results[0].Order.Id, pulled[0].Id)
+	}
+	pulled, err = c.CancelOrders(ctx, matcher.CancelFilter{})
+	assert.NoError(t, err)
+	assert.Len(t, pulled, 1)
+
+	_, err = c.GetOrder(ctx, matcher.Order{}.Id)
+	assert.True(t, IsNotFound(err))
+
+	_, err = c.PlaceOrder(ctx, limitOrder(matcher.Buy, -1, 100))
+	var e *Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusBadRequest, e.StatusCode)
+	assert.Equal(t, "quantity", e.Fields[0].Field)
+
+	_, err = c.DumpMatcher(ctx)
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusForbidden, e.StatusCode)
+
+	admin := NewClient(srv.URL, Options{Key: "ops", Secret: "ops-secret"})
+	assert.NoError(t, admin.SetLogLevel(ctx, "debug"))
+	level, err := admin.LogLevel(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, "debug", level)
+
+	rest, err := c.PlaceOrder(ctx, limitOrder(matcher.Buy, 5, 90))
+	assert.NoError(t, err)
+	state, err := admin.KillSwitch(ctx, "alice")
+	assert.NoError(t, err)
+	assert.True(t, state.Disabled)
+	if assert.Len(t, state.Cancelled, 1) {
+		assert.Equal(t, rest.Order.Id, state.Cancelled[0].Id)
+	}
+	state, err = c.Account(ctx, "alice")
+	assert.NoError(t, err)
+	assert.True(t, state.Disabled)
+	_, err = c.ReleaseKillSwitch(ctx, "alice")
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusForbidden, e.StatusCode)
+	state, err = admin.ReleaseKillSwitch(ctx, "alice")
+	assert.NoError(t, err)
+	assert.False(t, state.Disabled)
+
+	unsigned := NewClient(srv.URL, Options{})
+	_, err = unsigned.Book(ctx)
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, http.StatusUnauthorized, e.StatusCode)
+}
+
+func Test_Client_Retry(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		retries      int
+		wantAttempts int32
+		wantErr      bool
+	}{
+		{name: "RateLimited", status: http.StatusTooManyRequests, wantAttempts: 3},
+		{name: "QueueFull", status: http.StatusServiceUnavailable, wantAttempts: 3},
+		{name: "NoRetries", status: http.StatusServiceUnavailable, retries: -1, wantAttempts: 1, wantErr: true},
+		{name: "NotRetried", status: http.StatusBadRequest, wantAttempts: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				if atomic.AddInt32(&attempts, 1) < 3 {
+					w.Header().Set("Content-Type", "application/json")
+					w.WriteHeader(tt.status)
+					w.Write([]byte(`{"error":"refused"}`))
+					return
+				}
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"book":{"buy":[{"price":5,"quantity":1,"orders":1}],"sell":[]}}`))
+			}))
+			defer srv.Close()
+
+			c := NewClient(srv.URL, Options{Retries: tt.retries, Backoff: time.Millisecond})
+			book, err := c.Book(context.Background())
+			assert.Equal(t, tt.wantAttempts, atomic.LoadInt32(&attempts))
+			if tt.wantErr {
+				assert.EqualError(t, err, fmt.Sprintf("%d refused", tt.status))
+				return
+			}
+			assert.NoError(t, err)
+			assert.Len(t, book.Buy, 1)
+		})
+	}
+}
+
+func Test_Client_WatchTrades(t *testing.T) {
+	srv := newTestServer(t)
+	c := NewClient(srv.URL, Options{Key: "alice", Secret: "alice-secret"})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	trades := make(chan matcher.Trade, 10)
+	done := make(chan error)
+	go func() {
+		done <- c.WatchTrades(ctx, func(tr matcher.Trade) {
+			select {
+			case trades <- tr:
+			default:
+			}
+		})
+	}()
+
+	// Trades before the stream is connected are not seen, so cross orders
+	// until one is
+	var trade matcher.Trade
+	assert.Eventually(t, func() bool {
+		c.PlaceOrder(ctx, limitOrder(matcher.Buy, 5, 100))
+		c.PlaceOrder(ctx, limitOrder(matcher.Sell, 5, 100))
+		select {
+		case trade = <-trades:
+			return true
+		case <-time.After(20 * time.Millisecond):
+			return false
+		}
+	}, 2*time.Second, time.Millisecond)
+	assert.Equal(t, 100, trade.Price)
+	assert.Equal(t, 5, trade.Quantity)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
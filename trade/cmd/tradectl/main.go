@@ -0,0 +1,374 @@
+// Command tradectl places, changes and looks up orders on the trade service.
+//
+//	tradectl [-endpoint url] [-key key -secret secret] [-o table|json] <command> [flags] [args]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nbasker/tools/trade/api"
+	"github.com/nbasker/tools/trade/client"
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+var (
+	endpoint = flag.String("endpoint", env("TRADE_ENDPOINT", "http://localhost:8000"), "Trade service URL")
+	key      = flag.String("key", os.Getenv("TRADE_API_KEY"), "API key to sign requests with")
+	secret   = flag.String("secret", os.Getenv("TRADE_API_SECRET"), "Secret of the API key")
+	output   = flag.String("o", "table", "Output: table or json")
+	timeout  = flag.Duration("timeout", 10*time.Second, "Time to wait for a command, watch is not limited")
+)
+
+// command is a subcommand with its usage
+type command struct {
+	usage string
+	run   func(ctx context.Context, c client.Client, args []string) (interface{}, error)
+}
+
+var commands = map[string]command{
+	"place":   {"place -side buy|sell -type limit -qty n [-price p] [flags]", place},
+	"batch":   {"batch <file of orders> | batch -", batch},
+	"cancel":  {"cancel <order id> | cancel -client-id id [-account a] | cancel -all [-side s] [-symbol s] [-account a]", cancel},
+	"amend":   {"amend [-qty n] [-price p] <order id> | amend -client-id id [-account a] [-qty n] [-price p]", amend},
+	"get":     {"get <order id> | get -client-id id [-account a]", get},
+	"history": {"history <order id>", history},
+	"list":    {"list [-status s] [-side s] [-symbol s] [-account a] [-limit n] [-cursor c] [-all]", list},
+	"book":    {"book", book},
+	"account": {"account <account>", account},
+	"kill":    {"kill [-release] <account>", kill},
+	"watch":   {"watch", nil},
+}
+
+func env(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintln(out, "Usage: tradectl [flags] <command> [flags] [args]")
+	fmt.Fprintln(out, "\nCommands:")
+	for _, name := range []string{"place", "batch", "cancel", "amend", "get", "history", "list", "book", "account", "kill", "watch"} {
+		fmt.Fprintln(out, "  "+commands[name].usage)
+	}
+	fmt.Fprintln(out, "\nFlags:")
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() == 0 {
+		usage()
+		os.Exit(2)
+	}
+	cmd, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		usage()
+		os.Exit(2)
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(os.Stderr, "-o must be table or json")
+		os.Exit(2)
+	}
+
+	c := client.NewClient(*endpoint, client.Options{Key: *key, Secret: *secret})
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if flag.Arg(0) == "watch" {
+		err := c.WatchTrades(ctx, func(t matcher.Trade) {
+			if err := show(t); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+			}
+		})
+		if err != nil && ctx.Err() == nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, done := context.WithTimeout(ctx, *timeout)
+	defer done()
+	v, err := cmd.run(ctx, c, flag.Args()[1:])
+	if err == flag.ErrHelp {
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := show(v); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// orderRef is the order a command acts on, by id or by client order id
+type orderRef struct {
+	clientOrderId string
+	account       string
+}
+
+func (r *orderRef) flags(fs *flag.FlagSet) {
+	fs.StringVar(&r.clientOrderId, "client-id", "", "Client order id of the order")
+	fs.StringVar(&r.account, "account", "", "Account of the client order id")
+}
+
+// id returns the order id argument, or uuid.Nil if the order is given by
+// its client order id
+func (r *orderRef) id(fs *flag.FlagSet) (uuid.UUID, error) {
+	if r.clientOrderId != "" {
+		if fs.NArg() != 0 {
+			return uuid.Nil, fmt.Errorf("give either an order id or -client-id")
+		}
+		return uuid.Nil, nil
+	}
+	if fs.NArg() != 1 {
+		return uuid.Nil, fmt.Errorf("give an order id or -client-id")
+	}
+	return uuid.Parse(fs.Arg(0))
+}
+
+func place(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("place", flag.ContinueOnError)
+	var r api.OrderRequest
+	side := fs.String("side", "", "buy or sell")
+	typ := fs.String("type", "limit", "market, limit, stop, stop-limit, iceberg or pegged")
+	fs.IntVar(&r.Quantity, "qty", 0, "Quantity")
+	fs.IntVar(&r.Price, "price", 0, "Limit price")
+	fs.IntVar(&r.TriggerPrice, "trigger", 0, "Trigger price of a stop order")
+	fs.IntVar(&r.DisplayQuantity, "display", 0, "Display quantity of an iceberg order")
+	fs.StringVar(&r.ClientOrderId, "client-id", "", "Client order id, generated if not given")
+	fs.StringVar(&r.Account, "account", "", "Account of the order")
+	fs.StringVar(&r.Symbol, "symbol", "", "Symbol of the order")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var ok bool
+	if r.Transaction, ok = parseSide(*side); !ok {
+		return nil, fmt.Errorf("-side must be buy or sell")
+	}
+	if r.OrderType, ok = parseType(*typ); !ok {
+		return nil, fmt.Errorf("-type must be market, limit, stop, stop-limit, iceberg or pegged")
+	}
+	p, err := c.PlaceOrder(ctx, r)
+	if err != nil {
+		return nil, err
+	}
+	if !p.Acknowledged {
+		fmt.Fprintln(os.Stderr, "order accepted, not yet acknowledged by the matcher")
+	}
+	return p.OrderResponse, nil
+}
+
+// batch places the orders of a file, or of the standard input, holding the
+// body of a batch request
+func batch(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("give a file of orders, or - for the standard input")
+	}
+	var b []byte
+	var err error
+	if args[0] == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(args[0])
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r api.BatchRequest
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("%s: %v", args[0], err)
+	}
+	return c.PlaceOrders(ctx, r.Orders)
+}
+
+func cancel(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("cancel", flag.ContinueOnError)
+	var ref orderRef
+	ref.flags(fs)
+	all := fs.Bool("all", false, "Cancel every working order of the account")
+	side := fs.String("side", "", "Side of the orders cancelled with -all")
+	symbol := fs.String("symbol", "", "Symbol of the orders cancelled with -all")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if *all {
+		if fs.NArg() != 0 || ref.clientOrderId != "" {
+			return nil, fmt.Errorf("give either an order, -client-id or -all")
+		}
+		f := matcher.CancelFilter{Account: ref.account, Symbol: *symbol}
+		if *side != "" {
+			var ok bool
+			if f.Transaction, ok = parseSide(*side); !ok {
+				return nil, fmt.Errorf("-side must be buy or sell")
+			}
+		}
+		orders, err := c.CancelOrders(ctx, f)
+		return api.OrdersResponse{Orders: orders}, err
+	}
+	id, err := ref.id(fs)
+	if err != nil {
+		return nil, err
+	}
+	if id == uuid.Nil {
+		return c.CancelClientOrder(ctx, ref.account, ref.clientOrderId)
+	}
+	return c.CancelOrder(ctx, id)
+}
+
+func amend(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("amend", flag.ContinueOnError)
+	var ref orderRef
+	var r api.AmendRequest
+	ref.flags(fs)
+	fs.IntVar(&r.Quantity, "qty", 0, "New quantity, unchanged if not given")
+	fs.IntVar(&r.Price, "price", 0, "New price, unchanged if not given")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	id, err := ref.id(fs)
+	if err != nil {
+		return nil, err
+	}
+	if id == uuid.Nil {
+		return c.AmendClientOrder(ctx, ref.account, ref.clientOrderId, r)
+	}
+	return c.AmendOrder(ctx, id, r)
+}
+
+func get(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("get", flag.ContinueOnError)
+	var ref orderRef
+	ref.flags(fs)
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	id, err := ref.id(fs)
+	if err != nil {
+		return nil, err
+	}
+	if id == uuid.Nil {
+		return c.GetClientOrder(ctx, ref.account, ref.clientOrderId)
+	}
+	return c.GetOrder(ctx, id)
+}
+
+func history(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("give an order id")
+	}
+	id, err := uuid.Parse(args[0])
+	if err != nil {
+		return nil, err
+	}
+	return c.OrderHistory(ctx, id)
+}
+
+func list(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	var q client.Query
+	status := fs.String("status", "", "placed, timedout, completed, rejected or cancelled")
+	side := fs.String("side", "", "buy or sell")
+	fs.StringVar(&q.Symbol, "symbol", "", "Symbol of the orders")
+	fs.StringVar(&q.Account, "account", "", "Account of the orders")
+	fs.IntVar(&q.Limit, "limit", 0, "Orders per page")
+	fs.StringVar(&q.Cursor, "cursor", "", "Cursor of the page, from a previous list")
+	all := fs.Bool("all", false, "Follow the cursor through every page")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	var ok bool
+	if *status != "" {
+		if q.Status, ok = parseStatus(*status); !ok {
+			return nil, fmt.Errorf("-status must be placed, timedout, completed, rejected or cancelled")
+		}
+	}
+	if *side != "" {
+		if q.Side, ok = parseSide(*side); !ok {
+			return nil, fmt.Errorf("-side must be buy or sell")
+		}
+	}
+
+	r, err := c.ListOrders(ctx, q)
+	for err == nil && *all && r.NextCursor != "" {
+		q.Cursor = r.NextCursor
+		var next api.OrdersResponse
+		if next, err = c.ListOrders(ctx, q); err == nil {
+			r.Orders = append(r.Orders, next.Orders...)
+			r.NextCursor = next.NextCursor
+		}
+	}
+	return r, err
+}
+
+func book(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	return c.Book(ctx)
+}
+
+func account(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	if len(args) != 1 {
+		return nil, fmt.Errorf("give an account")
+	}
+	return c.Account(ctx, args[0])
+}
+
+func kill(ctx context.Context, c client.Client, args []string) (interface{}, error) {
+	fs := flag.NewFlagSet("kill", flag.ContinueOnError)
+	release := fs.Bool("release", false, "Take orders of the account again")
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != 1 {
+		return nil, fmt.Errorf("give an account")
+	}
+	if *release {
+		return c.ReleaseKillSwitch(ctx, fs.Arg(0))
+	}
+	return c.KillSwitch(ctx, fs.Arg(0))
+}
+
+func parseSide(s string) (matcher.Transaction, bool) {
+	for t := matcher.Buy; t <= matcher.Sell; t++ {
+		if t.String() == s {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func parseType(s string) (matcher.OrderType, bool) {
+	for t := matcher.Market; t <= matcher.Pegged; t++ {
+		if t.String() == s {
+			return t, true
+		}
+	}
+	return 0, false
+}
+
+func parseStatus(s string) (matcher.Status, bool) {
+	for st := matcher.Placed; st <= matcher.Cancelled; st++ {
+		if st.String() == s {
+			return st, true
+		}
+	}
+	return 0, false
+}
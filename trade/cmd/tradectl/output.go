@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nbasker/tools/trade/api"
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// show writes the result of a command as a table or as JSON
+func show(v interface{}) error {
+	if *output == "json" {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	switch v := v.(type) {
+	case api.OrderResponse:
+		orderTable(w, []matcher.Order{v.Order})
+		if len(v.Fills) > 0 {
+			fmt.Fprintln(w)
+			tradeTable(w, v.Fills)
+		}
+	case matcher.Order:
+		orderTable(w, []matcher.Order{v})
+	case api.OrdersResponse:
+		orderTable(w, v.Orders)
+		if v.NextCursor != "" {
+			fmt.Fprintf(w, "\nnext cursor: %s\n", v.NextCursor)
+		}
+	case []matcher.Event:
+		eventTable(w, v)
+	case []api.BatchResult:
+		batchTable(w, v)
+	case matcher.Book:
+		bookTable(w, v)
+	case api.AccountResponse:
+		fmt.Fprintln(w, "ACCOUNT\tDISABLED\tCANCEL ON DISCONNECT\tSESSIONS")
+		fmt.Fprintf(w, "%s\t%t\t%t\t%d\n", v.Account, v.Disabled, v.CancelOnDisconnect, v.Sessions)
+		if len(v.Cancelled) > 0 {
+			fmt.Fprintln(w, "\ncancelled:")
+			orderTable(w, v.Cancelled)
+		}
+	case matcher.Trade:
+		// Trades are watched one at a time, a line each
+		fmt.Fprintf(w, "%s\t%d @ %d\tbuy %s\tsell %s\n",
+			v.TradeTime.Format(time.RFC3339Nano), v.Quantity, v.Price, v.BuyId, v.SellId)
+	default:
+		return fmt.Errorf("no table for %T", v)
+	}
+	return w.Flush()
+}
+
+// orNone is the value, or a dash if it is not set
+func orNone(n int) string {
+	if n == 0 {
+		return "-"
+	}
+	return strconv.Itoa(n)
+}
+
+func orderTable(w *tabwriter.Writer, orders []matcher.Order) {
+	fmt.Fprintln(w, "ID\tCLIENT ID\tACCOUNT\tSIDE\tTYPE\tQUANTITY\tEXECUTED\tPRICE\tSTATUS\tTIME")
+	for _, o := range orders {
+		cid := o.ClientOrderId
+		if cid == "" {
+			cid = "-"
+		}
+		account := o.Account
+		if account == "" {
+			account = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n",
+			o.Id, cid, account, o.Transaction, o.OrderType, o.Quantity, o.Executed,
+			orNone(o.Price), o.Status, o.OrderTime.Format(time.RFC3339))
+	}
+}
+
+func tradeTable(w *tabwriter.Writer, trades []matcher.Trade) {
+	fmt.Fprintln(w, "BUY ID\tSELL ID\tQUANTITY\tPRICE\tTIME")
+	for _, t := range trades {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\n",
+			t.BuyId, t.SellId, t.Quantity, t.Price, t.TradeTime.Format(time.RFC3339Nano))
+	}
+}
+
+func eventTable(w *tabwriter.Writer, events []matcher.Event) {
+	fmt.Fprintln(w, "TIME\tEVENT\tQUANTITY\tEXECUTED\tPRICE\tCAUSE")
+	for _, e := range events {
+		fmt.Fprintf(w, "%s\t%s\t%d\t%d\t%s\t%s\n",
+			e.Time.Format(time.RFC3339Nano), e.Type, e.Quantity, e.Executed, orNone(e.Price), e.Cause)
+	}
+}
+
+// batchTable lists the result of each order of a batch, with the error of
+// the orders not placed
+func batchTable(w *tabwriter.Writer, results []api.BatchResult) {
+	fmt.Fprintln(w, "#\tRESULT\tID\tSIDE\tQUANTITY\tEXECUTED\tPRICE\tSTATUS\tERROR")
+	for i, r := range results {
+		if r.Order == nil {
+			msg := r.Error
+			for _, f := range r.Fields {
+				msg += ", " + f.Field + " " + f.Message
+			}
+			fmt.Fprintf(w, "%d\t%d\t-\t-\t-\t-\t-\t-\t%s\n", i, r.Status, msg)
+			continue
+		}
+		o := r.Order
+		fmt.Fprintf(w, "%d\t%d\t%s\t%s\t%d\t%d\t%s\t%s\t-\n",
+			i, r.Status, o.Id, o.Transaction, o.Quantity, o.Executed, orNone(o.Price), o.Status)
+	}
+}
+
+// bookTable lists the sell levels from the highest price down to the buy
+// levels, so the spread is in the middle
+func bookTable(w *tabwriter.Writer, b matcher.Book) {
+	fmt.Fprintln(w, "SIDE\tPRICE\tQUANTITY\tORDERS")
+	for i := len(b.Sell) - 1; i >= 0; i-- {
+		l := b.Sell[i]
+		fmt.Fprintf(w, "sell\t%d\t%d\t%d\n", l.Price, l.Quantity, l.Orders)
+	}
+	for _, l := range b.Buy {
+		fmt.Fprintf(w, "buy\t%d\t%d\t%d\n", l.Price, l.Quantity, l.Orders)
+	}
+	fmt.Fprintf(w, "\nlast price: %s\n", orNone(b.LastPrice))
+}
@@ -0,0 +1,398 @@
+// Package config loads the settings of the trade service from a YAML or TOML
+// file, overridden by TRADE_<SECTION>_<SETTING> environment variables such
+// as TRADE_MATCHER_ORDER_TIMEOUT, and validates them.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// Config is the settings of the service. The settings marked reloadable
+// take effect when the service is sent SIGHUP, the others on restart.
+type Config struct {
+	Service  Service  `yaml:"service" toml:"service"`
+	Matcher  Matcher  `yaml:"matcher" toml:"matcher"`
+	Api      Api      `yaml:"api" toml:"api"`
+	Store    Store    `yaml:"store" toml:"store"`
+	Audit    Audit    `yaml:"audit" toml:"audit"`
+	Shutdown Shutdown `yaml:"shutdown" toml:"shutdown"`
+}
+
+// Service is the endpoint and what it serves
+type Service struct {
+	// Endpoint is the address the REST API listens on
+	Endpoint string `yaml:"endpoint" toml:"endpoint"`
+	// Symbol is the symbol traded by the service
+	Symbol string `yaml:"symbol" toml:"symbol"`
+	// ApiKeys is the JSON file of the API keys, required unless insecure
+	ApiKeys string `yaml:"api_keys" toml:"api_keys"`
+	// Insecure runs the service without API keys, so that requests are not
+	// authenticated, for development only
+	Insecure bool `yaml:"insecure" toml:"insecure"`
+	// LogLevel is the level logged at, reloadable
+	LogLevel string `yaml:"log_level" toml:"log_level"`
+}
+
+// Matcher is the order matching settings
+type Matcher struct {
+	// OrderTimeout is the time an order works before it times out, in
+	// whole seconds, reloadable
+	OrderTimeout time.Duration `yaml:"order_timeout" toml:"order_timeout"`
+	// CleanInterval is the time between sweeps for timed out orders when
+	// no orders arrive, reloadable
+	CleanInterval time.Duration `yaml:"clean_interval" toml:"clean_interval"`
+	// QueueDepth is the number of orders queued for the matcher before new
+	// ones are refused
+	QueueDepth int `yaml:"queue_depth" toml:"queue_depth"`
+	// OrderBuffer is the size of the order channel of the matcher
+	OrderBuffer int `yaml:"order_buffer" toml:"order_buffer"`
+	// CompleteBuffer is the size of the channel of the closed orders to
+	// the store
+	CompleteBuffer int `yaml:"complete_buffer" toml:"complete_buffer"`
+}
+
+// Api is the REST API settings
+type Api struct {
+	// AckTimeout is the time an order waits for the matcher before it is
+	// answered 202, reloadable
+	AckTimeout time.Duration `yaml:"ack_timeout" toml:"ack_timeout"`
+	// IdempotencyWindow is the time a client order id is kept to detect
+	// repeated orders
+	IdempotencyWindow time.Duration `yaml:"idempotency_window" toml:"idempotency_window"`
+	// HeartbeatInterval is the time between heartbeats on the trade
+	// streams, which keep them open and find the clients that are gone
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval" toml:"heartbeat_interval"`
+	// RateLimit is the orders per second per client, 0 for no limit,
+	// reloadable
+	RateLimit float64 `yaml:"rate_limit" toml:"rate_limit"`
+	// RateBurst is the orders a client can place at once, reloadable
+	RateBurst int `yaml:"rate_burst" toml:"rate_burst"`
+}
+
+// Store is where the closed orders are kept
+type Store struct {
+	// Backend is memory, or bolt for a database file that keeps the orders
+	// across restarts
+	Backend string `yaml:"backend" toml:"backend"`
+	// Path is the database file of the bolt backend
+	Path string `yaml:"path" toml:"path"`
+	// RetentionDays is the number of whole days before today whose orders
+	// are kept in the store, older ones are moved to the archive. The
+	// orders are kept forever if it is 0.
+	RetentionDays int `yaml:"retention_days" toml:"retention_days"`
+	// ArchiveDir is the directory of the daily archive files
+	ArchiveDir string `yaml:"archive_dir" toml:"archive_dir"`
+	// ArchiveInterval is the time between moves of old orders to the
+	// archive
+	ArchiveInterval time.Duration `yaml:"archive_interval" toml:"archive_interval"`
+}
+
+// Audit is the tamper-evident log of the orders and events the store writes
+type Audit struct {
+	// Log is the hash chained audit log file, none is written if empty
+	Log string `yaml:"log" toml:"log"`
+	// Checkpoints is the file of the signed checkpoints of the log
+	Checkpoints string `yaml:"checkpoints" toml:"checkpoints"`
+	// CheckpointInterval is the time between signed checkpoints
+	CheckpointInterval time.Duration `yaml:"checkpoint_interval" toml:"checkpoint_interval"`
+	// PrivateKey is the PEM file of the ed25519 key the service signs the
+	// checkpoints with
+	PrivateKey string `yaml:"private_key" toml:"private_key"`
+	// PublicKey is the PEM file of the ed25519 key -verify-audit checks the
+	// checkpoints with, so that the private key stays with the service
+	PublicKey string `yaml:"public_key" toml:"public_key"`
+}
+
+// Shutdown is how the service stops
+type Shutdown struct {
+	// Timeout is the time to shut down in before giving up, reloadable
+	Timeout time.Duration `yaml:"timeout" toml:"timeout"`
+	// Resting is what happens to the working orders: persist or cancel
+	Resting string `yaml:"resting" toml:"resting"`
+}
+
+// Default returns the settings used when neither the file nor the
+// environment sets them
+func Default() Config {
+	return Config{
+		Service: Service{
+			Endpoint: "localhost:8000",
+			Symbol:   "SAMPLE",
+			LogLevel: "info",
+		},
+		Matcher: Matcher{
+			OrderTimeout:  10 * time.Second,
+			CleanInterval: 5 * time.Second,
+			QueueDepth:    1000,
+		},
+		Api: Api{
+			AckTimeout:        2 * time.Second,
+			IdempotencyWindow: 24 * time.Hour,
+			HeartbeatInterval: 5 * time.Second,
+			RateLimit:         50,
+			RateBurst:         100,
+		},
+		Store: Store{
+			Backend:         "memory",
+			Path:            "trade.db",
+			ArchiveDir:      "archive",
+			ArchiveInterval: time.Hour,
+		},
+		Audit: Audit{
+			Checkpoints:        "audit.checkpoints",
+			CheckpointInterval: time.Minute,
+		},
+		Shutdown: Shutdown{
+			Timeout: 10 * time.Second,
+			Resting: "persist",
+		},
+	}
+}
+
+// envPrefix starts the environment variables that override the settings
+const envPrefix = "TRADE_"
+
+// Load returns the defaults overridden by the file, if the path is not
+// empty, and then by the environment. The file is YAML or TOML by its
+// extension, and unknown settings in it are errors.
+func Load(path string) (Config, error) {
+	c := Default()
+	if path != "" {
+		if err := c.loadFile(path); err != nil {
+			return Config{}, err
+		}
+	}
+	if err := c.loadEnv(os.LookupEnv); err != nil {
+		return Config{}, err
+	}
+	return c, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		dec := yaml.NewDecoder(bytes.NewReader(b))
+		dec.KnownFields(true)
+		if err := dec.Decode(c); err != nil && err != io.EOF {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	case ".toml":
+		md, err := toml.Decode(string(b), c)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if undecoded := md.Undecoded(); len(undecoded) > 0 {
+			return fmt.Errorf("%s: unknown setting %s", path, undecoded[0])
+		}
+	default:
+		return fmt.Errorf("%s: unknown config format %q, must be .yaml, .yml or .toml", path, ext)
+	}
+	return nil
+}
+
+// loadEnv sets each setting that has an environment variable named after
+// its section and its name
+func (c *Config) loadEnv(lookup func(string) (string, bool)) error {
+	var errs []string
+	c.each(func(section, name string, v reflect.Value) {
+		env := envPrefix + strings.ToUpper(section+"_"+name)
+		s, ok := lookup(env)
+		if !ok {
+			return
+		}
+		if err := set(v, s); err != nil {
+			errs = append(errs, fmt.Sprintf("%s: %v", env, err))
+		}
+	})
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// each calls f with every setting, by its section and name
+func (c *Config) each(f func(section, name string, v reflect.Value)) {
+	cv := reflect.ValueOf(c).Elem()
+	for i := 0; i < cv.NumField(); i++ {
+		section := cv.Type().Field(i).Tag.Get("yaml")
+		sv := cv.Field(i)
+		for j := 0; j < sv.NumField(); j++ {
+			f(section, sv.Type().Field(j).Tag.Get("yaml"), sv.Field(j))
+		}
+	}
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// set parses s into the setting
+func set(v reflect.Value, s string) error {
+	switch {
+	case v.Type() == durationType:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(d))
+	case v.Kind() == reflect.String:
+		v.SetString(s)
+	case v.Kind() == reflect.Int:
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		v.SetInt(int64(n))
+	case v.Kind() == reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case v.Kind() == reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported setting of kind %s", v.Kind())
+	}
+	return nil
+}
+
+// Validate returns an error naming every invalid setting
+func (c *Config) Validate() error {
+	var errs []string
+	invalid := func(setting, msg string) {
+		errs = append(errs, setting+" "+msg)
+	}
+
+	if c.Service.Endpoint == "" {
+		invalid("service.endpoint", "must be set")
+	}
+	if c.Service.Symbol == "" {
+		invalid("service.symbol", "must be set")
+	}
+	if c.Service.ApiKeys == "" && !c.Service.Insecure {
+		invalid("service.api_keys", "must be set unless service.insecure is true")
+	}
+	if _, err := logrus.ParseLevel(c.Service.LogLevel); err != nil {
+		invalid("service.log_level", "must be one of panic, fatal, error, warn, info, debug or trace")
+	}
+	if c.Matcher.OrderTimeout < time.Second || c.Matcher.OrderTimeout%time.Second != 0 {
+		invalid("matcher.order_timeout", "must be whole seconds, at least 1s")
+	}
+	if c.Matcher.CleanInterval <= 0 {
+		invalid("matcher.clean_interval", "must be positive")
+	}
+	if c.Matcher.QueueDepth < 1 {
+		invalid("matcher.queue_depth", "must be at least 1")
+	}
+	if c.Matcher.OrderBuffer < 0 {
+		invalid("matcher.order_buffer", "must not be negative")
+	}
+	if c.Matcher.CompleteBuffer < 0 {
+		invalid("matcher.complete_buffer", "must not be negative")
+	}
+	if c.Api.AckTimeout <= 0 {
+		invalid("api.ack_timeout", "must be positive")
+	}
+	if c.Api.IdempotencyWindow <= 0 {
+		invalid("api.idempotency_window", "must be positive")
+	}
+	if c.Api.HeartbeatInterval <= 0 {
+		invalid("api.heartbeat_interval", "must be positive")
+	}
+	if c.Api.RateLimit < 0 {
+		invalid("api.rate_limit", "must not be negative")
+	}
+	if c.Api.RateLimit > 0 && c.Api.RateBurst < 1 {
+		invalid("api.rate_burst", "must be at least 1 with a rate limit")
+	}
+	if c.Store.Backend != "memory" && c.Store.Backend != "bolt" {
+		invalid("store.backend", "must be memory or bolt")
+	}
+	if c.Store.Backend == "bolt" && c.Store.Path == "" {
+		invalid("store.path", "must be set for the bolt backend")
+	}
+	if c.Store.RetentionDays < 0 {
+		invalid("store.retention_days", "must not be negative")
+	}
+	if c.Store.RetentionDays > 0 && c.Store.ArchiveDir == "" {
+		invalid("store.archive_dir", "must be set with a retention")
+	}
+	if c.Store.RetentionDays > 0 && c.Store.ArchiveInterval <= 0 {
+		invalid("store.archive_interval", "must be positive with a retention")
+	}
+	if c.Audit.Log != "" {
+		if c.Audit.Checkpoints == "" || c.Audit.Checkpoints == c.Audit.Log {
+			invalid("audit.checkpoints", "must be set apart from the audit log")
+		}
+		if c.Audit.CheckpointInterval <= 0 {
+			invalid("audit.checkpoint_interval", "must be positive")
+		}
+		if c.Audit.PrivateKey == "" {
+			invalid("audit.private_key", "must be set with an audit log")
+		}
+	}
+	if c.Shutdown.Timeout <= 0 {
+		invalid("shutdown.timeout", "must be positive")
+	}
+	if c.Shutdown.Resting != "persist" && c.Shutdown.Resting != "cancel" {
+		invalid("shutdown.resting", "must be persist or cancel")
+	}
+
+	if len(errs) > 0 {
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// reloadable are the settings applied to the running service on reload
+var reloadable = map[string]bool{
+	"service.log_level":      true,
+	"matcher.order_timeout":  true,
+	"matcher.clean_interval": true,
+	"api.ack_timeout":        true,
+	"api.rate_limit":         true,
+	"api.rate_burst":         true,
+	"shutdown.timeout":       true,
+}
+
+// Reload returns the config with the reloadable settings of next, and the
+// settings that differ in next but keep their value until a restart
+func (c Config) Reload(next Config) (Config, []string) {
+	values := make(map[string]reflect.Value)
+	next.each(func(section, name string, v reflect.Value) {
+		values[section+"."+name] = v
+	})
+	var restart []string
+	c.each(func(section, name string, v reflect.Value) {
+		setting := section + "." + name
+		n := values[setting]
+		switch {
+		case reloadable[setting]:
+			v.Set(n)
+		case v.Interface() != n.Interface():
+			restart = append(restart, setting)
+		}
+	})
+	return c, restart
+}
@@ -0,0 +1,163 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Load(t *testing.T) {
+	changed := Default()
+	changed.Service.Symbol = "ACME"
+	changed.Matcher.CleanInterval = time.Second
+	changed.Api.RateLimit = 2.5
+	insecure := Default()
+	insecure.Service.Insecure = true
+
+	tests := []struct {
+		name    string
+		file    string
+		content string
+		env     map[string]string
+		want    Config
+		wantErr string
+	}{
+		{
+			name: "Defaults",
+			want: Default(),
+		},
+		{
+			name:    "Yaml",
+			file:    "trade.yaml",
+			content: "service:\n  symbol: ACME\nmatcher:\n  clean_interval: 1s\napi:\n  rate_limit: 2.5\n",
+			want:    changed,
+		},
+		{
+			name:    "Toml",
+			file:    "trade.toml",
+			content: "[service]\nsymbol = \"ACME\"\n[matcher]\nclean_interval = \"1s\"\n[api]\nrate_limit = 2.5\n",
+			want:    changed,
+		},
+		{
+			name:    "EnvOverridesFile",
+			file:    "trade.yaml",
+			content: "service:\n  symbol: OTHER\n",
+			env: map[string]string{
+				"TRADE_SERVICE_SYMBOL":         "ACME",
+				"TRADE_MATCHER_CLEAN_INTERVAL": "1s",
+				"TRADE_API_RATE_LIMIT":         "2.5",
+			},
+			want: changed,
+		},
+		{
+			name: "EnvBool",
+			env:  map[string]string{"TRADE_SERVICE_INSECURE": "true"},
+			want: insecure,
+		},
+		{
+			name:    "UnknownYamlSetting",
+			file:    "trade.yaml",
+			content: "matcher:\n  clean_every: 1s\n",
+			wantErr: "field clean_every not found",
+		},
+		{
+			name:    "UnknownTomlSetting",
+			file:    "trade.toml",
+			content: "[matcher]\nclean_every = \"1s\"\n",
+			wantErr: "unknown setting matcher.clean_every",
+		},
+		{
+			name:    "UnknownFormat",
+			file:    "trade.json",
+			content: "{}",
+			wantErr: "unknown config format",
+		},
+		{
+			name:    "InvalidEnv",
+			env:     map[string]string{"TRADE_MATCHER_QUEUE_DEPTH": "many"},
+			wantErr: "TRADE_MATCHER_QUEUE_DEPTH",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				os.Setenv(k, v)
+				defer os.Unsetenv(k)
+			}
+			path := ""
+			if tt.file != "" {
+				path = filepath.Join(t.TempDir(), tt.file)
+				assert.NoError(t, ioutil.WriteFile(path, []byte(tt.content), 0600))
+			}
+
+			c, err := Load(path)
+			if tt.wantErr != "" {
+				assert.Error(t, err)
+				assert.Contains(t, err.Error(), tt.wantErr)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, c)
+		})
+	}
+}
+
+func Test_Load_Sample(t *testing.T) {
+	c, err := Load("trade.yaml")
+	assert.NoError(t, err)
+	assert.Equal(t, Default(), c)
+
+	// The sample names no keys file, which only runs insecure
+	assert.Error(t, c.Validate())
+	c.Service.Insecure = true
+	assert.NoError(t, c.Validate())
+}
+
+func Test_Validate(t *testing.T) {
+	c := Default()
+	c.Service.LogLevel = "loud"
+	c.Matcher.OrderTimeout = 1500 * time.Millisecond
+	c.Matcher.QueueDepth = 0
+	c.Api.RateBurst = 0
+	c.Store.Backend = "sqlite"
+	c.Store.RetentionDays = 7
+	c.Store.ArchiveDir = ""
+	c.Audit.Log = "audit.checkpoints"
+	c.Shutdown.Resting = "drop"
+
+	assert.EqualError(t, c.Validate(), "invalid config: "+
+		"service.api_keys must be set unless service.insecure is true; "+
+		"service.log_level must be one of panic, fatal, error, warn, info, debug or trace; "+
+		"matcher.order_timeout must be whole seconds, at least 1s; "+
+		"matcher.queue_depth must be at least 1; "+
+		"api.rate_burst must be at least 1 with a rate limit; "+
+		"store.backend must be memory or bolt; "+
+		"store.archive_dir must be set with a retention; "+
+		"audit.checkpoints must be set apart from the audit log; "+
+		"audit.private_key must be set with an audit log; "+
+		"shutdown.resting must be persist or cancel")
+}
+
+func Test_Reload(t *testing.T) {
+	running := Default()
+	next := Default()
+	next.Service.LogLevel = "debug"
+	next.Service.Endpoint = "localhost:9000"
+	next.Matcher.OrderTimeout = 30 * time.Second
+	next.Matcher.QueueDepth = 10
+	next.Api.RateLimit = 5
+
+	c, restart := running.Reload(next)
+	assert.Equal(t, []string{"service.endpoint", "matcher.queue_depth"}, restart)
+
+	want := Default()
+	want.Service.LogLevel = "debug"
+	want.Matcher.OrderTimeout = 30 * time.Second
+	want.Api.RateLimit = 5
+	assert.Equal(t, want, c)
+	assert.Equal(t, Default(), running, "the running config is not changed")
+}
@@ -2,16 +2,89 @@ package main
 
 import (
 	"flag"
+	"os"
+	"time"
 
+	"github.com/nbasker/tools/trade/config"
 	"github.com/nbasker/tools/trade/service"
 )
 
+var defaults = config.Default()
+
 var (
-	serviceEndpoint = flag.String("service-endpoint", "localhost:8000", "Trade service endpoint")
-	orderTimeout    = flag.Int("order-timeout", 10, "Order Execution Timeout")
+	configFile      = flag.String("config", "", "YAML or TOML config file, the flags given override it")
+	serviceEndpoint = flag.String("service-endpoint", defaults.Service.Endpoint, "Trade service endpoint")
+	orderTimeout    = flag.Int("order-timeout", int(defaults.Matcher.OrderTimeout/time.Second), "Order Execution Timeout")
+	symbol          = flag.String("symbol", defaults.Service.Symbol, "Symbol traded by the service")
+	ackTimeout      = flag.Duration("ack-timeout", defaults.Api.AckTimeout, "Order Acknowledgement Timeout")
+	idempotency     = flag.Duration("idempotency-window", defaults.Api.IdempotencyWindow, "Time a client order id is kept to detect repeated orders")
+	queueDepth      = flag.Int("queue-depth", defaults.Matcher.QueueDepth, "Orders queued for the matcher before new ones are refused")
+	rateLimit       = flag.Float64("rate-limit", defaults.Api.RateLimit, "Orders per second per client, 0 for no limit")
+	rateBurst       = flag.Int("rate-burst", defaults.Api.RateBurst, "Orders a client can place at once")
+	shutdownTimeout = flag.Duration("shutdown-timeout", defaults.Shutdown.Timeout, "Time to shut down in before giving up")
+	shutdownResting = flag.String("shutdown-resting", defaults.Shutdown.Resting, "Working orders on shutdown: persist or cancel")
+	apiKeys         = flag.String("api-keys", defaults.Service.ApiKeys, "JSON file of the API keys, required unless running insecure")
+	insecure        = flag.Bool("insecure", defaults.Service.Insecure, "Run without API keys, requests are not authenticated, for development only")
+	storeBackend    = flag.String("store", defaults.Store.Backend, "Store of the closed orders: memory or bolt")
+	storePath       = flag.String("store-path", defaults.Store.Path, "Database file of the bolt store")
+	auditLog        = flag.String("audit-log", defaults.Audit.Log, "Hash chained audit log of the store, none if empty")
+	verifyAudit     = flag.Bool("verify-audit", false, "Verify the audit log and its signed checkpoints, then exit")
 )
 
+// load returns the config of the file and the environment, with the flags
+// given on the command line over it
+func load() (config.Config, error) {
+	c, err := config.Load(*configFile)
+	if err != nil {
+		return config.Config{}, err
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "service-endpoint":
+			c.Service.Endpoint = *serviceEndpoint
+		case "order-timeout":
+			c.Matcher.OrderTimeout = time.Duration(*orderTimeout) * time.Second
+		case "symbol":
+			c.Service.Symbol = *symbol
+		case "ack-timeout":
+			c.Api.AckTimeout = *ackTimeout
+		case "idempotency-window":
+			c.Api.IdempotencyWindow = *idempotency
+		case "queue-depth":
+			c.Matcher.QueueDepth = *queueDepth
+		case "rate-limit":
+			c.Api.RateLimit = *rateLimit
+		case "rate-burst":
+			c.Api.RateBurst = *rateBurst
+		case "shutdown-timeout":
+			c.Shutdown.Timeout = *shutdownTimeout
+		case "shutdown-resting":
+			c.Shutdown.Resting = *shutdownResting
+		case "api-keys":
+			c.Service.ApiKeys = *apiKeys
+		case "insecure":
+			c.Service.Insecure = *insecure
+		case "store":
+			c.Store.Backend = *storeBackend
+		case "store-path":
+			c.Store.Path = *storePath
+		case "audit-log":
+			c.Audit.Log = *auditLog
+		}
+	})
+	return c, nil
+}
+
 func main() {
 	flag.Parse()
-	service.Start(*serviceEndpoint, *orderTimeout)
+
+	if *verifyAudit {
+		if err := service.VerifyAudit(load); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+	if err := service.Start(load); err != nil {
+		os.Exit(1)
+	}
 }
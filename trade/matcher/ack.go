@@ -0,0 +1,113 @@
+package matcher
+
+import (
+	"errors"
+	"time"
+)
+
+var (
+	// ErrQueueFull is returned when the queue of orders waiting for the
+	// matcher is full. The order is not entered.
+	ErrQueueFull = errors.New("matcher queue is full")
+
+	// ErrAckTimeout is returned when the matcher took the order but did not
+	// acknowledge it within the timeout. The order is entered and its state
+	// can be looked up later.
+	ErrAckTimeout = errors.New("matcher did not acknowledge the order in time")
+)
+
+// Ack is the state of an order once matched on arrival, with the trades it
+// made
+type Ack struct {
+	Order Order   `json:"order"`
+	Fills []Trade `json:"fills,omitempty"`
+}
+
+// PlaceOrder queues the order for the matcher goroutine and returns its state
+// once it has matched, rested or been rejected. It does not wait for room in
+// the queue, and waits at most the timeout for the acknowledgement.
+func (m *matcherService) PlaceOrder(o *Order, timeout time.Duration) (Ack, error) {
+	reply := make(chan Ack, 1)
+	f := func() {
+		m.acking = o
+		m.processOrder(o)
+		reply <- Ack{Order: *o, Fills: m.ackFills}
+		m.acking = nil
+		m.ackFills = nil
+	}
+
+	if !m.enqueue(f) {
+		return Ack{}, ErrQueueFull
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case a := <-reply:
+		return a, nil
+	case <-timer.C:
+		return Ack{}, ErrAckTimeout
+	}
+}
+
+// PlaceOrders queues the orders for the matcher goroutine together and
+// returns their states in the same order once each has matched, rested or
+// been rejected. The orders are entered one after another with no other
+// order in between. None are entered if the queue is full, and all are
+// entered if the acknowledgement times out.
+func (m *matcherService) PlaceOrders(orders []*Order, timeout time.Duration) ([]Ack, error) {
+	reply := make(chan []Ack, 1)
+	f := func() {
+		acks := make([]Ack, 0, len(orders))
+		for _, o := range orders {
+			m.acking = o
+			m.processOrder(o)
+			acks = append(acks, Ack{Order: *o, Fills: m.ackFills})
+			m.acking = nil
+			m.ackFills = nil
+		}
+		reply <- acks
+	}
+
+	if !m.enqueue(f) {
+		return nil, ErrQueueFull
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case acks := <-reply:
+		return acks, nil
+	case <-timer.C:
+		return nil, ErrAckTimeout
+	}
+}
+
+// enqueue adds f to the ingress queue of the matcher goroutine, reporting
+// false if the queue is full
+func (m *matcherService) enqueue(f func()) bool {
+	queued := time.Now()
+	wait := func() {
+		m.metrics.lag.Observe(time.Since(queued).Seconds())
+		f()
+	}
+	select {
+	case m.ingress <- wait:
+		return true
+	default:
+		return false
+	}
+}
+
+// Queue returns the length and capacity of the ingress queue
+func (m *matcherService) Queue() (int, int) {
+	return len(m.ingress), cap(m.ingress)
+}
+
+// recordFill adds the trade to the acknowledgement of the order being placed
+// if it is a party to it
+func (m *matcherService) recordFill(t Trade) {
+	if m.acking != nil && (t.BuyId == m.acking.Id || t.SellId == m.acking.Id) {
+		m.ackFills = append(m.ackFills, t)
+	}
+}
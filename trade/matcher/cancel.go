@@ -0,0 +1,223 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// ErrOrderNotFound is returned when the matcher holds no working order with
+// the id, either because there never was one or because it has closed.
+var ErrOrderNotFound = errors.New("no working order with the id")
+
+// CancelOrder cancels a working order on the matcher goroutine and returns
+// its final state. Cancelling the parent of a bracket group cancels its
+// waiting children, the other orders of a group are left working.
+func (m *matcherService) CancelOrder(id uuid.UUID) (Order, error) {
+	var o Order
+	var err error
+	m.do(func() {
+		lo, ok := m.live[id]
+		if !ok || lo.closed() {
+			err = ErrOrderNotFound
+			return
+		}
+		m.cancel(lo, "cancel request")
+		m.settle()
+		o = *lo
+	})
+	return o, err
+}
+
+// CancelFilter selects the working orders of a mass cancel. Zero values
+// match every order. Reason is the cause recorded in the history of the
+// orders cancelled, a mass cancel if empty.
+type CancelFilter struct {
+	Account     string
+	Symbol      string
+	Transaction Transaction
+	Reason      string
+}
+
+func (f CancelFilter) match(o *Order) bool {
+	return (f.Account == "" || o.Account == f.Account) &&
+		(f.Symbol == "" || o.Symbol == f.Symbol) &&
+		(f.Transaction == 0 || o.Transaction == f.Transaction)
+}
+
+// CancelOrders cancels every working order that passes the filter in one
+// step on the matcher goroutine, so that no order is matched against the
+// ones left to cancel, and returns the orders cancelled by order time. The
+// waiting children of the bracket parents cancelled are cancelled and
+// returned too.
+func (m *matcherService) CancelOrders(f CancelFilter) []Order {
+	var orders []Order
+	m.do(func() {
+		orders = m.cancelOrders(f)
+	})
+
+	m.log.WithFields(logrus.Fields{
+		"Account":     f.Account,
+		"Symbol":      f.Symbol,
+		"Transaction": f.Transaction,
+		"Orders":      len(orders),
+	}).Debug("Cancelled orders")
+	return orders
+}
+
+// cancelOrders cancels the working orders that match the filter, with the
+// orders cascaded from them, and returns the orders cancelled by time.
+// It runs on the matcher goroutine.
+func (m *matcherService) cancelOrders(f CancelFilter) []Order {
+	var open []*Order
+	for _, o := range m.live {
+		if o.closed() {
+			continue
+		}
+		open = append(open, o)
+		if f.match(o) {
+			reason := f.Reason
+			if reason == "" {
+				reason = "mass cancel"
+			}
+			m.cancel(o, reason)
+		}
+	}
+	m.settle()
+
+	var orders []Order
+	for _, o := range open {
+		if o.Status == Cancelled {
+			orders = append(orders, *o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool {
+		if !orders[i].OrderTime.Equal(orders[j].OrderTime) {
+			return orders[i].OrderTime.Before(orders[j].OrderTime)
+		}
+		return orders[i].Id.String() < orders[j].Id.String()
+	})
+	return orders
+}
+
+// DisableAccount cancels the working orders of the account and rejects its
+// new orders until it is enabled again. Both happen in one step on the
+// matcher goroutine, so that no order of the account is matched once it is
+// disabled. It returns the orders cancelled.
+func (m *matcherService) DisableAccount(account string) []Order {
+	var orders []Order
+	m.do(func() {
+		m.disabled[account] = true
+		orders = m.cancelOrders(CancelFilter{Account: account, Reason: "account kill switch"})
+	})
+	m.log.WithFields(logrus.Fields{
+		"Account": account,
+		"Orders":  len(orders),
+	}).Warn("Account disabled")
+	return orders
+}
+
+// EnableAccount accepts the new orders of a disabled account again
+func (m *matcherService) EnableAccount(account string) {
+	m.do(func() {
+		delete(m.disabled, account)
+	})
+	m.log.WithFields(logrus.Fields{
+		"Account": account,
+	}).Warn("Account enabled")
+}
+
+// AccountDisabled reports if the account is disabled
+func (m *matcherService) AccountDisabled(account string) bool {
+	var disabled bool
+	m.do(func() {
+		disabled = m.disabled[account]
+	})
+	return disabled
+}
+
+// AmendOrder changes the total quantity and the price of a working limit or
+// iceberg order and returns its state after matching at the new price. A zero
+// quantity or price is left unchanged. The order keeps its place in the queue
+// if only its quantity is reduced, otherwise it goes to the back of the new
+// price level.
+func (m *matcherService) AmendOrder(id uuid.UUID, quantity, price int) (Ack, error) {
+	var a Ack
+	var err error
+	m.do(func() {
+		o, ok := m.live[id]
+		if !ok || o.closed() {
+			err = ErrOrderNotFound
+			return
+		}
+		if err = m.amend(o, quantity, price); err != nil {
+			return
+		}
+		a = Ack{Order: *o, Fills: m.ackFills}
+		m.acking = nil
+		m.ackFills = nil
+	})
+	return a, err
+}
+
+func (m *matcherService) amend(o *Order, quantity, price int) error {
+	if o.OrderType != Limit && o.OrderType != Iceberg {
+		return fmt.Errorf("%s orders cannot be amended", o.OrderType)
+	}
+	if o.GroupId != uuid.Nil {
+		return errors.New("orders of a group cannot be amended")
+	}
+	if quantity == 0 {
+		quantity = o.PlacedQuantity
+	}
+	if price == 0 {
+		price = o.Price
+	}
+	if quantity <= o.Executed {
+		return fmt.Errorf("quantity %d is not above the executed quantity %d",
+			quantity, o.Executed)
+	}
+	if price <= 0 {
+		return errors.New("price must be positive")
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"OrderId":     o.Id.String()[:10],
+		"OldQuantity": o.PlacedQuantity,
+		"Quantity":    quantity,
+		"OldPrice":    o.Price,
+		"Price":       price,
+	}).Debug("Amended order")
+
+	cause := fmt.Sprintf("quantity %d to %d, price %d to %d",
+		o.PlacedQuantity, quantity, o.Price, price)
+	remaining := quantity - o.Executed
+	if price == o.Price && remaining <= o.Quantity {
+		o.PlacedQuantity = quantity
+		o.Quantity = remaining
+		if o.shown > remaining {
+			o.shown = remaining
+		}
+		if o.MinQuantity > remaining {
+			o.MinQuantity = remaining
+		}
+		m.record(o, EventAmended, cause)
+		return nil
+	}
+
+	m.unrest(o)
+	o.PlacedQuantity = quantity
+	o.Quantity = remaining
+	o.Price = price
+	if o.MinQuantity > remaining {
+		o.MinQuantity = remaining
+	}
+	m.record(o, EventAmended, cause)
+	m.acking = o
+	m.matchOrder(o, false)
+	m.settle()
+	return nil
+}
@@ -0,0 +1,91 @@
+package matcher
+
+import (
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Level is a price level of the book with its orders in queue order
+type Level struct {
+	Price  int     `json:"price"`
+	Orders []Order `json:"orders"`
+}
+
+// GroupState is the state of an order group held by the matcher
+type GroupState struct {
+	Id     uuid.UUID   `json:"id"`
+	Type   GroupType   `json:"type"`
+	Active bool        `json:"active"`
+	Done   bool        `json:"done"`
+	Orders []uuid.UUID `json:"orders"`
+}
+
+// Channels is the depth of the channels of the matcher
+type Channels struct {
+	Orders          int `json:"orders"`
+	Ingress         int `json:"ingress"`
+	IngressCapacity int `json:"ingress_capacity"`
+	Complete        int `json:"complete"`
+}
+
+// Dump is a copy of the in-memory structures of the matcher, taken at once
+// on the matcher goroutine
+type Dump struct {
+	Buy       []Level      `json:"buy"`
+	Sell      []Level      `json:"sell"`
+	Stops     []Order      `json:"stops"`
+	Pegs      []Order      `json:"pegs"`
+	Groups    []GroupState `json:"groups"`
+	LastPrice int          `json:"last_price"`
+	Live      int          `json:"live"`
+	Channels  Channels     `json:"channels"`
+}
+
+// Dump copies the buy and sell maps, the held stops and pegs and the groups
+func (m *matcherService) Dump() Dump {
+	var d Dump
+	m.do(func() {
+		d = Dump{
+			Buy:       levels(m.buy),
+			Sell:      levels(m.sell),
+			Stops:     copyOrders(m.stops),
+			Pegs:      copyOrders(m.pegs),
+			Groups:    []GroupState{},
+			LastPrice: m.lastPrice,
+			Live:      len(m.live),
+		}
+		for _, g := range m.groups {
+			gs := GroupState{Id: g.Id, Type: g.Type, Active: g.active, Done: g.done}
+			for _, o := range g.Orders {
+				gs.Orders = append(gs.Orders, o.Id)
+			}
+			d.Groups = append(d.Groups, gs)
+		}
+	})
+	sort.Slice(d.Buy, func(i, j int) bool { return d.Buy[i].Price > d.Buy[j].Price })
+	sort.Slice(d.Sell, func(i, j int) bool { return d.Sell[i].Price < d.Sell[j].Price })
+	d.Channels = Channels{
+		Orders:          len(m.och),
+		Ingress:         len(m.ingress),
+		IngressCapacity: cap(m.ingress),
+		Complete:        len(m.complete),
+	}
+	return d
+}
+
+func levels(oMap OrderMap) []Level {
+	ls := []Level{}
+	for p, ol := range oMap {
+		ls = append(ls, Level{Price: p, Orders: copyOrders(ol)})
+	}
+	return ls
+}
+
+func copyOrders(ol []*Order) []Order {
+	orders := []Order{}
+	for _, o := range ol {
+		orders = append(orders, *o)
+	}
+	return orders
+}
@@ -0,0 +1,87 @@
+package matcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// EventType is a transition in the life of an order
+type EventType int
+
+const (
+	EventPlaced EventType = iota + 1
+	EventTriggered
+	EventPartiallyFilled
+	EventFilled
+	EventAmended
+	EventRepriced
+	EventCancelled
+	EventExpired
+	EventRejected
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventPlaced:
+		return "placed"
+	case EventTriggered:
+		return "triggered"
+	case EventPartiallyFilled:
+		return "partially_filled"
+	case EventFilled:
+		return "filled"
+	case EventAmended:
+		return "amended"
+	case EventRepriced:
+		return "repriced"
+	case EventCancelled:
+		return "cancelled"
+	case EventExpired:
+		return "expired"
+	case EventRejected:
+		return "rejected"
+	}
+	return "unknown"
+}
+
+// Event is a transition of an order with its cause, and the quantity left,
+// the quantity executed and the price of the order after it
+type Event struct {
+	OrderId  uuid.UUID `json:"order_id"`
+	Type     EventType `json:"type"`
+	Time     time.Time `json:"time"`
+	Cause    string    `json:"cause"`
+	Quantity int       `json:"quantity"`
+	Executed int       `json:"executed"`
+	Price    int       `json:"price"`
+}
+
+// record sends an event of the order on the events channel, if the matcher
+// has one. Like the closed orders, the events are sent on the matcher
+// goroutine in the order they happen.
+func (m *matcherService) record(o *Order, t EventType, cause string) {
+	if m.events == nil {
+		return
+	}
+	m.events <- Event{
+		OrderId:  o.Id,
+		Type:     t,
+		Time:     time.Now().UTC(),
+		Cause:    cause,
+		Quantity: o.Quantity,
+		Executed: o.Executed,
+		Price:    o.Price,
+	}
+}
+
+// recordExecution records the fill of the order. The other order is not
+// named, as the history of an order is seen by the trader of its account.
+func (m *matcherService) recordExecution(o *Order, executed, price int) {
+	t := EventPartiallyFilled
+	if o.Quantity == 0 {
+		t = EventFilled
+	}
+	m.record(o, t, fmt.Sprintf("traded %d at %d", executed, price))
+}
@@ -0,0 +1,253 @@
+package matcher
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+// GroupType enum
+type GroupType int
+
+const (
+	// OCO orders work together until a fill or trigger of one cancels the others
+	OCO GroupType = iota + 1
+	// Bracket has a parent order followed by its child orders, which only
+	// work once the parent is filled and are then one-cancels-other
+	Bracket
+)
+
+func (t GroupType) String() string {
+	switch t {
+	case OCO:
+		return "oco"
+	case Bracket:
+		return "bracket"
+	}
+	return "unknown"
+}
+
+// Group defines orders placed together, the first order of a bracket group
+// is the parent.
+type Group struct {
+	Id     uuid.UUID `json:"id,omitempty"`
+	Type   GroupType `json:"type,omitempty"`
+	Orders []*Order  `json:"orders,omitempty"`
+
+	// active is set once the parent of a bracket group is filled
+	active bool
+	// done is set once a fill or trigger cancelled the other orders
+	done bool
+}
+
+// legs returns the orders of the group that cancel each other
+func (g *Group) legs() []*Order {
+	if g.Type == Bracket {
+		return g.Orders[1:]
+	}
+	return g.Orders
+}
+
+func (g *Group) validate() error {
+	switch g.Type {
+	case OCO:
+		if len(g.Orders) < 2 {
+			return errors.New("oco group needs at least two orders")
+		}
+	case Bracket:
+		if len(g.Orders) < 2 {
+			return errors.New("bracket group needs a parent and at least one child order")
+		}
+		for _, c := range g.Orders[1:] {
+			if c.Transaction == g.Orders[0].Transaction {
+				return errors.New("bracket child orders must be on the opposite side of the parent")
+			}
+		}
+	default:
+		return errors.New("group type must be oco or bracket")
+	}
+	return nil
+}
+
+// PlaceGroup links the orders to the group and enters them on the matcher
+// goroutine, so that no other order sees the group half placed. A bracket
+// group only enters its parent, the children wait for the parent to fill.
+// The group is rejected as a whole if it is not well formed, and not placed
+// if the ingress queue is full.
+func (m *matcherService) PlaceGroup(g *Group) ([]Order, error) {
+	if err := g.validate(); err != nil {
+		return nil, err
+	}
+	for _, o := range g.Orders {
+		o.GroupId = g.Id
+	}
+	if g.Type == Bracket {
+		for _, c := range g.Orders[1:] {
+			c.ParentId = g.Orders[0].Id
+		}
+	}
+
+	var placed []Order
+	done := make(chan struct{})
+	f := func() {
+		m.processGroup(g)
+		for _, o := range g.Orders {
+			placed = append(placed, *o)
+		}
+		close(done)
+	}
+	if !m.enqueue(f) {
+		return nil, ErrQueueFull
+	}
+	<-done
+	return placed, nil
+}
+
+func (m *matcherService) processGroup(g *Group) {
+	m.log.WithFields(logrus.Fields{
+		"GroupId": g.Id.String()[:10],
+		"Type":    g.Type,
+		"Orders":  len(g.Orders),
+	}).Debug("Matcher received group")
+
+	disabled := ""
+	for _, o := range g.Orders {
+		m.live[o.Id] = o
+		m.metrics.received.WithLabelValues(o.Transaction.String(), o.OrderType.String()).Inc()
+		m.record(o, EventPlaced, fmt.Sprintf("new order of %s group %s", g.Type, g.Id))
+		if m.disabled[o.Account] {
+			disabled = o.Account
+		}
+	}
+	if disabled != "" {
+		// The group is rejected as a whole
+		for _, o := range g.Orders {
+			m.reject(o, "account "+disabled+" is disabled")
+		}
+		return
+	}
+	m.groups[g.Id] = g
+	enter := g.Orders
+	if g.Type == Bracket {
+		enter = g.Orders[:1]
+	}
+	for _, o := range enter {
+		// An earlier order of the group may have filled and cancelled it
+		if !o.closed() {
+			m.enter(o)
+		}
+	}
+	m.settle()
+}
+
+// groupActivity is called when an order fills or triggers. The first such
+// order of a one-cancels-other group cancels the rest, and a filled bracket
+// parent activates its children.
+func (m *matcherService) groupActivity(o *Order) {
+	g, ok := m.groups[o.GroupId]
+	if !ok || g.done {
+		return
+	}
+	if g.Type == Bracket && !g.active {
+		if o.Quantity == 0 {
+			g.active = true
+			m.activated = append(m.activated, g)
+		}
+		return
+	}
+
+	g.done = true
+	for _, l := range g.legs() {
+		if l != o && !l.closed() {
+			m.cancel(l, fmt.Sprintf("order %s of the group filled or triggered", o.Id))
+		}
+	}
+}
+
+// cancel marks the order cancelled for the cause. It is skipped by the
+// matching until updateGroups removes it from the book.
+func (m *matcherService) cancel(o *Order, cause string) {
+	m.log.WithFields(logrus.Fields{
+		"OrderId": o.Id.String()[:10],
+		"GroupId": o.GroupId.String()[:10],
+		"Cause":   cause,
+	}).Debug("Cancelled order")
+
+	o.Status = Cancelled
+	m.record(o, EventCancelled, cause)
+	m.cancelled = append(m.cancelled, o)
+}
+
+// updateGroups enters the children of filled bracket parents, cancels the
+// children of bracket parents that closed unfilled and removes cancelled
+// orders from the book. It reports if anything changed.
+func (m *matcherService) updateGroups() bool {
+	changed := false
+
+	activated := m.activated
+	m.activated = nil
+	for _, g := range activated {
+		changed = true
+		for _, c := range g.Orders[1:] {
+			if !c.closed() {
+				m.enter(c)
+			}
+		}
+	}
+
+	for id, g := range m.groups {
+		if g.Type == Bracket && !g.active && g.Orders[0].closed() {
+			g.done = true
+			for _, c := range g.Orders[1:] {
+				if !c.closed() {
+					m.cancel(c, fmt.Sprintf("bracket parent %s closed unfilled", g.Orders[0].Id))
+				}
+			}
+		}
+		open := false
+		for _, o := range g.Orders {
+			if !o.closed() {
+				open = true
+			}
+		}
+		if !open {
+			delete(m.groups, id)
+		}
+	}
+
+	if len(m.cancelled) > 0 {
+		changed = true
+		for _, o := range m.cancelled {
+			m.unrest(o)
+			m.send(o)
+		}
+		m.cancelled = nil
+
+		stops := m.stops[:0]
+		for _, o := range m.stops {
+			if !o.closed() {
+				stops = append(stops, o)
+			}
+		}
+		m.stops = stops
+	}
+	return changed
+}
+
+// waitingChildren returns the bracket children waiting for their parent
+func (m *matcherService) waitingChildren() []*Order {
+	var waiting []*Order
+	for _, g := range m.groups {
+		if g.Type != Bracket || g.active {
+			continue
+		}
+		for _, c := range g.Orders[1:] {
+			if !c.closed() {
+				waiting = append(waiting, c)
+			}
+		}
+	}
+	return waiting
+}
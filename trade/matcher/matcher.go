@@ -1,9 +1,13 @@
 package matcher
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/sirupsen/logrus"
 )
 
@@ -31,6 +35,10 @@ type OrderType int
 const (
 	Market OrderType = iota + 1
 	Limit
+	Stop
+	StopLimit
+	Iceberg
+	Pegged
 )
 
 func (t OrderType) String() string {
@@ -39,6 +47,14 @@ func (t OrderType) String() string {
 		return "market"
 	case Limit:
 		return "limit"
+	case Stop:
+		return "stop"
+	case StopLimit:
+		return "stop-limit"
+	case Iceberg:
+		return "iceberg"
+	case Pegged:
+		return "pegged"
 	}
 	return "unknown"
 }
@@ -50,6 +66,8 @@ const (
 	Placed Status = iota + 1
 	TimedOut
 	Completed
+	Rejected
+	Cancelled
 )
 
 func (s Status) String() string {
@@ -60,72 +78,448 @@ func (s Status) String() string {
 		return "timedout"
 	case Completed:
 		return "completed"
+	case Rejected:
+		return "rejected"
+	case Cancelled:
+		return "cancelled"
+	}
+	return "unknown"
+}
+
+// PostOnly enum, what to do with a post-only order that would take liquidity
+type PostOnly int
+
+const (
+	PostOnlyReject PostOnly = iota + 1
+	PostOnlyReprice
+)
+
+func (p PostOnly) String() string {
+	switch p {
+	case PostOnlyReject:
+		return "reject"
+	case PostOnlyReprice:
+		return "reprice"
 	}
 	return "unknown"
 }
 
 // Order defines the order placed for trade
 type Order struct {
-	Id             uuid.UUID   `json:"id,omitempty"`
-	OrderTime      time.Time   `json:"order_time,omitempty"`
-	Transaction    Transaction `json:"transaction,omitempty"`
-	PlacedQuantity int         `json:"placed_quantity,omitempty"`
-	Quantity       int         `json:"quantity,omitempty"`
-	Executed       int         `json:"executed,omitempty"`
-	Price          int         `json:"price,omitempty"`
-	OrderType      OrderType   `json:"order_type,omitempty"`
-	Status         Status      `json:"status,omitempty"`
+	Id              uuid.UUID    `json:"id,omitempty"`
+	OrderTime       time.Time    `json:"order_time,omitempty"`
+	Transaction     Transaction  `json:"transaction,omitempty"`
+	PlacedQuantity  int          `json:"placed_quantity,omitempty"`
+	Quantity        int          `json:"quantity,omitempty"`
+	Executed        int          `json:"executed,omitempty"`
+	Price           int          `json:"price,omitempty"`
+	OrderType       OrderType    `json:"order_type,omitempty"`
+	Status          Status       `json:"status,omitempty"`
+	TriggerPrice    int          `json:"trigger_price,omitempty"`
+	Triggered       bool         `json:"triggered,omitempty"`
+	DisplayQuantity int          `json:"display_quantity,omitempty"`
+	PostOnly        PostOnly     `json:"post_only,omitempty"`
+	AllOrNone       bool         `json:"all_or_none,omitempty"`
+	MinQuantity     int          `json:"min_quantity,omitempty"`
+	RejectReason    string       `json:"reject_reason,omitempty"`
+	ClientOrderId   string       `json:"client_order_id,omitempty"`
+	PegReference    PegReference `json:"peg_reference,omitempty"`
+	PegOffset       int          `json:"peg_offset,omitempty"`
+	PegLimit        int          `json:"peg_limit,omitempty"`
+	Symbol          string       `json:"symbol,omitempty"`
+	Account         string       `json:"account,omitempty"`
+	GroupId         uuid.UUID    `json:"group_id,omitempty"`
+	ParentId        uuid.UUID    `json:"parent_id,omitempty"`
+
+	// shown is the display slice of a resting iceberg order
+	shown int
+}
+
+// Displayed returns the quantity of the order shown on the book. Only the
+// display slice of an iceberg order is shown, the rest is hidden.
+func (o *Order) Displayed() int {
+	if o.OrderType == Iceberg {
+		return o.shown
+	}
+	return o.Quantity
+}
+
+// replenish shows a new display slice once an iceberg order's slice is
+// filled, and reports if one was shown.
+func (o *Order) replenish() bool {
+	if o.OrderType != Iceberg || o.shown > 0 || o.Quantity == 0 {
+		return false
+	}
+	o.shown = o.DisplayQuantity
+	if o.shown <= 0 || o.shown > o.Quantity {
+		o.shown = o.Quantity
+	}
+	return true
+}
+
+// closed reports if the order has left the matcher
+func (o *Order) closed() bool {
+	return o.Status == TimedOut || o.Status == Completed ||
+		o.Status == Rejected || o.Status == Cancelled
+}
+
+// IsStop reports if the order is a stop or stop-limit order
+func (o *Order) IsStop() bool {
+	return o.OrderType == Stop || o.OrderType == StopLimit
 }
 
 type OrderMap map[int][]*Order
 
+// StopPolicy enum
+type StopPolicy int
+
+const (
+	// PersistResting sends the working orders to the store as they stand
+	// when the matcher stops
+	PersistResting StopPolicy = iota + 1
+	// CancelResting cancels the working orders when the matcher stops
+	CancelResting
+)
+
+func (p StopPolicy) String() string {
+	switch p {
+	case PersistResting:
+		return "persist"
+	case CancelResting:
+		return "cancel"
+	}
+	return "unknown"
+}
+
+// Trade is an execution between a buy and a sell order. The accounts of the
+// orders are not encoded, they tell whose order ids a client may see.
+type Trade struct {
+	BuyId       uuid.UUID `json:"buy_id"`
+	SellId      uuid.UUID `json:"sell_id"`
+	Price       int       `json:"price"`
+	Quantity    int       `json:"quantity"`
+	TradeTime   time.Time `json:"trade_time"`
+	BuyAccount  string    `json:"-"`
+	SellAccount string    `json:"-"`
+}
+
+// PriceLevel is the quantity shown on the book at a price
+type PriceLevel struct {
+	Price    int `json:"price"`
+	Quantity int `json:"quantity"`
+	Orders   int `json:"orders"`
+}
+
+// Book is the market depth, buy levels from the highest price and sell
+// levels from the lowest price.
+type Book struct {
+	Buy       []PriceLevel `json:"buy"`
+	Sell      []PriceLevel `json:"sell"`
+	LastPrice int          `json:"last_price,omitempty"`
+}
+
 // Matcher that receives orders and executes
 type Matcher interface {
-	// Execute Orders matches the buy and sell order from in memory maps.
-	ExecuteOrders()
+	// Execute Orders matches the buy and sell order from in memory maps
+	// until the context is done. It then places the orders still waiting,
+	// deals with the working orders as the stop policy says and closes the
+	// complete channel.
+	ExecuteOrders(ctx context.Context)
+
+	// LiveOrders returns a snapshot of the orders held by the matcher,
+	// including the untriggered stop orders kept off the book.
+	LiveOrders() []Order
+
+	// LiveOrder returns a snapshot of an order held by the matcher.
+	LiveOrder(id uuid.UUID) (Order, bool)
+
+	// Depth returns the quantity shown on the book at each price.
+	Depth() Book
+
+	// PlaceOrder enters the order and returns its state after matching on
+	// arrival, waiting at most the timeout.
+	PlaceOrder(o *Order, timeout time.Duration) (Ack, error)
+
+	// PlaceOrders enters the orders together and returns their states after
+	// matching on arrival, waiting at most the timeout.
+	PlaceOrders(orders []*Order, timeout time.Duration) ([]Ack, error)
+
+	// CancelOrder cancels a working order and returns its final state.
+	CancelOrder(id uuid.UUID) (Order, error)
+
+	// CancelOrders cancels the working orders that pass the filter at once
+	// and returns their final states.
+	CancelOrders(f CancelFilter) []Order
+
+	// DisableAccount cancels the working orders of the account and rejects
+	// its new orders until it is enabled again, returning the orders
+	// cancelled.
+	DisableAccount(account string) []Order
+
+	// EnableAccount accepts the new orders of a disabled account again.
+	EnableAccount(account string)
+
+	// AccountDisabled reports if the account is disabled.
+	AccountDisabled(account string) bool
+
+	// AmendOrder changes the quantity and price of a working limit or
+	// iceberg order and returns its state after matching. Zero values are
+	// left unchanged.
+	AmendOrder(id uuid.UUID, quantity, price int) (Ack, error)
+
+	// PlaceGroup places the orders of an OCO or bracket group together and
+	// returns copies of the orders once placed.
+	PlaceGroup(g *Group) ([]Order, error)
+
+	// Queue returns the number of orders and groups waiting to be placed and
+	// the capacity of the queue.
+	Queue() (depth, capacity int)
+
+	// Dump returns a consistent copy of the in-memory structures of the
+	// matcher for debugging.
+	Dump() Dump
+
+	// Collectors returns the metrics of the matcher, which are read without
+	// going through the matcher goroutine.
+	Collectors() []prometheus.Collector
+
+	// Subscribe registers f to be called with every trade. f is called on
+	// the matcher goroutine, so it must return quickly and not call the
+	// matcher.
+	Subscribe(f func(Trade))
+
+	// SetTimeouts changes the order timeout, in seconds, and the interval
+	// between sweeps for timed out orders while the matcher runs.
+	SetTimeouts(oTimeout int, cleanInterval time.Duration)
 }
 
 // matcherService implements the order processing
 type matcherService struct {
-	och      <-chan *Order
-	complete chan<- *Order
-	oTimeout int
-	log      *logrus.Logger
-	buy      OrderMap
-	sell     OrderMap
+	och       <-chan *Order
+	complete  chan<- *Order
+	events    chan<- Event
+	cmd       chan func()
+	ingress   chan func()
+	live      map[uuid.UUID]*Order
+	oTimeout  int
+	clean     time.Duration
+	onStop    StopPolicy
+	log       *logrus.Logger
+	buy       OrderMap
+	sell      OrderMap
+	stops     []*Order
+	pegs      []*Order
+	groups    map[uuid.UUID]*Group
+	disabled  map[string]bool
+	activated []*Group
+	cancelled []*Order
+	lastPrice int
+	fills     int
+	tradeSubs []func(Trade)
+	acking    *Order
+	ackFills  []Trade
+	metrics   *metrics
 }
 
-// NewMatcherService instantiates order matching service
+// NewMatcherService instantiates order matching service. The closed orders
+// are sent on complete, and the events of the orders on events unless it is
+// nil.
 func NewMatcherService(
 	och <-chan *Order,
 	complete chan<- *Order,
+	events chan<- Event,
 	oTimeout int,
+	cleanInterval time.Duration,
+	queueDepth int,
+	onStop StopPolicy,
 	log *logrus.Logger,
 ) Matcher {
 	return &matcherService{
 		och:      och,
 		complete: complete,
+		events:   events,
+		cmd:      make(chan func()),
+		ingress:  make(chan func(), queueDepth),
+		live:     make(map[uuid.UUID]*Order),
 		oTimeout: oTimeout,
+		clean:    cleanInterval,
+		onStop:   onStop,
 		log:      log,
 		buy:      make(OrderMap),
 		sell:     make(OrderMap),
+		groups:   make(map[uuid.UUID]*Group),
+		disabled: make(map[string]bool),
+		metrics:  newMetrics(),
 	}
 }
 
 // ReceiveOrders gets the orders from a channel and stores in memory
-func (m *matcherService) ExecuteOrders() {
+func (m *matcherService) ExecuteOrders(ctx context.Context) {
 	m.log.WithFields(logrus.Fields{
-		"OrderTimeout": m.oTimeout}).Info("Starting to Execute Orders")
+		"OrderTimeout":  m.oTimeout,
+		"CleanInterval": m.clean}).Info("Starting to Execute Orders")
 	for {
 		select {
+		case <-ctx.Done():
+			m.stop()
+			return
 		case o := <-m.och:
 			m.processOrder(o)
-		case <-time.After(5 * time.Second):
+		case f := <-m.cmd:
+			f()
+		case f := <-m.ingress:
+			f()
+		case <-time.After(m.clean):
 			m.log.Info("Clean Timedout Orders")
 			// m.printLiveOrders()
 			m.cleanTimedoutOrders(Buy)
 			m.cleanTimedoutOrders(Sell)
+			m.cleanTimedoutStops()
+			m.cleanTimedoutPegs()
+			m.settle()
 		}
+		m.observeBook()
+	}
+}
+
+// stop places the orders and groups still waiting for the matcher, then
+// persists or cancels the working orders and closes the complete channel so
+// that the store can finish.
+func (m *matcherService) stop() {
+	for drained := false; !drained; {
+		select {
+		case o := <-m.och:
+			m.processOrder(o)
+		case f := <-m.ingress:
+			f()
+		default:
+			drained = true
+		}
+	}
+
+	m.log.WithFields(logrus.Fields{
+		"Orders": len(m.live),
+		"Policy": m.onStop,
+	}).Info("Stopping to Execute Orders")
+	if m.onStop == CancelResting {
+		for _, o := range m.live {
+			if !o.closed() {
+				m.cancel(o, "service shut down")
+			}
+		}
+		m.settle()
+	}
+	for _, o := range m.live {
+		m.send(o)
+	}
+	close(m.complete)
+	if m.events != nil {
+		close(m.events)
+	}
+}
+
+// do runs f on the matcher goroutine and waits for it to return, so that
+// callers from other goroutines see a consistent view of the order maps.
+func (m *matcherService) do(f func()) {
+	done := make(chan struct{})
+	m.cmd <- func() {
+		f()
+		close(done)
+	}
+	<-done
+}
+
+// LiveOrders returns copies of the buy, sell and untriggered stop orders
+func (m *matcherService) LiveOrders() []Order {
+	var live []Order
+	m.do(func() {
+		for _, o := range m.live {
+			live = append(live, *o)
+		}
+	})
+	return live
+}
+
+// LiveOrder returns a copy of the order if the matcher holds it
+func (m *matcherService) LiveOrder(id uuid.UUID) (Order, bool) {
+	var o Order
+	var ok bool
+	m.do(func() {
+		var lo *Order
+		if lo, ok = m.live[id]; ok {
+			o = *lo
+		}
+	})
+	return o, ok
+}
+
+// send removes the closed order from the live orders and sends it in the
+// complete channel
+func (m *matcherService) send(o *Order) {
+	m.observeClosed(o)
+	delete(m.live, o.Id)
+	m.complete <- o
+}
+
+// Depth aggregates the displayed quantity of the buy and sell maps
+func (m *matcherService) Depth() Book {
+	var b Book
+	m.do(func() {
+		b.Buy = depth(m.buy)
+		b.Sell = depth(m.sell)
+		b.LastPrice = m.lastPrice
+	})
+	sort.Slice(b.Buy, func(i, j int) bool { return b.Buy[i].Price > b.Buy[j].Price })
+	sort.Slice(b.Sell, func(i, j int) bool { return b.Sell[i].Price < b.Sell[j].Price })
+	return b
+}
+
+func depth(oMap OrderMap) []PriceLevel {
+	levels := []PriceLevel{}
+	for p, ol := range oMap {
+		l := PriceLevel{Price: p}
+		for _, o := range ol {
+			l.Quantity += o.Displayed()
+			l.Orders++
+		}
+		levels = append(levels, l)
+	}
+	return levels
+}
+
+// SetTimeouts changes the timeouts on the matcher goroutine, taking effect
+// from the next sweep
+func (m *matcherService) SetTimeouts(oTimeout int, cleanInterval time.Duration) {
+	m.do(func() {
+		m.oTimeout = oTimeout
+		m.clean = cleanInterval
+	})
+}
+
+// Subscribe adds f to the functions called with every trade
+func (m *matcherService) Subscribe(f func(Trade)) {
+	m.do(func() {
+		m.tradeSubs = append(m.tradeSubs, f)
+	})
+}
+
+func (m *matcherService) publishTrade(in, match *Order, executed int) {
+	t := Trade{
+		BuyId:       in.Id,
+		SellId:      match.Id,
+		Price:       in.Price,
+		Quantity:    executed,
+		TradeTime:   time.Now().UTC(),
+		BuyAccount:  in.Account,
+		SellAccount: match.Account,
+	}
+	if in.Transaction == Sell {
+		t.BuyId, t.SellId = match.Id, in.Id
+		t.BuyAccount, t.SellAccount = match.Account, in.Account
+	}
+	m.recordFill(t)
+	for _, f := range m.tradeSubs {
+		f(t)
 	}
 }
 
@@ -136,28 +530,81 @@ func updateOrderQuantity(executed int, in, match *Order) {
 	match.Executed += executed
 }
 
-func (m *matcherService) processInputAgainstMatch(in *Order, mlist []*Order) {
-	for _, mo := range mlist {
-		if in.Quantity > mo.Quantity {
-			updateOrderQuantity(mo.Quantity, in, mo)
-		} else {
-			updateOrderQuantity(in.Quantity, in, mo)
-			break
+// processInputAgainstMatch fills the input order from the match-list and
+// returns the match-list in its new queue order.
+func (m *matcherService) processInputAgainstMatch(in *Order, mlist []*Order) []*Order {
+	for i := 0; i < len(mlist) && in.Quantity > 0; i++ {
+		mo := mlist[i]
+		if mo.closed() {
+			// Cancelled by its group, it leaves the book once the event ends
+			continue
+		}
+		executed := mo.Displayed()
+		if in.Quantity < executed {
+			executed = in.Quantity
+		}
+		// Orders only match at the same price, so that is the trade price
+		m.lastPrice = in.Price
+		m.fills++
+		updateOrderQuantity(executed, in, mo)
+		m.recordExecution(in, executed, in.Price)
+		m.recordExecution(mo, executed, in.Price)
+		m.publishTrade(in, mo, executed)
+		m.groupActivity(in)
+		m.groupActivity(mo)
+
+		if mo.OrderType == Iceberg {
+			mo.shown -= executed
+			if mo.replenish() {
+				// The new slice goes to the back of the price level's queue
+				mlist[i] = nil
+				mlist = append(mlist, mo)
+			}
 		}
 	}
 
 	// check input order is fully executed
 	if in.Quantity > 0 {
 		// Not fully executed as in.Quantity is not 0
-		if in.Transaction == Buy {
-			m.buy[in.Price] = append(m.buy[in.Price], in)
-		} else if in.Transaction == Sell {
-			m.sell[in.Price] = append(m.sell[in.Price], in)
-		}
+		m.rest(in)
 	} else {
 		// Fuly executed send order in complete channel
 		in.Status = Completed
-		m.complete <- in
+		m.send(in)
+	}
+	return mlist
+}
+
+// unrest removes the order from its price level in the buy or sell map
+func (m *matcherService) unrest(o *Order) {
+	oMap := m.buy
+	if o.Transaction == Sell {
+		oMap = m.sell
+	}
+	ol := oMap[o.Price]
+	for i, lo := range ol {
+		if lo == o {
+			ol = append(ol[:i], ol[i+1:]...)
+			break
+		}
+	}
+	if len(ol) > 0 {
+		oMap[o.Price] = ol
+	} else {
+		delete(oMap, o.Price)
+	}
+}
+
+// rest adds the order to the back of its price level in the buy or sell map
+func (m *matcherService) rest(o *Order) {
+	if o.OrderType == Iceberg {
+		o.shown = 0
+		o.replenish()
+	}
+	if o.Transaction == Buy {
+		m.buy[o.Price] = append(m.buy[o.Price], o)
+	} else if o.Transaction == Sell {
+		m.sell[o.Price] = append(m.sell[o.Price], o)
 	}
 }
 
@@ -184,7 +631,8 @@ func (m *matcherService) cleanTimedoutOrders(oType Transaction) {
 				}).Debug("TimedOut Order")
 
 				o.Status = TimedOut
-				m.complete <- o
+				m.record(o, EventExpired, fmt.Sprintf("timed out after %ds", m.oTimeout))
+				m.send(o)
 			} else {
 				temp = append(temp, o)
 			}
@@ -202,6 +650,27 @@ func (m *matcherService) cleanTimedoutOrders(oType Transaction) {
 	}
 }
 
+func (m *matcherService) cleanTimedoutStops() {
+	temp := m.stops[:0]
+	for _, o := range m.stops {
+		if int(time.Since(o.OrderTime).Seconds()) > m.oTimeout {
+			m.log.WithFields(logrus.Fields{
+				"Id":           o.Id.String()[:10],
+				"Transaction":  o.Transaction,
+				"TriggerPrice": o.TriggerPrice,
+				"OrderTime":    o.OrderTime.Format(time.UnixDate),
+			}).Debug("TimedOut Stop Order")
+
+			o.Status = TimedOut
+			m.record(o, EventExpired, fmt.Sprintf("timed out after %ds", m.oTimeout))
+			m.send(o)
+		} else {
+			temp = append(temp, o)
+		}
+	}
+	m.stops = temp
+}
+
 func (m *matcherService) cleanCompletedOrders(oType Transaction, price int) {
 
 	var mlist []*Order
@@ -215,12 +684,16 @@ func (m *matcherService) cleanCompletedOrders(oType Transaction, price int) {
 	// Remove from the copied list and send message in complete channel
 	temp := mlist[:0]
 	for _, o := range mlist {
-		if o.Quantity > 0 {
+		if o == nil {
+			// An iceberg order that moved to the back of the queue
+			continue
+		}
+		if o.Quantity > 0 || o.Status == Cancelled {
 			temp = append(temp, o)
 		} else {
 			// Fuly executed send order in complete channel
 			o.Status = Completed
-			m.complete <- o
+			m.send(o)
 		}
 	}
 
@@ -251,29 +724,223 @@ func (m *matcherService) processOrder(o *Order) {
 		"OrderTime":   o.OrderTime.Format(time.UnixDate),
 	}).Debug("Matcher received order")
 
+	m.live[o.Id] = o
+	m.metrics.received.WithLabelValues(o.Transaction.String(), o.OrderType.String()).Inc()
+	m.record(o, EventPlaced, "new order")
+	if m.disabled[o.Account] {
+		m.reject(o, "account "+o.Account+" is disabled")
+		return
+	}
+	m.enter(o)
+	m.settle()
+}
+
+// enter holds, rests or matches the order according to its type
+func (m *matcherService) enter(o *Order) {
+	if o.IsStop() && !o.Triggered {
+		if !m.stopCrossed(o) {
+			// Hold the stop off the book until the last trade crosses it
+			m.stops = append(m.stops, o)
+			return
+		}
+		m.triggerStop(o)
+	}
+	if o.OrderType == Pegged {
+		// Pegged orders are priced and placed on the book by repricePegs
+		o.Price = 0
+		m.pegs = append(m.pegs, o)
+	} else {
+		m.matchOrder(o, true)
+	}
+}
+
+// settle triggers the crossed stops, reprices the pegged orders and updates
+// the order groups until the book no longer changes. Only fills and group
+// changes move the pegs' reference prices, so a pass without either leaves
+// nothing more to do.
+func (m *matcherService) settle() {
+	for {
+		m.triggerStops()
+		fills := m.fills
+		m.repricePegs()
+		changed := m.updateGroups()
+		if m.fills == fills && !changed {
+			return
+		}
+	}
+}
+
+// stopCrossed checks if the last trade price has reached the trigger price.
+// A buy stop triggers at or above its trigger, a sell stop at or below.
+func (m *matcherService) stopCrossed(o *Order) bool {
+	if m.lastPrice == 0 {
+		return false
+	}
+	switch o.Transaction {
+	case Buy:
+		return m.lastPrice >= o.TriggerPrice
+	case Sell:
+		return m.lastPrice <= o.TriggerPrice
+	}
+	return false
+}
+
+// triggerStop converts a stop into an order that can be matched. A stop
+// enters as a market order at the last trade price, a stop-limit as a limit
+// order at its own price.
+func (m *matcherService) triggerStop(o *Order) {
+	m.log.WithFields(logrus.Fields{
+		"OrderId":      o.Id.String()[:10],
+		"Transaction":  o.Transaction,
+		"OrderType":    o.OrderType,
+		"TriggerPrice": o.TriggerPrice,
+		"LastPrice":    m.lastPrice,
+	}).Debug("Stop order triggered")
+
+	o.Triggered = true
+	if o.OrderType == Stop {
+		o.Price = m.lastPrice
+	}
+	m.record(o, EventTriggered, fmt.Sprintf("last price %d crossed the trigger price %d",
+		m.lastPrice, o.TriggerPrice))
+	m.groupActivity(o)
+}
+
+// triggerStops enters every held stop crossed by the last trade price. The
+// fills of a triggered stop move the last trade price, so the held stops are
+// checked again until none are left to trigger.
+func (m *matcherService) triggerStops() {
+	for {
+		var next *Order
+		for i, o := range m.stops {
+			if !o.closed() && m.stopCrossed(o) {
+				next = o
+				m.stops = append(m.stops[:i], m.stops[i+1:]...)
+				break
+			}
+		}
+		if next == nil {
+			return
+		}
+		m.triggerStop(next)
+		m.matchOrder(next, true)
+	}
+}
+
+// opposite returns the map the order is matched against
+func (m *matcherService) opposite(o *Order) OrderMap {
+	if o.Transaction == Buy {
+		return m.sell
+	}
+	return m.buy
+}
+
+// checkInstructions enforces the execution instructions of an order entering
+// the book and returns why it is rejected, or an empty string if it can be
+// matched. A post-only order must not execute, it is rejected or repriced a
+// tick away at a time until it no longer would. An arriving all-or-none
+// order must execute its full quantity and an arriving minimum-quantity
+// order at least its minimum quantity, the remainder of which then rests on
+// the book. An order already on the book, moved by an amendment, is not
+// held to them again.
+func (m *matcherService) checkInstructions(o *Order, arriving bool) string {
+	if o.MinQuantity < 0 || o.MinQuantity > o.Quantity {
+		return fmt.Sprintf("minimum quantity %d is not between 0 and quantity %d",
+			o.MinQuantity, o.Quantity)
+	}
+	if o.PostOnly != 0 && (o.AllOrNone || o.MinQuantity > 0) {
+		return "post-only order cannot be all-or-none or have a minimum quantity"
+	}
+
+	oMap := m.opposite(o)
+	switch o.PostOnly {
+	case 0:
+	case PostOnlyReject:
+		if len(oMap[o.Price]) > 0 {
+			return fmt.Sprintf("post-only order would take liquidity at price %d",
+				o.Price)
+		}
+	case PostOnlyReprice:
+		tick := -1
+		if o.Transaction == Sell {
+			tick = 1
+		}
+		for len(oMap[o.Price]) > 0 {
+			o.Price += tick
+		}
+		if o.Price <= 0 {
+			return "post-only order has no price to reprice to"
+		}
+	default:
+		return fmt.Sprintf("invalid post-only instruction %d", o.PostOnly)
+	}
+	if !arriving {
+		return ""
+	}
+
+	avail := 0
+	for _, mo := range oMap[o.Price] {
+		if mo.closed() {
+			continue
+		}
+		avail += mo.Quantity
+	}
+	if o.AllOrNone && avail < o.Quantity {
+		return fmt.Sprintf("all-or-none order for %d has only %d available at price %d",
+			o.Quantity, avail, o.Price)
+	}
+	if o.MinQuantity > 0 && avail < o.MinQuantity {
+		return fmt.Sprintf("minimum quantity %d has only %d available at price %d",
+			o.MinQuantity, avail, o.Price)
+	}
+	return ""
+}
+
+// reject sends the order to the complete channel without matching it
+func (m *matcherService) reject(o *Order, reason string) {
+	m.log.WithFields(logrus.Fields{
+		"OrderId": o.Id.String()[:10],
+		"Reason":  reason,
+	}).Debug("Rejected order")
+
+	o.Status = Rejected
+	o.RejectReason = reason
+	m.record(o, EventRejected, reason)
+	m.send(o)
+}
+
+// matchOrder matches the order against the opposite side or rests it. The
+// arrival-only instructions are checked if the order is arriving.
+func (m *matcherService) matchOrder(o *Order, arriving bool) {
+	if reason := m.checkInstructions(o, arriving); reason != "" {
+		m.reject(o, reason)
+		return
+	}
+
 	switch o.Transaction {
 	case Buy:
 		// Check for sellOrder with a matching price
 		sellOrder, ok := m.sell[o.Price]
 		if ok {
-			m.processInputAgainstMatch(o, sellOrder)
+			m.sell[o.Price] = m.processInputAgainstMatch(o, sellOrder)
 			m.cleanCompletedOrders(Sell, o.Price)
 		} else {
 			// No match add to buy map
-			m.buy[o.Price] = append(m.buy[o.Price], o)
+			m.rest(o)
 		}
 	case Sell:
 		// Check for buyOrder with a matching price
 		buyOrder, ok := m.buy[o.Price]
 		if ok {
-			m.processInputAgainstMatch(o, buyOrder)
+			m.buy[o.Price] = m.processInputAgainstMatch(o, buyOrder)
 			m.cleanCompletedOrders(Buy, o.Price)
 		} else {
 			// No match add to sell map
-			m.sell[o.Price] = append(m.sell[o.Price], o)
+			m.rest(o)
 		}
 	default:
 		m.log.Error("Invalid order transaction, only Buy or Sell supported")
+		m.reject(o, "invalid order transaction, only buy or sell supported")
 	}
 }
 
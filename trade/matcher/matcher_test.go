@@ -1,11 +1,13 @@
 package matcher
 
 import (
+	"context"
 	"io/ioutil"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
@@ -179,8 +181,8 @@ func Test_Matcher_ExecuteOrders(t *testing.T) {
 			orders := make(chan *Order)
 			complete := make(chan *Order)
 
-			match := NewMatcherService(orders, complete, tt.timeout, log)
-			go match.ExecuteOrders()
+			match := NewMatcherService(orders, complete, nil, tt.timeout, 5*time.Second, 100, PersistResting, log)
+			go match.ExecuteOrders(context.Background())
 
 			for _, o := range tt.inOrders {
 				orders <- o
@@ -196,3 +198,745 @@ func Test_Matcher_ExecuteOrders(t *testing.T) {
 		})
 	}
 }
+
+func newTestMatcher(complete chan *Order) *matcherService {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	return NewMatcherService(nil, complete, nil, 10, 5*time.Second, 100, PersistResting, log).(*matcherService)
+}
+
+func newTestOrder(t Transaction, ot OrderType, qty, price, trigger int) *Order {
+	return &Order{
+		Id:             uuid.New(),
+		OrderTime:      time.Now().UTC(),
+		Transaction:    t,
+		PlacedQuantity: qty,
+		Quantity:       qty,
+		Price:          price,
+		OrderType:      ot,
+		Status:         Placed,
+		TriggerPrice:   trigger,
+	}
+}
+
+func Test_Matcher_StopOrders(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	sellA := newTestOrder(Sell, Limit, 5, 100, 0)
+	sellB := newTestOrder(Sell, Limit, 10, 101, 0)
+	stop1 := newTestOrder(Buy, StopLimit, 5, 101, 100)
+	stop2 := newTestOrder(Buy, Stop, 5, 0, 101)
+	buyC := newTestOrder(Buy, Limit, 5, 100, 0)
+
+	for _, o := range []*Order{sellA, sellB, stop1, stop2} {
+		m.processOrder(o)
+	}
+	// No trade has happened, so both stops are held off the book
+	assert.Equal(t, []*Order{stop1, stop2}, m.stops)
+	assert.Empty(t, m.buy)
+	assert.False(t, stop1.Triggered)
+	assert.False(t, stop2.Triggered)
+
+	// The trade at 100 triggers stop1, whose fill at 101 triggers stop2
+	m.processOrder(buyC)
+	close(complete)
+
+	rmap := make(map[uuid.UUID]*Order)
+	for o := range complete {
+		rmap[o.Id] = o
+	}
+	assert.Len(t, rmap, 5)
+	for _, o := range rmap {
+		assert.Equal(t, Completed, o.Status)
+		assert.Equal(t, o.PlacedQuantity, o.Executed)
+	}
+	assert.True(t, stop1.Triggered)
+	assert.True(t, stop2.Triggered)
+	assert.Equal(t, 101, stop2.Price)
+	assert.Equal(t, 101, m.lastPrice)
+	assert.Empty(t, m.stops)
+	assert.Empty(t, m.buy)
+	assert.Empty(t, m.sell)
+}
+
+func Test_Matcher_Events(t *testing.T) {
+	complete := make(chan *Order, 10)
+	events := make(chan Event, 20)
+	m := newTestMatcher(complete)
+	m.events = events
+	m.onStop = CancelResting
+
+	sell := newTestOrder(Sell, Limit, 10, 100, 0)
+	stop := newTestOrder(Buy, StopLimit, 5, 99, 100)
+	buy := newTestOrder(Buy, Limit, 4, 100, 0)
+	for _, o := range []*Order{sell, stop, buy} {
+		m.processOrder(o)
+	}
+	m.cancel(sell, "cancel request")
+	m.stop()
+
+	history := make(map[uuid.UUID][]EventType)
+	var causes []string
+	for e := range events {
+		history[e.OrderId] = append(history[e.OrderId], e.Type)
+		if e.OrderId == sell.Id {
+			causes = append(causes, e.Cause)
+		}
+	}
+	assert.Equal(t, []EventType{EventPlaced, EventPartiallyFilled, EventCancelled}, history[sell.Id])
+	assert.Equal(t, []EventType{EventPlaced, EventFilled}, history[buy.Id])
+	// The stop triggered by the trade rests until the matcher shuts down
+	assert.Equal(t, []EventType{EventPlaced, EventTriggered, EventCancelled}, history[stop.Id])
+	assert.Equal(t, []string{"new order", "traded 4 at 100", "cancel request"}, causes)
+}
+
+func Test_Matcher_LiveOrders(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+
+	orders := make(chan *Order)
+	complete := make(chan *Order)
+
+	match := NewMatcherService(orders, complete, nil, 10, 5*time.Second, 100, PersistResting, log)
+	go match.ExecuteOrders(context.Background())
+
+	buy := newTestOrder(Buy, Limit, 10, 100, 0)
+	stop := newTestOrder(Sell, Stop, 10, 0, 90)
+	orders <- buy
+	orders <- stop
+
+	live := match.LiveOrders()
+	assert.ElementsMatch(t, []Order{*buy, *stop}, live)
+	for _, o := range live {
+		assert.False(t, o.Triggered)
+	}
+}
+
+func Test_Matcher_PlaceOrder(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	// Orders wait in the queue until the matcher runs, and are turned away
+	// once it is full
+	m.ingress = make(chan func(), 1)
+	queued := newTestOrder(Buy, Limit, 10, 90, 0)
+	_, err := m.PlaceOrder(queued, 10*time.Millisecond)
+	assert.Equal(t, ErrAckTimeout, err)
+	_, err = m.PlaceOrder(newTestOrder(Buy, Limit, 10, 90, 0), time.Second)
+	assert.Equal(t, ErrQueueFull, err)
+	depth, capacity := m.Queue()
+	assert.Equal(t, 1, depth)
+	assert.Equal(t, 1, capacity)
+
+	go m.ExecuteOrders(context.Background())
+	assert.Eventually(t, func() bool {
+		_, ok := m.LiveOrder(queued.Id)
+		return ok
+	}, time.Second, 10*time.Millisecond)
+
+	sell := newTestOrder(Sell, Limit, 10, 100, 0)
+	ack, err := m.PlaceOrder(sell, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, Placed, ack.Order.Status)
+	assert.Empty(t, ack.Fills)
+
+	buy := newTestOrder(Buy, Limit, 6, 100, 0)
+	ack, err = m.PlaceOrder(buy, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, Completed, ack.Order.Status)
+	assert.Equal(t, 6, ack.Order.Executed)
+	if assert.Len(t, ack.Fills, 1) {
+		assert.Equal(t, buy.Id, ack.Fills[0].BuyId)
+		assert.Equal(t, sell.Id, ack.Fills[0].SellId)
+		assert.Equal(t, 6, ack.Fills[0].Quantity)
+	}
+
+	ack, err = m.PlaceOrder(newTestOrder(Buy, Limit, 10, 100, 0), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, Placed, ack.Order.Status)
+	assert.Len(t, ack.Fills, 1)
+	assert.Equal(t, 4, ack.Order.Executed)
+}
+
+func Test_Matcher_CancelAmend(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+	go m.ExecuteOrders(context.Background())
+
+	first := newTestOrder(Sell, Limit, 10, 100, 0)
+	second := newTestOrder(Sell, Limit, 10, 100, 0)
+	for _, o := range []*Order{first, second} {
+		_, err := m.PlaceOrder(o, time.Second)
+		assert.NoError(t, err)
+	}
+
+	// Reducing the quantity keeps the order first in the queue
+	ack, err := m.AmendOrder(first.Id, 5, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, 5, ack.Order.Quantity)
+	assert.Equal(t, 100, ack.Order.Price)
+
+	ack, err = m.PlaceOrder(newTestOrder(Buy, Limit, 5, 100, 0), time.Second)
+	assert.NoError(t, err)
+	if assert.Len(t, ack.Fills, 1) {
+		assert.Equal(t, first.Id, ack.Fills[0].SellId)
+	}
+	assert.Equal(t, Completed, (<-complete).Status)
+	assert.Equal(t, Completed, (<-complete).Status)
+
+	// A new price matches the resting buy order
+	buy := newTestOrder(Buy, Limit, 10, 95, 0)
+	_, err = m.PlaceOrder(buy, time.Second)
+	assert.NoError(t, err)
+	ack, err = m.AmendOrder(second.Id, 0, 95)
+	assert.NoError(t, err)
+	assert.Equal(t, Completed, ack.Order.Status)
+	if assert.Len(t, ack.Fills, 1) {
+		assert.Equal(t, buy.Id, ack.Fills[0].BuyId)
+	}
+	<-complete
+	<-complete
+
+	_, err = m.AmendOrder(second.Id, 20, 0)
+	assert.Equal(t, ErrOrderNotFound, err)
+
+	resting := newTestOrder(Buy, Limit, 10, 90, 0)
+	_, err = m.PlaceOrder(resting, time.Second)
+	assert.NoError(t, err)
+	_, err = m.AmendOrder(resting.Id, 0, -1)
+	assert.Error(t, err)
+
+	o, err := m.CancelOrder(resting.Id)
+	assert.NoError(t, err)
+	assert.Equal(t, Cancelled, o.Status)
+	assert.Equal(t, resting, <-complete)
+	assert.Empty(t, m.Depth().Buy)
+	_, err = m.CancelOrder(resting.Id)
+	assert.Equal(t, ErrOrderNotFound, err)
+}
+
+func Test_Matcher_AmendMinQuantity(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+	go m.ExecuteOrders(context.Background())
+
+	_, err := m.PlaceOrder(newTestOrder(Buy, Limit, 5, 100, 0), time.Second)
+	assert.NoError(t, err)
+	sell := newTestOrder(Sell, Limit, 10, 100, 0)
+	sell.MinQuantity = 5
+	ack, err := m.PlaceOrder(sell, time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, Placed, ack.Order.Status)
+	assert.Equal(t, 5, ack.Order.Executed)
+	<-complete
+
+	// The minimum quantity was met on arrival, a new price with nothing on
+	// the other side rests the remainder
+	ack, err = m.AmendOrder(sell.Id, 0, 99)
+	assert.NoError(t, err)
+	assert.Equal(t, Placed, ack.Order.Status)
+	assert.Empty(t, ack.Order.RejectReason)
+	assert.Equal(t, []PriceLevel{{Price: 99, Quantity: 5, Orders: 1}}, m.Depth().Sell)
+
+	ack, err = m.AmendOrder(sell.Id, 12, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, Placed, ack.Order.Status)
+	assert.Equal(t, 7, ack.Order.Quantity)
+}
+
+func Test_Matcher_PlaceOrders(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	m.ingress = make(chan func(), 0)
+	_, err := m.PlaceOrders([]*Order{newTestOrder(Buy, Limit, 10, 90, 0)}, time.Second)
+	assert.Equal(t, ErrQueueFull, err)
+
+	m.ingress = make(chan func(), 1)
+	go m.ExecuteOrders(context.Background())
+	sell := newTestOrder(Sell, Limit, 10, 100, 0)
+	buy := newTestOrder(Buy, Limit, 4, 100, 0)
+	aon := newTestOrder(Buy, Limit, 10, 100, 0)
+	aon.AllOrNone = true
+	acks, err := m.PlaceOrders([]*Order{sell, buy, aon}, time.Second)
+	assert.NoError(t, err)
+	if assert.Len(t, acks, 3) {
+		assert.Equal(t, Placed, acks[0].Order.Status)
+		assert.Empty(t, acks[0].Fills)
+		assert.Equal(t, Completed, acks[1].Order.Status)
+		if assert.Len(t, acks[1].Fills, 1) {
+			assert.Equal(t, sell.Id, acks[1].Fills[0].SellId)
+		}
+		assert.Equal(t, Rejected, acks[2].Order.Status)
+		assert.Empty(t, acks[2].Fills)
+	}
+	assert.Equal(t, 6, m.Depth().Sell[0].Quantity)
+}
+
+func Test_Matcher_CancelOrders(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+	go m.ExecuteOrders(context.Background())
+
+	order := func(account string, side Transaction, price int) *Order {
+		o := newTestOrder(side, Limit, 10, price, 0)
+		o.Account = account
+		_, err := m.PlaceOrder(o, time.Second)
+		assert.NoError(t, err)
+		return o
+	}
+	bid := order("mm", Buy, 99)
+	ask := order("mm", Sell, 101)
+	other := order("other", Buy, 98)
+
+	parent := newTestOrder(Buy, Limit, 10, 97, 0)
+	child := newTestOrder(Sell, Limit, 10, 110, 0)
+	parent.Account, child.Account = "mm", "mm"
+	_, err := m.PlaceGroup(newTestGroup(Bracket, parent, child))
+	assert.NoError(t, err)
+
+	// The waiting child of a cancelled parent is cancelled with it
+	cancelled := m.CancelOrders(CancelFilter{Account: "mm", Transaction: Buy})
+	var ids []uuid.UUID
+	for _, o := range cancelled {
+		assert.Equal(t, Cancelled, o.Status)
+		ids = append(ids, o.Id)
+	}
+	assert.ElementsMatch(t, []uuid.UUID{bid.Id, parent.Id, child.Id}, ids)
+	book := m.Depth()
+	assert.Equal(t, []PriceLevel{{Price: 98, Quantity: 10, Orders: 1}}, book.Buy)
+	assert.Equal(t, []PriceLevel{{Price: 101, Quantity: 10, Orders: 1}}, book.Sell)
+
+	cancelled = m.CancelOrders(CancelFilter{Account: "mm"})
+	if assert.Len(t, cancelled, 1) {
+		assert.Equal(t, ask.Id, cancelled[0].Id)
+	}
+	assert.Empty(t, m.CancelOrders(CancelFilter{Account: "mm"}))
+	_, ok := m.LiveOrder(other.Id)
+	assert.True(t, ok)
+}
+
+func Test_Matcher_DisableAccount(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+	go m.ExecuteOrders(context.Background())
+
+	order := func(account string, side Transaction, price int) *Order {
+		o := newTestOrder(side, Limit, 10, price, 0)
+		o.Account = account
+		return o
+	}
+	resting := order("mm", Sell, 100)
+	_, err := m.PlaceOrder(resting, time.Second)
+	assert.NoError(t, err)
+
+	cancelled := m.DisableAccount("mm")
+	if assert.Len(t, cancelled, 1) {
+		assert.Equal(t, resting.Id, cancelled[0].Id)
+	}
+	assert.True(t, m.AccountDisabled("mm"))
+
+	// New orders and groups of the account are rejected, others still match
+	ack, err := m.PlaceOrder(order("mm", Buy, 90), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, Rejected, ack.Order.Status)
+	assert.Equal(t, "account mm is disabled", ack.Order.RejectReason)
+	placed, err := m.PlaceGroup(newTestGroup(OCO, order("other", Buy, 90), order("mm", Buy, 80)))
+	assert.NoError(t, err)
+	for _, o := range placed {
+		assert.Equal(t, Rejected, o.Status)
+	}
+	ack, err = m.PlaceOrder(order("other", Buy, 90), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, Placed, ack.Order.Status)
+
+	m.EnableAccount("mm")
+	assert.False(t, m.AccountDisabled("mm"))
+	ack, err = m.PlaceOrder(order("mm", Sell, 90), time.Second)
+	assert.NoError(t, err)
+	assert.Equal(t, Completed, ack.Order.Status)
+}
+
+func Test_Matcher_Stop(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy StopPolicy
+		want   Status
+	}{
+		{"PersistResting", PersistResting, Placed},
+		{"CancelResting", CancelResting, Cancelled},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			complete := make(chan *Order, 10)
+			m := newTestMatcher(complete)
+			m.onStop = tt.policy
+
+			// The orders are still queued when the matcher is stopped
+			resting := newTestOrder(Buy, Limit, 10, 100, 0)
+			stop := newTestOrder(Sell, Stop, 10, 0, 90)
+			for _, o := range []*Order{resting, stop} {
+				_, err := m.PlaceOrder(o, time.Millisecond)
+				assert.Equal(t, ErrAckTimeout, err)
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			m.ExecuteOrders(ctx)
+
+			var stopped []*Order
+			for o := range complete {
+				stopped = append(stopped, o)
+			}
+			assert.ElementsMatch(t, []*Order{resting, stop}, stopped)
+			for _, o := range stopped {
+				assert.Equal(t, tt.want, o.Status)
+			}
+			assert.Empty(t, m.live)
+		})
+	}
+}
+
+func Test_Matcher_Metrics(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	m.processOrder(newTestOrder(Sell, Limit, 10, 100, 0))
+	m.processOrder(newTestOrder(Buy, Limit, 10, 100, 0))
+	m.processOrder(newTestOrder(Buy, Limit, 10, 90, 0))
+	aon := newTestOrder(Buy, Limit, 10, 110, 0)
+	aon.AllOrNone = true
+	m.processOrder(aon)
+	m.observeBook()
+
+	mt := m.metrics
+	assert.Equal(t, 3.0, testutil.ToFloat64(mt.received.WithLabelValues("buy", "limit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(mt.received.WithLabelValues("sell", "limit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(mt.filled.WithLabelValues("buy", "limit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(mt.filled.WithLabelValues("sell", "limit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(mt.rejected.WithLabelValues("buy", "limit")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(mt.bookLevels.WithLabelValues("buy")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(mt.bookLevels.WithLabelValues("sell")))
+	assert.Equal(t, 10.0, testutil.ToFloat64(mt.bookQty.WithLabelValues("buy")))
+	assert.Equal(t, 0.0, testutil.ToFloat64(mt.bookQty.WithLabelValues("sell")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(mt.openOrders))
+}
+
+func Test_Matcher_Dump(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	first := newTestOrder(Buy, Limit, 10, 100, 0)
+	second := newTestOrder(Buy, Limit, 5, 100, 0)
+	high := newTestOrder(Buy, Limit, 5, 101, 0)
+	sell := newTestOrder(Sell, Limit, 5, 105, 0)
+	stop := newTestOrder(Sell, Stop, 10, 0, 90)
+	for _, o := range []*Order{first, second, high, sell, stop} {
+		m.processOrder(o)
+	}
+	g := newTestGroup(OCO, newTestOrder(Sell, Limit, 5, 110, 0), newTestOrder(Sell, Limit, 5, 111, 0))
+	m.processGroup(g)
+	go m.ExecuteOrders(context.Background())
+
+	d := m.Dump()
+	assert.Equal(t, []Level{
+		{Price: 101, Orders: []Order{*high}},
+		{Price: 100, Orders: []Order{*first, *second}},
+	}, d.Buy)
+	assert.Equal(t, []int{105, 110, 111}, []int{d.Sell[0].Price, d.Sell[1].Price, d.Sell[2].Price})
+	assert.Equal(t, []Order{*stop}, d.Stops)
+	assert.Equal(t, []GroupState{{
+		Id: g.Id, Type: OCO, Orders: []uuid.UUID{g.Orders[0].Id, g.Orders[1].Id},
+	}}, d.Groups)
+	assert.Equal(t, 7, d.Live)
+	assert.Equal(t, Channels{IngressCapacity: 100}, d.Channels)
+}
+
+func Test_Matcher_IcebergOrders(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	iceberg := newTestOrder(Sell, Iceberg, 30, 100, 0)
+	iceberg.DisplayQuantity = 10
+	limit := newTestOrder(Sell, Limit, 5, 100, 0)
+	m.processOrder(iceberg)
+	m.processOrder(limit)
+	assert.Equal(t, []PriceLevel{{Price: 100, Quantity: 15, Orders: 2}}, depth(m.sell))
+
+	// The first slice fills and the replenished slice queues behind limit
+	buy1 := newTestOrder(Buy, Limit, 12, 100, 0)
+	m.processOrder(buy1)
+	assert.Equal(t, []*Order{limit, iceberg}, m.sell[100])
+	assert.Equal(t, []PriceLevel{{Price: 100, Quantity: 13, Orders: 2}}, depth(m.sell))
+	assert.Equal(t, 30, iceberg.PlacedQuantity)
+	assert.Equal(t, 20, iceberg.Quantity)
+	assert.Equal(t, 10, iceberg.Executed)
+	assert.Equal(t, 3, limit.Quantity)
+
+	buy2 := newTestOrder(Buy, Limit, 5, 100, 0)
+	m.processOrder(buy2)
+	assert.Equal(t, []*Order{iceberg}, m.sell[100])
+	assert.Equal(t, 8, iceberg.Displayed())
+	assert.Equal(t, 18, iceberg.Quantity)
+	assert.Equal(t, 12, iceberg.Executed)
+	close(complete)
+
+	var done []*Order
+	for o := range complete {
+		done = append(done, o)
+	}
+	assert.ElementsMatch(t, []*Order{buy1, buy2, limit}, done)
+}
+
+func Test_Matcher_ExecutionInstructions(t *testing.T) {
+	tests := []struct {
+		name      string
+		resting   []*Order
+		in        *Order
+		wantPrice int
+		wantLeft  int
+		wantErr   string
+	}{
+		{
+			name:    "PostOnlyReject",
+			resting: []*Order{newTestOrder(Sell, Limit, 10, 100, 0)},
+			in: &Order{Transaction: Buy, OrderType: Limit, Quantity: 5,
+				Price: 100, PostOnly: PostOnlyReject},
+			wantPrice: 100,
+			wantLeft:  5,
+			wantErr:   "post-only order would take liquidity at price 100",
+		},
+		{
+			name: "PostOnlyReprice",
+			resting: []*Order{newTestOrder(Sell, Limit, 10, 100, 0),
+				newTestOrder(Sell, Limit, 10, 99, 0)},
+			in: &Order{Transaction: Buy, OrderType: Limit, Quantity: 5,
+				Price: 100, PostOnly: PostOnlyReprice},
+			wantPrice: 98,
+			wantLeft:  5,
+		},
+		{
+			name: "AllOrNoneFilled",
+			resting: []*Order{newTestOrder(Sell, Limit, 3, 100, 0),
+				newTestOrder(Sell, Limit, 4, 100, 0)},
+			in: &Order{Transaction: Buy, OrderType: Limit, Quantity: 7,
+				Price: 100, AllOrNone: true},
+			wantPrice: 100,
+		},
+		{
+			name:    "AllOrNoneRejected",
+			resting: []*Order{newTestOrder(Sell, Limit, 3, 100, 0)},
+			in: &Order{Transaction: Buy, OrderType: Limit, Quantity: 7,
+				Price: 100, AllOrNone: true},
+			wantPrice: 100,
+			wantLeft:  7,
+			wantErr:   "all-or-none order for 7 has only 3 available at price 100",
+		},
+		{
+			name:    "MinQuantityRests",
+			resting: []*Order{newTestOrder(Buy, Limit, 4, 100, 0)},
+			in: &Order{Transaction: Sell, OrderType: Limit, Quantity: 10,
+				Price: 100, MinQuantity: 4},
+			wantPrice: 100,
+			wantLeft:  6,
+		},
+		{
+			name:    "MinQuantityRejected",
+			resting: []*Order{newTestOrder(Buy, Limit, 3, 100, 0)},
+			in: &Order{Transaction: Sell, OrderType: Limit, Quantity: 10,
+				Price: 100, MinQuantity: 4},
+			wantPrice: 100,
+			wantLeft:  10,
+			wantErr:   "minimum quantity 4 has only 3 available at price 100",
+		},
+		{
+			name: "ConflictingInstructions",
+			in: &Order{Transaction: Sell, OrderType: Limit, Quantity: 10,
+				Price: 100, MinQuantity: 4, PostOnly: PostOnlyReject},
+			wantPrice: 100,
+			wantLeft:  10,
+			wantErr:   "post-only order cannot be all-or-none or have a minimum quantity",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			complete := make(chan *Order, 10)
+			m := newTestMatcher(complete)
+			for _, o := range tt.resting {
+				m.processOrder(o)
+			}
+			tt.in.Id = uuid.New()
+			tt.in.PlacedQuantity = tt.in.Quantity
+			m.processOrder(tt.in)
+
+			assert.Equal(t, tt.wantPrice, tt.in.Price)
+			assert.Equal(t, tt.wantLeft, tt.in.Quantity)
+			assert.Equal(t, tt.wantErr, tt.in.RejectReason)
+			if tt.wantErr != "" {
+				assert.Equal(t, Rejected, tt.in.Status)
+			}
+		})
+	}
+}
+
+func newTestPeg(t Transaction, qty int, ref PegReference, offset, limit int) *Order {
+	o := newTestOrder(t, Pegged, qty, 0, 0)
+	o.PegReference = ref
+	o.PegOffset = offset
+	o.PegLimit = limit
+	return o
+}
+
+func Test_Matcher_PeggedOrders(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	buy1 := newTestOrder(Buy, Limit, 10, 100, 0)
+	sell1 := newTestOrder(Sell, Limit, 10, 110, 0)
+	primary := newTestPeg(Buy, 5, PegPrimary, 0, 0)
+	midpoint := newTestPeg(Sell, 5, PegMidpoint, 0, 107)
+	market := newTestPeg(Buy, 5, PegMarket, -1, 0)
+	for _, o := range []*Order{buy1, sell1, primary, midpoint, market} {
+		m.processOrder(o)
+	}
+	assert.Equal(t, 100, primary.Price)
+	assert.Equal(t, []*Order{buy1, primary}, m.buy[100])
+	assert.Equal(t, 107, midpoint.Price)
+	assert.Equal(t, 109, market.Price)
+
+	// A better bid moves the primary peg behind it and the midpoint peg up
+	buy2 := newTestOrder(Buy, Limit, 5, 104, 0)
+	m.processOrder(buy2)
+	assert.Equal(t, []*Order{buy1}, m.buy[100])
+	assert.Equal(t, []*Order{buy2, primary}, m.buy[104])
+	assert.Equal(t, 107, midpoint.Price)
+	assert.ElementsMatch(t, []PriceLevel{
+		{Price: 109, Quantity: 5, Orders: 1},
+		{Price: 104, Quantity: 10, Orders: 2},
+		{Price: 100, Quantity: 10, Orders: 1},
+	}, depth(m.buy))
+
+	// Once the sell side is empty the market and midpoint pegs are held
+	buy3 := newTestOrder(Buy, Limit, 10, 110, 0)
+	m.processOrder(buy3)
+	assert.Equal(t, Completed, sell1.Status)
+	assert.Equal(t, 0, market.Price)
+	assert.Equal(t, 0, midpoint.Price)
+	assert.NotContains(t, m.buy, 109)
+}
+
+func Test_Matcher_PeggedOrders_Reprice(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	// A peg is priced where nothing is on the other side, the arrival-only
+	// instructions are not checked when it is priced or repriced
+	m.processOrder(newTestOrder(Buy, Limit, 10, 100, 0))
+	peg := newTestPeg(Buy, 5, PegPrimary, 0, 0)
+	peg.MinQuantity = 5
+	m.processOrder(peg)
+	assert.Equal(t, Placed, peg.Status)
+	assert.Equal(t, 100, peg.Price)
+
+	events := make(chan Event, 10)
+	m.events = events
+	m.processOrder(newTestOrder(Buy, Limit, 10, 101, 0))
+	assert.Equal(t, Placed, peg.Status)
+	assert.Equal(t, []*Order{peg}, m.buy[101][1:])
+	assert.Empty(t, complete)
+
+	// The repriced event carries the new price
+	close(events)
+	var repriced []Event
+	for e := range events {
+		if e.OrderId == peg.Id {
+			repriced = append(repriced, e)
+		}
+	}
+	if assert.Len(t, repriced, 1) {
+		assert.Equal(t, EventRepriced, repriced[0].Type)
+		assert.Equal(t, 101, repriced[0].Price)
+		assert.Equal(t, "peg price 100 to 101", repriced[0].Cause)
+	}
+}
+
+func newTestGroup(gt GroupType, orders ...*Order) *Group {
+	g := &Group{Id: uuid.New(), Type: gt, Orders: orders}
+	for _, o := range orders {
+		o.GroupId = g.Id
+	}
+	if gt == Bracket {
+		for _, c := range orders[1:] {
+			c.ParentId = orders[0].Id
+		}
+	}
+	return g
+}
+
+func Test_Matcher_OCOGroup(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	profit := newTestOrder(Sell, Limit, 10, 110, 0)
+	loss := newTestOrder(Sell, Stop, 10, 0, 95)
+	m.processGroup(newTestGroup(OCO, profit, loss))
+	assert.Equal(t, []*Order{profit}, m.sell[110])
+	assert.Equal(t, []*Order{loss}, m.stops)
+
+	// Filling the take-profit cancels the stop-loss
+	m.processOrder(newTestOrder(Buy, Limit, 4, 110, 0))
+	assert.Equal(t, Cancelled, loss.Status)
+	assert.Empty(t, m.stops)
+	assert.Equal(t, 6, profit.Quantity)
+	assert.Equal(t, Placed, profit.Status)
+}
+
+func Test_Matcher_BracketGroup(t *testing.T) {
+	complete := make(chan *Order, 10)
+	m := newTestMatcher(complete)
+
+	parent := newTestOrder(Buy, Limit, 10, 100, 0)
+	profit := newTestOrder(Sell, Limit, 10, 110, 0)
+	loss := newTestOrder(Sell, Stop, 10, 0, 95)
+	g := newTestGroup(Bracket, parent, profit, loss)
+	assert.NoError(t, g.validate())
+	m.processGroup(g)
+	assert.ElementsMatch(t, []*Order{profit, loss}, m.waitingChildren())
+	assert.Empty(t, m.sell)
+	assert.Empty(t, m.stops)
+
+	// The children work once the parent fills
+	m.processOrder(newTestOrder(Sell, Limit, 10, 100, 0))
+	assert.Equal(t, Completed, parent.Status)
+	assert.Empty(t, m.waitingChildren())
+	assert.Equal(t, []*Order{profit}, m.sell[110])
+	assert.Equal(t, []*Order{loss}, m.stops)
+
+	// A trade at 95 triggers the stop-loss, which cancels the take-profit
+	m.processOrder(newTestOrder(Buy, Limit, 1, 95, 0))
+	m.processOrder(newTestOrder(Sell, Limit, 1, 95, 0))
+	assert.True(t, loss.Triggered)
+	assert.Equal(t, Cancelled, profit.Status)
+	assert.NotContains(t, m.sell, 110)
+	assert.Equal(t, []*Order{loss}, m.sell[95])
+
+	// A parent that times out unfilled cancels its children
+	parent = newTestOrder(Buy, Limit, 10, 100, 0)
+	parent.OrderTime = time.Now().Add(-time.Minute)
+	profit = newTestOrder(Sell, Limit, 10, 110, 0)
+	m.processGroup(newTestGroup(Bracket, parent, profit))
+	m.cleanTimedoutOrders(Buy)
+	m.settle()
+	assert.Equal(t, TimedOut, parent.Status)
+	assert.Equal(t, Cancelled, profit.Status)
+	assert.Empty(t, m.waitingChildren())
+}
+
+func Test_Group_Validate(t *testing.T) {
+	buy := newTestOrder(Buy, Limit, 10, 100, 0)
+	sell := newTestOrder(Sell, Limit, 10, 110, 0)
+	assert.Error(t, (&Group{Type: OCO, Orders: []*Order{buy}}).validate())
+	assert.Error(t, (&Group{Type: Bracket, Orders: []*Order{buy, buy}}).validate())
+	assert.Error(t, (&Group{Orders: []*Order{buy, sell}}).validate())
+	assert.NoError(t, (&Group{Type: Bracket, Orders: []*Order{buy, sell}}).validate())
+}
@@ -0,0 +1,109 @@
+package matcher
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metrics of the matcher. They are updated on the matcher goroutine and read
+// by the scrapes without going through it.
+type metrics struct {
+	received   *prometheus.CounterVec
+	rejected   *prometheus.CounterVec
+	filled     *prometheus.CounterVec
+	expired    *prometheus.CounterVec
+	cancelled  *prometheus.CounterVec
+	fillTime   prometheus.Histogram
+	bookLevels *prometheus.GaugeVec
+	bookQty    *prometheus.GaugeVec
+	openOrders prometheus.Gauge
+	lag        prometheus.Histogram
+}
+
+func newMetrics() *metrics {
+	orders := func(name, help string) *prometheus.CounterVec {
+		return prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "trade_orders_" + name + "_total",
+			Help: help,
+		}, []string{"side", "type"})
+	}
+	return &metrics{
+		received:  orders("received", "Orders received by the matcher."),
+		rejected:  orders("rejected", "Orders rejected by the matcher."),
+		filled:    orders("filled", "Orders fully executed."),
+		expired:   orders("expired", "Orders timed out before they were executed."),
+		cancelled: orders("cancelled", "Orders cancelled by clients, groups or the shutdown."),
+		fillTime: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "trade_order_fill_seconds",
+			Help:    "Time from placing an order to its full execution.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 10),
+		}),
+		bookLevels: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "trade_book_levels",
+			Help: "Price levels on each side of the book.",
+		}, []string{"side"}),
+		bookQty: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "trade_book_quantity",
+			Help: "Quantity shown on each side of the book, without the hidden part of icebergs.",
+		}, []string{"side"}),
+		openOrders: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "trade_open_orders",
+			Help: "Working orders held by the matcher, on and off the book.",
+		}),
+		lag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "trade_matcher_lag_seconds",
+			Help:    "Time orders and groups wait in the queue for the matcher loop.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}),
+	}
+}
+
+// Collectors returns the metrics of the matcher to register
+func (m *matcherService) Collectors() []prometheus.Collector {
+	mt := m.metrics
+	return []prometheus.Collector{
+		mt.received, mt.rejected, mt.filled, mt.expired, mt.cancelled,
+		mt.fillTime, mt.bookLevels, mt.bookQty, mt.openOrders, mt.lag,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "trade_matcher_queue_depth",
+			Help: "Orders and groups waiting in the queue for the matcher.",
+		}, func() float64 { return float64(len(m.ingress)) }),
+	}
+}
+
+// observeClosed counts the order by the status it closed with
+func (m *matcherService) observeClosed(o *Order) {
+	side, ot := o.Transaction.String(), o.OrderType.String()
+	switch o.Status {
+	case Completed:
+		m.metrics.filled.WithLabelValues(side, ot).Inc()
+		m.metrics.fillTime.Observe(time.Since(o.OrderTime).Seconds())
+	case TimedOut:
+		m.metrics.expired.WithLabelValues(side, ot).Inc()
+	case Rejected:
+		m.metrics.rejected.WithLabelValues(side, ot).Inc()
+	case Cancelled:
+		m.metrics.cancelled.WithLabelValues(side, ot).Inc()
+	}
+}
+
+// observeBook sets the gauges of the book once an event is processed
+func (m *matcherService) observeBook() {
+	m.metrics.bookLevels.WithLabelValues(Buy.String()).Set(float64(len(m.buy)))
+	m.metrics.bookLevels.WithLabelValues(Sell.String()).Set(float64(len(m.sell)))
+	m.metrics.bookQty.WithLabelValues(Buy.String()).Set(float64(shown(m.buy)))
+	m.metrics.bookQty.WithLabelValues(Sell.String()).Set(float64(shown(m.sell)))
+	m.metrics.openOrders.Set(float64(len(m.live)))
+}
+
+// shown is the quantity shown on a side of the book, as its depth shows it
+func shown(oMap OrderMap) int {
+	qty := 0
+	for _, ol := range oMap {
+		for _, o := range ol {
+			qty += o.Displayed()
+		}
+	}
+	return qty
+}
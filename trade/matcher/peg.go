@@ -0,0 +1,167 @@
+package matcher
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PegReference enum, the price a pegged order follows
+type PegReference int
+
+const (
+	// PegPrimary follows the best price on the order's own side
+	PegPrimary PegReference = iota + 1
+	// PegMarket follows the best price on the opposite side
+	PegMarket
+	// PegMidpoint follows the midpoint of the best buy and sell prices
+	PegMidpoint
+)
+
+func (r PegReference) String() string {
+	switch r {
+	case PegPrimary:
+		return "primary"
+	case PegMarket:
+		return "market"
+	case PegMidpoint:
+		return "midpoint"
+	}
+	return "unknown"
+}
+
+// bestPrices returns the best buy and sell prices of the orders that are not
+// pegged, so that pegged orders never follow themselves. A price is 0 if the
+// side has no such order.
+func (m *matcherService) bestPrices() (bid, ask int) {
+	for p, ol := range m.buy {
+		if p > bid && hasUnpegged(ol) {
+			bid = p
+		}
+	}
+	for p, ol := range m.sell {
+		if (ask == 0 || p < ask) && hasUnpegged(ol) {
+			ask = p
+		}
+	}
+	return bid, ask
+}
+
+func hasUnpegged(ol []*Order) bool {
+	for _, o := range ol {
+		if o.OrderType != Pegged && !o.closed() {
+			return true
+		}
+	}
+	return false
+}
+
+// pegPrice returns the price of a pegged order from the best prices: the
+// reference plus the offset, capped at the peg limit. A buy is never priced
+// above its limit and a sell never below. The price is 0 when the reference
+// is not available.
+func pegPrice(o *Order, bid, ask int) int {
+	same, other := bid, ask
+	if o.Transaction == Sell {
+		same, other = ask, bid
+	}
+
+	var ref int
+	switch o.PegReference {
+	case PegPrimary:
+		ref = same
+	case PegMarket:
+		ref = other
+	case PegMidpoint:
+		if bid == 0 || ask == 0 {
+			return 0
+		}
+		// Round the midpoint away from the opposite side
+		ref = (bid + ask) / 2
+		if o.Transaction == Sell {
+			ref = (bid + ask + 1) / 2
+		}
+	}
+	if ref == 0 {
+		return 0
+	}
+
+	price := ref + o.PegOffset
+	if o.PegLimit > 0 {
+		if o.Transaction == Buy && price > o.PegLimit {
+			price = o.PegLimit
+		} else if o.Transaction == Sell && price < o.PegLimit {
+			price = o.PegLimit
+		}
+	}
+	if price <= 0 {
+		return 0
+	}
+	return price
+}
+
+// repricePegs moves the pegged orders whose reference price changed. Pegs
+// are repriced in their arrival order, and a repriced peg is matched at its
+// new price, resting at the back of the price level. It is priced where
+// nothing is on the other side, so it is not held to the arrival-only
+// instructions.
+// A peg whose price did not change keeps its place in the queue. A peg
+// without a reference price is held off the book until one is available.
+func (m *matcherService) repricePegs() {
+	live := m.pegs[:0]
+	for _, o := range m.pegs {
+		if !o.closed() {
+			live = append(live, o)
+		}
+	}
+	m.pegs = live
+
+	bid, ask := m.bestPrices()
+	for _, o := range append([]*Order(nil), m.pegs...) {
+		if o.closed() {
+			continue
+		}
+		price := pegPrice(o, bid, ask)
+		if price == o.Price {
+			continue
+		}
+
+		m.log.WithFields(logrus.Fields{
+			"OrderId":   o.Id.String()[:10],
+			"Reference": o.PegReference,
+			"OldPrice":  o.Price,
+			"NewPrice":  price,
+		}).Debug("Repriced pegged order")
+
+		if o.Price != 0 {
+			m.unrest(o)
+		}
+		old := o.Price
+		o.Price = price
+		m.record(o, EventRepriced, fmt.Sprintf("peg price %d to %d", old, price))
+		if price != 0 {
+			m.matchOrder(o, false)
+		}
+	}
+}
+
+func (m *matcherService) cleanTimedoutPegs() {
+	for _, o := range m.pegs {
+		// Pegs on the book time out with the buy and sell maps
+		if o.Price != 0 || o.closed() {
+			continue
+		}
+		if int(time.Since(o.OrderTime).Seconds()) > m.oTimeout {
+			m.log.WithFields(logrus.Fields{
+				"Id":          o.Id.String()[:10],
+				"Transaction": o.Transaction,
+				"OrderTime":   o.OrderTime.Format(time.UnixDate),
+			}).Debug("TimedOut Pegged Order")
+
+			o.Status = TimedOut
+			m.record(o, EventExpired, fmt.Sprintf("timed out after %ds", m.oTimeout))
+			m.send(o)
+		}
+	}
+}
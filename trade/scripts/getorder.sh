@@ -1,3 +1,3 @@
 #!/bin/bash
 
-curl -XGET http://localhost:8000/orders -H 'Content-Type: application/json'
+curl -XGET http://localhost:8000/v1/orders -H 'Content-Type: application/json'
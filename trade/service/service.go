@@ -1,31 +1,304 @@
 package service
 
 import (
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/nbasker/tools/trade/algo"
 	"github.com/nbasker/tools/trade/api"
+	"github.com/nbasker/tools/trade/config"
 	"github.com/nbasker/tools/trade/matcher"
 	"github.com/nbasker/tools/trade/store"
 
 	"github.com/sirupsen/logrus"
 )
 
-// Start the service.
-func Start(srvEp string, oTimeout int) {
+// Start the service with the config returned by load. It runs until SIGINT
+// or SIGTERM, then shuts down within the shutdown timeout and returns an
+// error if it could not do so cleanly. On SIGHUP the config is loaded again
+// and its reloadable settings are applied.
+func Start(load func() (config.Config, error)) error {
 	log := logrus.New()
 	log.Out = os.Stdout
 
+	cfg, err := loadValid(load)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to load config")
+		return err
+	}
+	level, _ := logrus.ParseLevel(cfg.Service.LogLevel)
+	log.SetLevel(level)
+
 	log.Debug("service.Start()")
 
-	orders := make(chan *matcher.Order)
-	complete := make(chan *matcher.Order)
+	var keys []api.ApiKey
+	if cfg.Service.ApiKeys != "" {
+		if keys, err = api.LoadKeys(cfg.Service.ApiKeys); err != nil {
+			log.WithFields(logrus.Fields{
+				"Error": err.Error(),
+			}).Error("Unable to load API keys")
+			return err
+		}
+	}
+
+	onStop := matcher.PersistResting
+	if cfg.Shutdown.Resting == "cancel" {
+		onStop = matcher.CancelResting
+	}
+	orders := make(chan *matcher.Order, cfg.Matcher.OrderBuffer)
+	complete := make(chan *matcher.Order, cfg.Matcher.CompleteBuffer)
+	events := make(chan matcher.Event, cfg.Matcher.CompleteBuffer)
+
+	store, err := newStore(cfg, complete, events, log)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to open store")
+		return err
+	}
+	defer store.Close()
+	stored := make(chan struct{})
+	go func() {
+		store.StoreCompletedOrders()
+		close(stored)
+	}()
+
+	retainCtx, stopRetain := context.WithCancel(context.Background())
+	defer stopRetain()
+	retained := make(chan struct{})
+	if store, err = retain(retainCtx, cfg, store, retained, log); err != nil {
+		log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to open archive")
+		return err
+	}
+
+	matchCtx, stopMatch := context.WithCancel(context.Background())
+	defer stopMatch()
+	match := matcher.NewMatcherService(orders, complete, events, int(cfg.Matcher.OrderTimeout/time.Second),
+		cfg.Matcher.CleanInterval, cfg.Matcher.QueueDepth, onStop, log)
+	matched := make(chan struct{})
+	go func() {
+		match.ExecuteOrders(matchCtx)
+		close(matched)
+	}()
+
+	algoCtx, stopAlgos := context.WithCancel(context.Background())
+	defer stopAlgos()
+	algos := algo.NewAlgoService(match, time.Second, log)
+	scheduled := make(chan struct{})
+	go func() {
+		algos.RunSchedules(algoCtx)
+		close(scheduled)
+	}()
 
-	store := store.NewStorageService(complete, log)
-	go store.StoreCompletedOrders()
+	serve := api.NewApiService(cfg.Service.Endpoint, cfg.Service.Symbol, cfg.Api.AckTimeout,
+		cfg.Api.IdempotencyWindow, cfg.Api.HeartbeatInterval, match, algos, store, limitsOf(cfg), keys, log)
+	served := make(chan error, 1)
+	go func() {
+		served <- serve.Run()
+	}()
+
+	sigs, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stopSignals()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var runErr error
+	for running := true; running; {
+		select {
+		case <-hup:
+			cfg = reload(cfg, load, match, serve, log)
+		case <-sigs.Done():
+			log.Info("Shutting down")
+			running = false
+		case runErr = <-served:
+			log.WithFields(logrus.Fields{
+				"Error": runErr.Error(),
+			}).Error("REST Api Service failed, shutting down")
+			running = false
+		}
+	}
+
+	// Each stage stops the senders of the next one: the api and the algos
+	// send orders to the matcher, which sends them to the store.
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Shutdown.Timeout)
+	defer cancel()
+	if err := serve.Shutdown(ctx); err != nil {
+		log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to stop REST Api Service")
+		runErr = err
+	}
+	for _, stage := range []struct {
+		name string
+		stop func()
+		done <-chan struct{}
+	}{
+		{"algo schedules", stopAlgos, scheduled},
+		{"archive", stopRetain, retained},
+		{"matcher", stopMatch, matched},
+		{"store", func() {}, stored},
+	} {
+		stage.stop()
+		select {
+		case <-stage.done:
+		case <-ctx.Done():
+			log.WithFields(logrus.Fields{
+				"Stage": stage.name,
+			}).Error("Shutdown timed out")
+			return errors.New("shutdown timed out stopping the " + stage.name)
+		}
+	}
+	log.Info("Shut down")
+	return runErr
+}
+
+// newStore returns the store of the backend of the config, writing to the
+// audit log of the config if it has one
+func newStore(cfg config.Config, complete <-chan *matcher.Order, events <-chan matcher.Event,
+	log *logrus.Logger) (store.Store, error) {
+	var audit *store.AuditLog
+	if cfg.Audit.Log != "" {
+		key, err := store.LoadAuditPrivateKey(cfg.Audit.PrivateKey)
+		if err != nil {
+			return nil, err
+		}
+		audit, err = store.OpenAuditLog(cfg.Audit.Log, cfg.Audit.Checkpoints, key,
+			cfg.Audit.CheckpointInterval, log)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Store.Backend == "bolt" {
+		s, err := store.NewBoltStore(cfg.Store.Path, complete, events, audit, log)
+		if err != nil {
+			audit.Close()
+		}
+		return s, err
+	}
+	return store.NewStorageService(complete, events, audit, log), nil
+}
+
+// retain moves the orders past the retention of the config from the store
+// to the archive until ctx is done, then closes done. It returns the store
+// whose queries also read the archive, or the store itself and closes done
+// at once without a retention.
+func retain(ctx context.Context, cfg config.Config, s store.Store, done chan<- struct{},
+	log *logrus.Logger) (store.Store, error) {
+	if cfg.Store.RetentionDays == 0 {
+		close(done)
+		return s, nil
+	}
+	archive, err := store.NewArchive(cfg.Store.ArchiveDir, log)
+	if err != nil {
+		close(done)
+		return s, err
+	}
+	go func() {
+		archive.RunRetention(ctx, s, cfg.Store.RetentionDays, cfg.Store.ArchiveInterval)
+		close(done)
+	}()
+	return store.NewArchivedStore(s, archive, log), nil
+}
+
+// VerifyAudit walks the audit log of the config returned by load and checks
+// its hash chain and signed checkpoints, returning the first broken link.
+// Only the audit settings are used, so the config of a verifier needs no
+// private key.
+func VerifyAudit(load func() (config.Config, error)) error {
+	log := logrus.New()
+	log.Out = os.Stdout
+
+	cfg, err := load()
+	var key ed25519.PublicKey
+	switch {
+	case err != nil:
+	case cfg.Audit.Log == "":
+		err = errors.New("no audit log is configured")
+	case cfg.Audit.PublicKey == "":
+		err = errors.New("no audit.public_key is configured")
+	default:
+		key, err = store.LoadAuditPublicKey(cfg.Audit.PublicKey)
+	}
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to load config")
+		return err
+	}
+	report, err := store.VerifyAuditLog(cfg.Audit.Log, cfg.Audit.Checkpoints, key)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"Log":     cfg.Audit.Log,
+			"Records": report.Records,
+			"Error":   err.Error(),
+		}).Error("Audit log is broken")
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"Log":         cfg.Audit.Log,
+		"Records":     report.Records,
+		"Checkpoints": report.Checkpoints,
+		"Hash":        report.Hash,
+	}).Info("Audit log verified")
+	return nil
+}
+
+// loadValid loads the config and validates it
+func loadValid(load func() (config.Config, error)) (config.Config, error) {
+	cfg, err := load()
+	if err != nil {
+		return config.Config{}, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return config.Config{}, err
+	}
+	return cfg, nil
+}
+
+func limitsOf(cfg config.Config) api.Limits {
+	return api.Limits{Rate: cfg.Api.RateLimit, Burst: cfg.Api.RateBurst}
+}
 
-	match := matcher.NewMatcherService(orders, complete, oTimeout, log)
-	go match.ExecuteOrders()
+// reload loads the config again and applies its reloadable settings to the
+// running service, returning the config it runs with. An invalid config is
+// not applied at all.
+func reload(cfg config.Config, load func() (config.Config, error),
+	match matcher.Matcher, serve api.Api, log *logrus.Logger) config.Config {
+	next, err := loadValid(load)
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Config not reloaded")
+		return cfg
+	}
+	cfg, restart := cfg.Reload(next)
+	for _, setting := range restart {
+		log.WithFields(logrus.Fields{
+			"Setting": setting,
+		}).Warn("Setting changes on restart")
+	}
 
-	serve := api.NewApiService(srvEp, orders, store, log)
-	serve.Run()
+	level, _ := logrus.ParseLevel(cfg.Service.LogLevel)
+	log.SetLevel(level)
+	match.SetTimeouts(int(cfg.Matcher.OrderTimeout/time.Second), cfg.Matcher.CleanInterval)
+	serve.Configure(cfg.Api.AckTimeout, limitsOf(cfg))
+	log.WithFields(logrus.Fields{
+		"LogLevel":      cfg.Service.LogLevel,
+		"OrderTimeout":  cfg.Matcher.OrderTimeout,
+		"CleanInterval": cfg.Matcher.CleanInterval,
+		"AckTimeout":    cfg.Api.AckTimeout,
+		"RateLimit":     cfg.Api.RateLimit,
+		"RateBurst":     cfg.Api.RateBurst,
+	}).Info("Config reloaded")
+	return cfg
 }
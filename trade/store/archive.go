@@ -0,0 +1,415 @@
+package store
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// dayLayout names the archive file of a day
+const dayLayout = "2006-01-02"
+
+// ArchivedOrder is a line of an archive file, an order with its history
+type ArchivedOrder struct {
+	matcher.Order
+	Events []matcher.Event `json:"events,omitempty"`
+}
+
+// indexFile is the file of the archive that lists the day of each archived
+// order, a line of its id and day each
+const indexFile = "index"
+
+// Archive keeps the orders of past days in a directory of gzip compressed
+// NDJSON files, one per UTC day of OrderTime, and an index of the day of
+// each order to find it by id. It is safe for concurrent use.
+type Archive struct {
+	dir string
+	log *logrus.Logger
+
+	mu    sync.RWMutex
+	index map[uuid.UUID]time.Time
+}
+
+// NewArchive returns the archive in dir, creating the directory if needed.
+// The index is read, or built from the archive files if it is missing.
+func NewArchive(dir string, log *logrus.Logger) (*Archive, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	a := &Archive{dir: dir, log: log, index: make(map[uuid.UUID]time.Time)}
+	if err := a.loadIndex(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadIndex reads the index, or builds it from the archive files and
+// writes it if it is missing
+func (a *Archive) loadIndex() error {
+	path := filepath.Join(a.dir, indexFile)
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		days, err := a.Days()
+		if err != nil {
+			return err
+		}
+		for _, d := range days {
+			orders, err := a.read(d)
+			if err != nil {
+				return err
+			}
+			if err := a.writeIndex(d, orders); err != nil {
+				return err
+			}
+		}
+		// An empty archive still gets its index, so that it is not built
+		// again
+		return a.writeIndex(time.Time{}, nil)
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	sc := bufio.NewScanner(f)
+	for line := 1; sc.Scan(); line++ {
+		var id, date string
+		if _, err := fmt.Sscan(sc.Text(), &id, &date); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		uid, err := uuid.Parse(id)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		d, err := time.Parse(dayLayout, date)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		a.index[uid] = d
+	}
+	return sc.Err()
+}
+
+// writeIndex appends the day of the orders to the index
+func (a *Archive) writeIndex(d time.Time, orders []ArchivedOrder) error {
+	f, err := os.OpenFile(filepath.Join(a.dir, indexFile), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+	for i := range orders {
+		fmt.Fprintf(w, "%s %s\n", orders[i].Id, d.Format(dayLayout))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	for i := range orders {
+		a.index[orders[i].Id] = d
+	}
+	return nil
+}
+
+// day is the start of the UTC day of t
+func day(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+func (a *Archive) path(d time.Time) string {
+	return filepath.Join(a.dir, "orders-"+d.Format(dayLayout)+".ndjson.gz")
+}
+
+// Days returns the archived days, oldest first
+func (a *Archive) Days() ([]time.Time, error) {
+	paths, err := filepath.Glob(filepath.Join(a.dir, "orders-*.ndjson.gz"))
+	if err != nil {
+		return nil, err
+	}
+	var days []time.Time
+	for _, p := range paths {
+		name := filepath.Base(p)
+		d, err := time.Parse(dayLayout, name[len("orders-"):len(name)-len(".ndjson.gz")])
+		if err != nil {
+			continue
+		}
+		days = append(days, d)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+	return days, nil
+}
+
+// write appends the orders of a day to its file as a new gzip member, which
+// is read as if the file were compressed at once, and then to the index
+func (a *Archive) write(d time.Time, orders []ArchivedOrder) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	f, err := os.OpenFile(a.path(d), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	enc := json.NewEncoder(zw)
+	for i := range orders {
+		if err := enc.Encode(&orders[i]); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return a.writeIndex(d, orders)
+}
+
+// read returns the orders of a day, the last line of an order replacing the
+// ones before it. A day that is not archived has none.
+func (a *Archive) read(d time.Time) ([]ArchivedOrder, error) {
+	f, err := os.Open(a.path(d))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(bufio.NewReader(f))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", a.path(d), err)
+	}
+	var orders []ArchivedOrder
+	seen := make(map[uuid.UUID]int)
+	dec := json.NewDecoder(zr)
+	for dec.More() {
+		var o ArchivedOrder
+		if err := dec.Decode(&o); err != nil {
+			return nil, fmt.Errorf("%s: %w", a.path(d), err)
+		}
+		if i, ok := seen[o.Id]; ok {
+			orders[i] = o
+			continue
+		}
+		seen[o.Id] = len(orders)
+		orders = append(orders, o)
+	}
+	return orders, nil
+}
+
+// Orders returns the archived orders that pass the query after its cursor,
+// unsorted. Only the days of its time range from the day of the cursor are
+// read, from the oldest archived day if the range has no start, and none if
+// the query has no time range. Reading stops at the end of the day that has
+// more orders than the limit of the query, as the orders of later days sort
+// after them.
+func (a *Archive) Orders(q Query) ([]matcher.Order, error) {
+	if q.From.IsZero() && q.To.IsZero() {
+		return nil, nil
+	}
+	days, err := a.Days()
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	var orders []matcher.Order
+	for _, d := range days {
+		if (!q.From.IsZero() && d.Before(day(q.From))) || (!q.To.IsZero() && !d.Before(q.To)) ||
+			(q.After != nil && d.Before(day(q.After.OrderTime))) {
+			continue
+		}
+		archived, err := a.read(d)
+		if err != nil {
+			return nil, err
+		}
+		for i := range archived {
+			o := &archived[i].Order
+			if q.Match(o) && (q.After == nil || q.After.precedes(o)) {
+				orders = append(orders, *o)
+			}
+		}
+		if q.Limit > 0 && len(orders) > q.Limit {
+			break
+		}
+	}
+	return orders, nil
+}
+
+// Order returns the archived order with its history, from the file of the
+// day the index gives
+func (a *Archive) Order(id uuid.UUID) (ArchivedOrder, bool, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	d, ok := a.index[id]
+	if !ok {
+		return ArchivedOrder{}, false, nil
+	}
+	orders, err := a.read(d)
+	if err != nil {
+		return ArchivedOrder{}, false, err
+	}
+	for _, o := range orders {
+		if o.Id == id {
+			return o, true, nil
+		}
+	}
+	return ArchivedOrder{}, false, nil
+}
+
+// Retain moves the orders placed before the start of the UTC day the given
+// number of days before now from the store to the archive, with their
+// histories, and returns how many were moved. The orders are removed from
+// the store once their days are written, so that an order is always in one
+// of them.
+func (a *Archive) Retain(s Store, days int, now time.Time) (int, error) {
+	cutoff := day(now).AddDate(0, 0, -days)
+	moved := 0
+	for {
+		orders, more := s.Orders(Query{To: cutoff, Limit: maxBatch})
+		if len(orders) == 0 {
+			return moved, nil
+		}
+		byDay := make(map[time.Time][]ArchivedOrder)
+		ids := make([]uuid.UUID, 0, len(orders))
+		for _, o := range orders {
+			d := day(o.OrderTime)
+			byDay[d] = append(byDay[d], ArchivedOrder{Order: o, Events: s.History(o.Id)})
+			ids = append(ids, o.Id)
+		}
+		for d, archived := range byDay {
+			if err := a.write(d, archived); err != nil {
+				return moved, err
+			}
+		}
+		if err := s.Delete(ids); err != nil {
+			return moved, err
+		}
+		moved += len(ids)
+		if more == nil {
+			return moved, nil
+		}
+	}
+}
+
+// RunRetention moves the orders past the retention from the store to the
+// archive once every interval, until ctx is done
+func (a *Archive) RunRetention(ctx context.Context, s Store, days int, interval time.Duration) {
+	a.log.WithFields(logrus.Fields{
+		"Days":     days,
+		"Interval": interval,
+	}).Info("Starting to archive orders")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		n, err := a.Retain(s, days, time.Now())
+		if err != nil {
+			a.log.WithFields(logrus.Fields{
+				"Error": err.Error(),
+			}).Error("Unable to archive orders")
+		} else if n > 0 {
+			a.log.WithFields(logrus.Fields{
+				"Orders": n,
+			}).Info("Archived orders")
+		}
+		select {
+		case <-ctx.Done():
+			a.log.Info("Stopped archiving orders")
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// archivedStore is a store whose queries with a time range also read the
+// archived days of the range, and that finds the archived orders by id
+type archivedStore struct {
+	Store
+	archive *Archive
+	log     *logrus.Logger
+}
+
+// NewArchivedStore returns the store s, whose queries also read the days of
+// their time range that were moved to the archive, and whose orders and
+// histories are looked up in the archive when they are not stored
+func NewArchivedStore(s Store, archive *Archive, log *logrus.Logger) Store {
+	return &archivedStore{Store: s, archive: archive, log: log}
+}
+
+// Orders merges the archived orders of the time range with a page of the
+// stored ones. An order still stored replaces its archived copy.
+func (s *archivedStore) Orders(q Query) ([]matcher.Order, *Cursor) {
+	archived, err := s.archive.Orders(q)
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to read archive")
+	}
+	if len(archived) == 0 {
+		return s.Store.Orders(q)
+	}
+
+	stored, more := s.Store.Orders(q)
+	ids := make(map[uuid.UUID]bool, len(stored))
+	for _, o := range stored {
+		ids[o.Id] = true
+	}
+	orders := stored
+	for _, o := range archived {
+		if !ids[o.Id] {
+			orders = append(orders, o)
+		}
+	}
+	page, next := Page(orders, q)
+	// The stored orders after the page were not read, but are there
+	if next == nil && more != nil && len(page) > 0 {
+		next = CursorOf(&page[len(page)-1])
+	}
+	return page, next
+}
+
+// archived returns the order from the archive
+func (s *archivedStore) archived(id uuid.UUID) (ArchivedOrder, bool) {
+	o, ok, err := s.archive.Order(id)
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"OrderId": id.String(),
+			"Error":   err.Error(),
+		}).Error("Unable to read archive")
+	}
+	return o, ok
+}
+
+// Order returns the stored order, or the archived one
+func (s *archivedStore) Order(id uuid.UUID) (matcher.Order, bool) {
+	if o, ok := s.Store.Order(id); ok {
+		return o, true
+	}
+	o, ok := s.archived(id)
+	return o.Order, ok
+}
+
+// History returns the events of the stored order, or of the archived one
+func (s *archivedStore) History(id uuid.UUID) []matcher.Event {
+	if events := s.Store.History(id); len(events) > 0 {
+		return events
+	}
+	o, _ := s.archived(id)
+	return o.Events
+}
@@ -0,0 +1,460 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// The kinds of the records of the audit log
+const (
+	auditOrder = "order"
+	auditEvent = "event"
+)
+
+// genesis is the previous hash of the first record
+var genesis = make([]byte, sha256.Size)
+
+// AuditRecord is a line of the audit log: an order or an event written to
+// the store, chained to the record before it by its hash
+type AuditRecord struct {
+	Seq  uint64          `json:"seq"`
+	Time time.Time       `json:"time"`
+	Kind string          `json:"kind"`
+	Data json.RawMessage `json:"data"`
+	Prev string          `json:"prev"`
+	Hash string          `json:"hash"`
+}
+
+// hash is the SHA-256 of the previous hash and of the fields of the record,
+// so that changing, removing or reordering a record breaks every link after
+// it
+func (r *AuditRecord) hash(prev []byte) []byte {
+	h := sha256.New()
+	h.Write(prev)
+	var n [16]byte
+	binary.BigEndian.PutUint64(n[:8], r.Seq)
+	binary.BigEndian.PutUint64(n[8:], uint64(r.Time.UnixNano()))
+	h.Write(n[:])
+	h.Write([]byte(r.Kind))
+	h.Write([]byte{0})
+	h.Write(r.Data)
+	return h.Sum(nil)
+}
+
+// Checkpoint is a line of the checkpoint file: the hash of the log at a
+// record, signed with the ed25519 private key of the writer. A log whose
+// records were all hashed again after a change does not match the signed
+// hashes, and a truncated log ends before the last checkpoint. The
+// signatures are verified with the public key, so a verifier cannot sign.
+type Checkpoint struct {
+	Seq       uint64    `json:"seq"`
+	Hash      string    `json:"hash"`
+	Time      time.Time `json:"time"`
+	Signature string    `json:"signature"`
+}
+
+// message is what the signature of the checkpoint signs
+func (c *Checkpoint) message() []byte {
+	var n [16]byte
+	binary.BigEndian.PutUint64(n[:8], c.Seq)
+	binary.BigEndian.PutUint64(n[8:], uint64(c.Time.UnixNano()))
+	return append(n[:], c.Hash...)
+}
+
+// sign signs the checkpoint with the private key
+func (c *Checkpoint) sign(key ed25519.PrivateKey) {
+	c.Signature = hex.EncodeToString(ed25519.Sign(key, c.message()))
+}
+
+// verify reports if the checkpoint is signed with the private key of the
+// public key
+func (c *Checkpoint) verify(key ed25519.PublicKey) bool {
+	sig, err := hex.DecodeString(c.Signature)
+	return err == nil && ed25519.Verify(key, c.message(), sig)
+}
+
+// LoadAuditPrivateKey reads the ed25519 private key that signs the
+// checkpoints from a PEM file in PKCS #8, as written by
+// openssl genpkey -algorithm ed25519
+func LoadAuditPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := k.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 private key", path)
+	}
+	return key, nil
+}
+
+// LoadAuditPublicKey reads the ed25519 public key that verifies the
+// checkpoints from a PEM file in PKIX, as written by openssl pkey -pubout
+func LoadAuditPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	k, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	key, ok := k.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s: not an ed25519 public key", path)
+	}
+	return key, nil
+}
+
+// readPEM returns the bytes of the first PEM block of the file, which must
+// be of the type
+func readPEM(path, blockType string) ([]byte, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s: no PEM %s block", path, blockType)
+	}
+	return block.Bytes, nil
+}
+
+// BrokenLinkError is the first line of an audit log or of its checkpoints
+// that does not hold. A last line that is not ended by a newline is torn:
+// it was cut short while written, and the log is whole up to Offset.
+type BrokenLinkError struct {
+	File   string
+	Line   int
+	Reason string
+	Torn   bool
+	Offset int64
+}
+
+func (e *BrokenLinkError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Reason)
+}
+
+// AuditLog appends the orders and events written to the store to a hash
+// chained log file, and signs a checkpoint of the chain to a separate file
+// once every interval and when it is closed. It is written by the store
+// goroutine only.
+type AuditLog struct {
+	f        *os.File
+	w        *bufio.Writer
+	cp       *os.File
+	key      ed25519.PrivateKey
+	interval time.Duration
+
+	seq  uint64
+	last []byte
+
+	checkpointed  time.Time
+	checkpointSeq uint64
+}
+
+// OpenAuditLog opens the log at path to append to it, creating it if
+// needed, and the file of its checkpoints. The chain of an existing log is
+// verified first, so that it is not continued if it is broken. A torn last
+// record or checkpoint, cut short by a crash while it was written, is cut
+// off with a warning: a torn record was never signed.
+func OpenAuditLog(path, checkpoints string, key ed25519.PrivateKey, interval time.Duration,
+	log *logrus.Logger) (*AuditLog, error) {
+	l := &AuditLog{key: key, interval: interval, last: genesis, checkpointed: time.Now()}
+	if f, err := os.Open(path); err == nil {
+		err = walk(path, f, func(r *AuditRecord, hash []byte) error {
+			l.seq, l.last = r.Seq, hash
+			return nil
+		})
+		f.Close()
+		if err = cutTorn(err, log); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	l.checkpointSeq = l.seq
+	if b, err := ioutil.ReadFile(checkpoints); err == nil {
+		if err = cutTorn(tornLine(checkpoints, b), log); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	var err error
+	if l.f, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		return nil, err
+	}
+	if l.cp, err = os.OpenFile(checkpoints, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600); err != nil {
+		l.f.Close()
+		return nil, err
+	}
+	l.w = bufio.NewWriter(l.f)
+	return l, nil
+}
+
+// cutTorn truncates the file of a torn last line to the whole lines before
+// it, and returns any other error as it is
+func cutTorn(err error, log *logrus.Logger) error {
+	var broken *BrokenLinkError
+	if !errors.As(err, &broken) || !broken.Torn {
+		return err
+	}
+	log.WithFields(logrus.Fields{
+		"File":   broken.File,
+		"Line":   broken.Line,
+		"Offset": broken.Offset,
+	}).Warn("Cutting off a torn last line of the audit log")
+	return os.Truncate(broken.File, broken.Offset)
+}
+
+// tornLine returns a *BrokenLinkError if the last line of the file is not
+// ended by a newline
+func tornLine(path string, b []byte) error {
+	if len(b) == 0 || b[len(b)-1] == '\n' {
+		return nil
+	}
+	return &BrokenLinkError{File: path, Line: bytes.Count(b, []byte("\n")) + 1, Torn: true,
+		Offset: int64(bytes.LastIndexByte(b, '\n') + 1), Reason: "torn last line, not ended by a newline"}
+}
+
+// write appends the orders and then the events of the batch, and signs a
+// checkpoint if the interval has passed. It does nothing on a nil log.
+func (l *AuditLog) write(b batch) error {
+	if l == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	for _, o := range b.orders {
+		if err := l.append(now, auditOrder, o); err != nil {
+			return err
+		}
+	}
+	for _, e := range b.events {
+		if err := l.append(now, auditEvent, e); err != nil {
+			return err
+		}
+	}
+	if err := l.w.Flush(); err != nil {
+		return err
+	}
+	if time.Since(l.checkpointed) >= l.interval {
+		return l.checkpoint()
+	}
+	return nil
+}
+
+func (l *AuditLog) append(now time.Time, kind string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	r := AuditRecord{Seq: l.seq + 1, Time: now, Kind: kind, Data: data, Prev: hex.EncodeToString(l.last)}
+	hash := r.hash(l.last)
+	r.Hash = hex.EncodeToString(hash)
+	line, err := json.Marshal(&r)
+	if err != nil {
+		return err
+	}
+	if _, err := l.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	l.seq, l.last = r.Seq, hash
+	return nil
+}
+
+// checkpoint syncs the log and signs its last hash, unless nothing was
+// appended since the last checkpoint
+func (l *AuditLog) checkpoint() error {
+	l.checkpointed = time.Now()
+	if l.seq == l.checkpointSeq {
+		return nil
+	}
+	if err := l.f.Sync(); err != nil {
+		return err
+	}
+	c := Checkpoint{Seq: l.seq, Hash: hex.EncodeToString(l.last), Time: time.Now().UTC()}
+	c.sign(l.key)
+	line, err := json.Marshal(&c)
+	if err != nil {
+		return err
+	}
+	if _, err := l.cp.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	if err := l.cp.Sync(); err != nil {
+		return err
+	}
+	l.checkpointSeq = c.Seq
+	return nil
+}
+
+// Close flushes the log, signs a last checkpoint and closes the files
+func (l *AuditLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	err := l.w.Flush()
+	if err == nil {
+		err = l.checkpoint()
+	}
+	if cerr := l.cp.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := l.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// AuditReport is what a verification found
+type AuditReport struct {
+	Records     uint64 `json:"records"`
+	Checkpoints int    `json:"checkpoints"`
+	Hash        string `json:"hash"`
+}
+
+// VerifyAuditLog walks the log from its first record and checks that each
+// record follows the one before it, then that each checkpoint is signed
+// with the private key of the public key and matches the hash of the log at
+// its record. It returns a *BrokenLinkError for the first record or
+// checkpoint that does not hold.
+func VerifyAuditLog(path, checkpoints string, key ed25519.PublicKey) (AuditReport, error) {
+	var report AuditReport
+	signed, err := readCheckpoints(checkpoints, key)
+	if err != nil {
+		return report, err
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer f.Close()
+	next := 0
+	err = walk(path, f, func(r *AuditRecord, hash []byte) error {
+		report.Records = r.Seq
+		report.Hash = r.Hash
+		for ; next < len(signed) && signed[next].Seq == r.Seq; next++ {
+			if signed[next].Hash != r.Hash {
+				return &BrokenLinkError{File: checkpoints, Line: signed[next].line,
+					Reason: fmt.Sprintf("record %d has hash %s, not the signed %s", r.Seq, r.Hash, signed[next].Hash)}
+			}
+			report.Checkpoints++
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+	if next < len(signed) {
+		return report, &BrokenLinkError{File: checkpoints, Line: signed[next].line,
+			Reason: fmt.Sprintf("record %d is signed but the log ends at record %d", signed[next].Seq, report.Records)}
+	}
+	return report, nil
+}
+
+// walk reads the records of the log, checking that each follows the one
+// before it, and calls f with each record and its hash
+func walk(path string, rd io.Reader, f func(r *AuditRecord, hash []byte) error) error {
+	br := bufio.NewReader(rd)
+	prev := genesis
+	var offset int64
+	for line := 1; ; line++ {
+		b, err := br.ReadBytes('\n')
+		if err == io.EOF && len(b) > 0 {
+			return &BrokenLinkError{File: path, Line: line, Torn: true, Offset: offset,
+				Reason: "torn last line, not ended by a newline"}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		broken := func(format string, args ...interface{}) error {
+			return &BrokenLinkError{File: path, Line: line, Reason: fmt.Sprintf(format, args...)}
+		}
+		var r AuditRecord
+		if err := json.Unmarshal(b, &r); err != nil {
+			return broken("unreadable record: %v", err)
+		}
+		switch {
+		case r.Seq != uint64(line):
+			return broken("record %d where %d was expected", r.Seq, line)
+		case r.Prev != hex.EncodeToString(prev):
+			return broken("record %d does not link to the hash of record %d", r.Seq, line-1)
+		case r.Kind != auditOrder && r.Kind != auditEvent:
+			return broken("record %d is of unknown kind %q", r.Seq, r.Kind)
+		}
+		hash := r.hash(prev)
+		if r.Hash != hex.EncodeToString(hash) {
+			return broken("record %d does not match its hash", r.Seq)
+		}
+		if err := f(&r, hash); err != nil {
+			return err
+		}
+		prev = hash
+		offset += int64(len(b))
+	}
+}
+
+// signedCheckpoint is a checkpoint with the line it was read from
+type signedCheckpoint struct {
+	Checkpoint
+	line int
+}
+
+// readCheckpoints returns the checkpoints of the file, checking that each
+// is signed with the private key of the public key and follows the one
+// before it. A missing file has none.
+func readCheckpoints(path string, key ed25519.PublicKey) ([]signedCheckpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := tornLine(path, b); err != nil {
+		return nil, err
+	}
+	var signed []signedCheckpoint
+	for i, line := range bytes.Split(bytes.TrimSuffix(b, []byte("\n")), []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		c := signedCheckpoint{line: i + 1}
+		if err := json.Unmarshal(line, &c.Checkpoint); err != nil {
+			return nil, &BrokenLinkError{File: path, Line: c.line, Reason: fmt.Sprintf("unreadable checkpoint: %v", err)}
+		}
+		if !c.verify(key) {
+			return nil, &BrokenLinkError{File: path, Line: c.line, Reason: fmt.Sprintf("checkpoint of record %d is not signed with the key of the writer", c.Seq)}
+		}
+		if n := len(signed); n > 0 && c.Seq < signed[n-1].Seq {
+			return nil, &BrokenLinkError{File: path, Line: c.line, Reason: fmt.Sprintf("checkpoint of record %d after one of record %d", c.Seq, signed[n-1].Seq)}
+		}
+		signed = append(signed, c)
+	}
+	return signed, nil
+}
@@ -0,0 +1,410 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+var (
+	metaBucket   = []byte("meta")
+	versionKey   = []byte("version")
+	ordersBucket = []byte("orders")
+	eventsBucket = []byte("events")
+)
+
+// index is a bucket of keys that sort the orders by a prefix, then by
+// OrderTime and Id. The values are empty, the order is read by its id.
+type index struct {
+	bucket []byte
+	prefix func(o *matcher.Order) []byte
+}
+
+var (
+	byTime = index{[]byte("by_time"), func(*matcher.Order) []byte {
+		return nil
+	}}
+	byStatus = index{[]byte("by_status"), func(o *matcher.Order) []byte {
+		return []byte{byte(o.Status)}
+	}}
+	byAccount = index{[]byte("by_account"), func(o *matcher.Order) []byte {
+		return append([]byte(o.Account), 0)
+	}}
+	indexes = []index{byTime, byStatus, byAccount}
+)
+
+// timeKey encodes t so that the keys sort in time order, including the
+// times before 1970
+func timeKey(t time.Time) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(t.UnixNano())^(1<<63))
+	return b
+}
+
+func (ix index) key(o *matcher.Order) []byte {
+	k := append(ix.prefix(o), timeKey(o.OrderTime)...)
+	return append(k, o.Id[:]...)
+}
+
+// migrations bring the schema of a database file up to date, the one at
+// index i taking it from version i to i+1. A released migration is never
+// changed, a new one is appended.
+var migrations = []func(tx *bolt.Tx) error{
+	// 1: the orders by id, and indexed by time, status and account
+	func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{ordersBucket, byTime.bucket, byStatus.bucket, byAccount.bucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	// 2: the events of the orders, by order id and then sequence
+	func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(eventsBucket)
+		return err
+	},
+}
+
+// boltStore persists the closed orders in a bbolt database file, so that
+// they outlive the service. It is safe for concurrent use, bbolt allowing
+// reads while a transaction writes.
+type boltStore struct {
+	complete <-chan *matcher.Order
+	events   <-chan matcher.Event
+	audit    *AuditLog
+	log      *logrus.Logger
+	db       *bolt.DB
+}
+
+// NewBoltStore opens the database file at path, creating it if needed, and
+// migrates it to the schema of this version. The orders and events are also
+// written to the audit log once persisted, unless it is nil, which the store
+// closes.
+func NewBoltStore(
+	path string,
+	complete <-chan *matcher.Order,
+	events <-chan matcher.Event,
+	audit *AuditLog,
+	log *logrus.Logger,
+) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s := &boltStore{complete: complete, events: events, audit: audit, log: log, db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// migrate runs the migrations the database file has not had, in one
+// transaction
+func (s *boltStore) migrate() error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		meta, err := tx.CreateBucketIfNotExists(metaBucket)
+		if err != nil {
+			return err
+		}
+		var version uint64
+		if b := meta.Get(versionKey); b != nil {
+			version = binary.BigEndian.Uint64(b)
+		}
+		if version > uint64(len(migrations)) {
+			return fmt.Errorf("schema version %d is newer than %d", version, len(migrations))
+		}
+		for v := version; v < uint64(len(migrations)); v++ {
+			if err := migrations[v](tx); err != nil {
+				return fmt.Errorf("migration to version %d: %w", v+1, err)
+			}
+			s.log.WithFields(logrus.Fields{
+				"Version": v + 1,
+			}).Info("Migrated store")
+		}
+		b := make([]byte, 8)
+		binary.BigEndian.PutUint64(b, uint64(len(migrations)))
+		return meta.Put(versionKey, b)
+	})
+}
+
+// StoreCompletedOrders persists the executed and timed out orders and the
+// events of the orders, returning once the matcher has closed their
+// channels. The orders and events waiting on the channels are written
+// together.
+func (s *boltStore) StoreCompletedOrders() {
+	s.log.Info("Starting to collected completed orders and persist")
+	in := inbox{complete: s.complete, events: s.events}
+	for {
+		b, ok := in.next(maxBatch)
+		if !ok {
+			break
+		}
+		err := s.db.Update(func(tx *bolt.Tx) error {
+			for _, o := range b.orders {
+				if err := put(tx, o); err != nil {
+					return err
+				}
+			}
+			for _, e := range b.events {
+				if err := appendEvent(tx, e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			s.log.WithFields(logrus.Fields{
+				"Error":  err.Error(),
+				"Orders": len(b.orders),
+				"Events": len(b.events),
+			}).Error("Unable to persist orders")
+			continue
+		}
+		s.log.WithFields(logrus.Fields{
+			"Orders": len(b.orders),
+			"Events": len(b.events),
+		}).Debug("Persist")
+		if err := s.audit.write(b); err != nil {
+			s.log.WithFields(logrus.Fields{
+				"Error":  err.Error(),
+				"Orders": len(b.orders),
+				"Events": len(b.events),
+			}).Error("Unable to write audit log")
+		}
+	}
+	s.log.WithFields(logrus.Fields{
+		"Orders": s.Summary().Orders,
+	}).Info("Stopped collecting completed orders")
+}
+
+// put writes the order and its index keys, replacing an order stored with
+// its id
+func put(tx *bolt.Tx, o *matcher.Order) error {
+	orders := tx.Bucket(ordersBucket)
+	if b := orders.Get(o.Id[:]); b != nil {
+		var old matcher.Order
+		if err := json.Unmarshal(b, &old); err != nil {
+			return err
+		}
+		for _, ix := range indexes {
+			if err := tx.Bucket(ix.bucket).Delete(ix.key(&old)); err != nil {
+				return err
+			}
+		}
+	}
+	b, err := json.Marshal(o)
+	if err != nil {
+		return err
+	}
+	if err := orders.Put(o.Id[:], b); err != nil {
+		return err
+	}
+	for _, ix := range indexes {
+		if err := tx.Bucket(ix.bucket).Put(ix.key(o), []byte{}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendEvent writes the event after the other events of its order, keyed
+// by the order id and the next sequence of the bucket
+func appendEvent(tx *bolt.Tx, e matcher.Event) error {
+	events := tx.Bucket(eventsBucket)
+	seq, err := events.NextSequence()
+	if err != nil {
+		return err
+	}
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	k := make([]byte, len(e.OrderId)+8)
+	copy(k, e.OrderId[:])
+	binary.BigEndian.PutUint64(k[len(e.OrderId):], seq)
+	return events.Put(k, b)
+}
+
+// Order returns the stored order
+func (s *boltStore) Order(id uuid.UUID) (matcher.Order, bool) {
+	var o matcher.Order
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(ordersBucket).Get(id[:])
+		if b == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(b, &o)
+	})
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"OrderId": id.String(),
+			"Error":   err.Error(),
+		}).Error("Unable to read order")
+		return matcher.Order{}, false
+	}
+	return o, found
+}
+
+// Orders returns a page of the stored orders. The orders are read from the
+// index of the account if the query names one, else of the status if it
+// names one, else of the time, starting at the later of the cursor and the
+// start of the time range and ending with the time range.
+func (s *boltStore) Orders(q Query) ([]matcher.Order, *Cursor) {
+	ix, prefix := byTime, []byte(nil)
+	switch {
+	case q.Account != "":
+		ix, prefix = byAccount, byAccount.prefix(&matcher.Order{Account: q.Account})
+	case q.Status != 0:
+		ix, prefix = byStatus, byStatus.prefix(&matcher.Order{Status: q.Status})
+	}
+	start := prefix
+	if !q.From.IsZero() {
+		start = append(append([]byte(nil), prefix...), timeKey(q.From)...)
+	}
+	var after []byte
+	if q.After != nil {
+		after = ix.key(&matcher.Order{Account: q.Account, Status: q.Status, OrderTime: q.After.OrderTime, Id: q.After.Id})
+		if bytes.Compare(after, start) > 0 {
+			start = after
+		}
+	}
+	var end []byte
+	if !q.To.IsZero() {
+		end = timeKey(q.To)
+	}
+
+	orders := []matcher.Order{}
+	var next *Cursor
+	err := s.db.View(func(tx *bolt.Tx) error {
+		stored := tx.Bucket(ordersBucket)
+		c := tx.Bucket(ix.bucket).Cursor()
+		for k, _ := c.Seek(start); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+			if after != nil && bytes.Equal(k, after) {
+				continue
+			}
+			k = k[len(prefix):]
+			if end != nil && bytes.Compare(k[:8], end) >= 0 {
+				break
+			}
+			var o matcher.Order
+			if err := json.Unmarshal(stored.Get(k[8:]), &o); err != nil {
+				return err
+			}
+			if !q.Match(&o) {
+				continue
+			}
+			if len(orders) == q.Limit && q.Limit > 0 {
+				next = CursorOf(&orders[len(orders)-1])
+				return nil
+			}
+			orders = append(orders, o)
+		}
+		return nil
+	})
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to read orders")
+	}
+	return orders, next
+}
+
+// History returns the events of the order, in the order they were written
+func (s *boltStore) History(id uuid.UUID) []matcher.Event {
+	var events []matcher.Event
+	err := s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(eventsBucket).Cursor()
+		for k, v := c.Seek(id[:]); k != nil && bytes.HasPrefix(k, id[:]); k, v = c.Next() {
+			var e matcher.Event
+			if err := json.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			events = append(events, e)
+		}
+		return nil
+	})
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"OrderId": id.String(),
+			"Error":   err.Error(),
+		}).Error("Unable to read history")
+	}
+	return events
+}
+
+// Delete removes the orders with their index keys and their events
+func (s *boltStore) Delete(ids []uuid.UUID) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		orders := tx.Bucket(ordersBucket)
+		for _, id := range ids {
+			if b := orders.Get(id[:]); b != nil {
+				var o matcher.Order
+				if err := json.Unmarshal(b, &o); err != nil {
+					return err
+				}
+				for _, ix := range indexes {
+					if err := tx.Bucket(ix.bucket).Delete(ix.key(&o)); err != nil {
+						return err
+					}
+				}
+				if err := orders.Delete(id[:]); err != nil {
+					return err
+				}
+			}
+			c := tx.Bucket(eventsBucket).Cursor()
+			for k, _ := c.Seek(id[:]); k != nil && bytes.HasPrefix(k, id[:]); k, _ = c.Seek(id[:]) {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"Orders": len(ids),
+			"Error":  err.Error(),
+		}).Error("Unable to delete orders")
+	}
+	return err
+}
+
+// Summary counts the stored orders by status from the keys of the status
+// index
+func (s *boltStore) Summary() Summary {
+	sum := Summary{ByStatus: make(map[string]int)}
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(byStatus.bucket).ForEach(func(k, _ []byte) error {
+			sum.Orders++
+			sum.ByStatus[matcher.Status(k[0]).String()]++
+			return nil
+		})
+	})
+	if err != nil {
+		s.log.WithFields(logrus.Fields{
+			"Error": err.Error(),
+		}).Error("Unable to count orders")
+	}
+	return sum
+}
+
+// Close closes the database file and the audit log
+func (s *boltStore) Close() error {
+	err := s.db.Close()
+	if aerr := s.audit.Close(); err == nil {
+		err = aerr
+	}
+	return err
+}
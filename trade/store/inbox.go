@@ -0,0 +1,63 @@
+package store
+
+import (
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// maxBatch is the most orders and events taken from the matcher at once
+const maxBatch = 256
+
+// inbox receives the closed orders and the events of the orders from the
+// matcher, until it has closed both channels. A nil channel is taken as
+// closed.
+type inbox struct {
+	complete <-chan *matcher.Order
+	events   <-chan matcher.Event
+}
+
+// batch is what was taken from the matcher at once
+type batch struct {
+	orders []*matcher.Order
+	events []matcher.Event
+}
+
+func (b *batch) len() int {
+	return len(b.orders) + len(b.events)
+}
+
+// ready is a closed channel, to stop waiting once a batch has something
+var ready = func() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
+}()
+
+// next waits for an order or an event, then takes those already waiting, up
+// to max in all. It reports false once both channels are closed and nothing
+// is left.
+func (in *inbox) next(max int) (batch, bool) {
+	var b batch
+	var done <-chan struct{}
+	for (in.complete != nil || in.events != nil) && b.len() < max {
+		if b.len() > 0 {
+			done = ready
+		}
+		select {
+		case o, ok := <-in.complete:
+			if !ok {
+				in.complete = nil
+				continue
+			}
+			b.orders = append(b.orders, o)
+		case e, ok := <-in.events:
+			if !ok {
+				in.events = nil
+				continue
+			}
+			b.events = append(b.events, e)
+		case <-done:
+			return b, true
+		}
+	}
+	return b, b.len() > 0
+}
@@ -0,0 +1,121 @@
+package store
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+// Query selects orders and a page of them, in the order of OrderTime and
+// then Id. Zero values match every order.
+type Query struct {
+	Status  matcher.Status
+	Side    matcher.Transaction
+	Symbol  string
+	Account string
+
+	// From and To select the orders placed at or after From and before To
+	From time.Time
+	To   time.Time
+
+	// After is the cursor of the previous page, and Limit the largest
+	// number of orders of a page, all of them if zero
+	After *Cursor
+	Limit int
+}
+
+// Match reports if the order passes the query, ignoring the page
+func (q *Query) Match(o *matcher.Order) bool {
+	switch {
+	case q.Status != 0 && o.Status != q.Status,
+		q.Side != 0 && o.Transaction != q.Side,
+		q.Symbol != "" && o.Symbol != q.Symbol,
+		q.Account != "" && o.Account != q.Account,
+		!q.From.IsZero() && o.OrderTime.Before(q.From),
+		!q.To.IsZero() && !o.OrderTime.Before(q.To):
+		return false
+	}
+	return true
+}
+
+// Cursor is the position of the last order of a page
+type Cursor struct {
+	OrderTime time.Time
+	Id        uuid.UUID
+}
+
+// CursorOf is the position of the order
+func CursorOf(o *matcher.Order) *Cursor {
+	return &Cursor{OrderTime: o.OrderTime, Id: o.Id}
+}
+
+func (c Cursor) String() string {
+	s := strconv.FormatInt(c.OrderTime.UnixNano(), 10) + "/" + c.Id.String()
+	return base64.RawURLEncoding.EncodeToString([]byte(s))
+}
+
+// ParseCursor reads a cursor written by String
+func ParseCursor(s string) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(string(b), "/", 2)
+	if len(parts) != 2 {
+		return nil, fmt.Errorf("malformed cursor")
+	}
+	nsec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return nil, err
+	}
+	return &Cursor{OrderTime: time.Unix(0, nsec).UTC(), Id: id}, nil
+}
+
+// precedes reports if the cursor position sorts before o
+func (c *Cursor) precedes(o *matcher.Order) bool {
+	if !o.OrderTime.Equal(c.OrderTime) {
+		return o.OrderTime.After(c.OrderTime)
+	}
+	return bytes.Compare(o.Id[:], c.Id[:]) > 0
+}
+
+// before reports if a sorts before b, by OrderTime and then Id
+func before(a, b *matcher.Order) bool {
+	if !a.OrderTime.Equal(b.OrderTime) {
+		return a.OrderTime.Before(b.OrderTime)
+	}
+	return bytes.Compare(a.Id[:], b.Id[:]) < 0
+}
+
+// Page sorts the orders and returns those that pass the query after its
+// cursor, with the cursor of the next page if there are more
+func Page(orders []matcher.Order, q Query) ([]matcher.Order, *Cursor) {
+	sort.Slice(orders, func(i, j int) bool {
+		return before(&orders[i], &orders[j])
+	})
+
+	page := []matcher.Order{}
+	for i := range orders {
+		o := &orders[i]
+		if !q.Match(o) || (q.After != nil && !q.After.precedes(o)) {
+			continue
+		}
+		if len(page) == q.Limit && q.Limit > 0 {
+			return page, CursorOf(&page[len(page)-1])
+		}
+		page = append(page, *o)
+	}
+	return page, nil
+}
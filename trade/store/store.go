@@ -1,48 +1,97 @@
 package store
 
 import (
-	"fmt"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
 
 	"github.com/nbasker/tools/trade/matcher"
 )
 
-// Retriever fetches executed orders from a storage or database
+// Store keeps the closed orders and answers queries on them. It is safe
+// for concurrent use.
 type Store interface {
-	// StoreCompletedOrders persists the executed and timedout orders
+	// StoreCompletedOrders persists the executed and timedout orders and
+	// the events of the orders until the matcher closes their channels.
 	StoreCompletedOrders()
 
-	// RetrieveExecutedOrders gets the executed orders from store.
-	RetrieveExecutedOrders() string
+	// Order gets a stored order by id.
+	Order(id uuid.UUID) (matcher.Order, bool)
+
+	// Orders gets a page of the stored orders that pass the query, with the
+	// cursor of the next page if there are more.
+	Orders(q Query) ([]matcher.Order, *Cursor)
+
+	// History gets the events of an order in the order they happened.
+	History(id uuid.UUID) []matcher.Event
+
+	// Summary counts the stored orders.
+	Summary() Summary
+
+	// Delete removes the orders and their events from the store.
+	Delete(ids []uuid.UUID) error
+
+	// Close releases the store once the complete channel is closed and it
+	// is no longer read.
+	Close() error
 }
 
-// storageService persists and retrieves completed orders
+// Summary is the number of stored orders, in total and by status
+type Summary struct {
+	Orders   int            `json:"orders"`
+	ByStatus map[string]int `json:"by_status"`
+}
+
+// storageService persists and retrieves completed orders. The orders are
+// indexed by id and kept sorted by OrderTime and Id, so that a time range or
+// a page starts with a binary search.
 type storageService struct {
 	complete <-chan *matcher.Order
+	events   <-chan matcher.Event
+	audit    *AuditLog
 	log      *logrus.Logger
-	store    map[string]*matcher.Order
+
+	mu       sync.RWMutex
+	byId     map[uuid.UUID]*matcher.Order
+	byTime   []*matcher.Order
+	byStatus map[matcher.Status]int
+	history  map[uuid.UUID][]matcher.Event
 }
 
-// NewMatcherService instantiates order matching service
+// NewStorageService instantiates the store of the orders closed by the
+// matcher. The orders and events are also written to the audit log, unless
+// it is nil, which the store closes.
 func NewStorageService(
 	complete <-chan *matcher.Order,
+	events <-chan matcher.Event,
+	audit *AuditLog,
 	log *logrus.Logger,
 ) Store {
 	return &storageService{
 		complete: complete,
+		events:   events,
+		audit:    audit,
 		log:      log,
-		store:    make(map[string]*matcher.Order),
+		byId:     make(map[uuid.UUID]*matcher.Order),
+		byStatus: make(map[matcher.Status]int),
+		history:  make(map[uuid.UUID][]matcher.Event),
 	}
 }
 
-// StoreCompletedOrders persists the executed and timed out orders
+// StoreCompletedOrders persists the executed and timed out orders and the
+// events of the orders, returning once the matcher has closed their channels
 func (s *storageService) StoreCompletedOrders() {
 	s.log.Info("Starting to collected completed orders and persist")
+	in := inbox{complete: s.complete, events: s.events}
 	for {
-		select {
-		case o := <-s.complete:
+		b, ok := in.next(maxBatch)
+		if !ok {
+			break
+		}
+		for _, o := range b.orders {
 			s.log.WithFields(logrus.Fields{
 				"OrderId":     o.Id.String(),
 				"Transaction": o.Transaction,
@@ -51,35 +100,149 @@ func (s *storageService) StoreCompletedOrders() {
 				"Executed":    o.Executed,
 				"Price":       o.Price,
 				"OrderTime":   o.OrderTime.Format(time.UnixDate),
+				"GroupId":     o.GroupId.String(),
+				"ParentId":    o.ParentId.String(),
 			}).Debug("Persist")
-			s.store[o.Id.String()] = o
+			s.add(*o)
 		}
+		s.append(b.events)
+		s.writeAudit(b)
+	}
+	s.log.WithFields(logrus.Fields{
+		"Orders": s.Summary().Orders,
+	}).Info("Stopped collecting completed orders")
+}
+
+// add stores a copy of the order, replacing an order stored with its id
+func (s *storageService) add(o matcher.Order) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if old, ok := s.byId[o.Id]; ok {
+		i := s.search(old)
+		s.byTime = append(s.byTime[:i], s.byTime[i+1:]...)
+		s.byStatus[old.Status]--
+	}
+	i := s.search(&o)
+	s.byTime = append(s.byTime, nil)
+	copy(s.byTime[i+1:], s.byTime[i:])
+	s.byTime[i] = &o
+	s.byId[o.Id] = &o
+	s.byStatus[o.Status]++
+}
+
+// append adds the events to the histories of their orders
+func (s *storageService) append(events []matcher.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, e := range events {
+		s.history[e.OrderId] = append(s.history[e.OrderId], e)
 	}
 }
 
-// ReceiveOrders gets the orders from a channel and stores in memory
-func (s *storageService) RetrieveExecutedOrders() string {
-	s.log.Info("Retrieving completed orders (executed and timedout)")
-	oResp := "Id/Time => [Buy/Sell, Price, Placed, Executed, Left, Status]\n"
-	for _, o := range s.store {
+// search returns the index of the first stored order that does not sort
+// before o
+func (s *storageService) search(o *matcher.Order) int {
+	return sort.Search(len(s.byTime), func(i int) bool {
+		return !before(s.byTime[i], o)
+	})
+}
+
+// Order returns a copy of the stored order
+func (s *storageService) Order(id uuid.UUID) (matcher.Order, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	o, ok := s.byId[id]
+	if !ok {
+		return matcher.Order{}, false
+	}
+	return *o, true
+}
+
+// Orders returns copies of a page of the stored orders, starting at the
+// later of the cursor and the start of the time range
+func (s *storageService) Orders(q Query) ([]matcher.Order, *Cursor) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	start := sort.Search(len(s.byTime), func(i int) bool {
+		return !s.byTime[i].OrderTime.Before(q.From)
+	})
+	if q.After != nil {
+		after := sort.Search(len(s.byTime), func(i int) bool {
+			return q.After.precedes(s.byTime[i])
+		})
+		if after > start {
+			start = after
+		}
+	}
+
+	orders := []matcher.Order{}
+	for _, o := range s.byTime[start:] {
+		if !q.To.IsZero() && !o.OrderTime.Before(q.To) {
+			break
+		}
+		if !q.Match(o) {
+			continue
+		}
+		if len(orders) == q.Limit && q.Limit > 0 {
+			return orders, CursorOf(&orders[len(orders)-1])
+		}
+		orders = append(orders, *o)
+	}
+	return orders, nil
+}
+
+// History returns a copy of the events of the order
+func (s *storageService) History(id uuid.UUID) []matcher.Event {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]matcher.Event(nil), s.history[id]...)
+}
+
+// Delete removes the orders and their histories
+func (s *storageService) Delete(ids []uuid.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, id := range ids {
+		if o, ok := s.byId[id]; ok {
+			i := s.search(o)
+			s.byTime = append(s.byTime[:i], s.byTime[i+1:]...)
+			s.byStatus[o.Status]--
+			delete(s.byId, id)
+		}
+		delete(s.history, id)
+	}
+	return nil
+}
+
+// Summary counts the stored orders by status
+func (s *storageService) Summary() Summary {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sum := Summary{ByStatus: make(map[string]int)}
+	for st, n := range s.byStatus {
+		if n == 0 {
+			continue
+		}
+		sum.Orders += n
+		sum.ByStatus[st.String()] = n
+	}
+	return sum
+}
+
+// writeAudit writes the batch to the audit log
+func (s *storageService) writeAudit(b batch) {
+	if err := s.audit.write(b); err != nil {
 		s.log.WithFields(logrus.Fields{
-			"OrderId":     o.Id.String(),
-			"Transaction": o.Transaction,
-			"OrderType":   o.OrderType,
-			"Quantity":    o.Quantity,
-			"Executed":    o.Executed,
-			"Price":       o.Price,
-			"OrderTime":   o.OrderTime.Format(time.UnixDate),
-		}).Debug("Processed")
-		oResp += fmt.Sprintf("%s/%s => [ %s, %d, %d, %d, %d, %s ]\n",
-			o.Id.String(),
-			o.OrderTime.Format(time.UnixDate),
-			o.Transaction.String(),
-			o.Price,
-			o.PlacedQuantity,
-			o.Executed,
-			o.Quantity,
-			o.Status.String())
+			"Error":  err.Error(),
+			"Orders": len(b.orders),
+			"Events": len(b.events),
+		}).Error("Unable to write audit log")
 	}
-	return oResp
+}
+
+// Close closes the audit log, the orders are lost with the service
+func (s *storageService) Close() error {
+	return s.audit.Close()
 }
@@ -0,0 +1,548 @@
+package store
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/nbasker/tools/trade/matcher"
+)
+
+var t0 = time.Date(2022, 8, 14, 22, 0, 0, 0, time.UTC)
+
+type newStore func(t *testing.T, complete <-chan *matcher.Order, events <-chan matcher.Event, log *logrus.Logger) Store
+
+// backends are the stores under test, each returning a new store of the
+// orders sent on complete
+var backends = []struct {
+	name string
+	new  newStore
+}{
+	{"Memory", func(t *testing.T, complete <-chan *matcher.Order, events <-chan matcher.Event, log *logrus.Logger) Store {
+		return NewStorageService(complete, events, nil, log)
+	}},
+	{"Bolt", func(t *testing.T, complete <-chan *matcher.Order, events <-chan matcher.Event, log *logrus.Logger) Store {
+		s, err := NewBoltStore(filepath.Join(t.TempDir(), "trade.db"), complete, events, nil, log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return s
+	}},
+}
+
+// testStore is a store of a backend collecting the orders and events sent
+// on its channels
+type testStore struct {
+	Store
+	complete chan *matcher.Order
+	events   chan matcher.Event
+	done     chan struct{}
+}
+
+func newTestStore(t *testing.T, new newStore) *testStore {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	s := &testStore{
+		complete: make(chan *matcher.Order),
+		events:   make(chan matcher.Event),
+		done:     make(chan struct{}),
+	}
+	s.Store = new(t, s.complete, s.events, log)
+	go func() {
+		s.StoreCompletedOrders()
+		close(s.done)
+	}()
+	return s
+}
+
+// stop closes the channels and waits for the store to take what was sent
+func (s *testStore) stop() {
+	close(s.complete)
+	close(s.events)
+	<-s.done
+}
+
+func testOrder(minute int, status matcher.Status) *matcher.Order {
+	return &matcher.Order{
+		Id:          uuid.New(),
+		OrderTime:   t0.Add(time.Duration(minute) * time.Minute),
+		Transaction: matcher.Buy,
+		Quantity:    10,
+		Price:       100,
+		OrderType:   matcher.Limit,
+		Status:      status,
+		Symbol:      "SAMPLE",
+		Account:     "acc1",
+	}
+}
+
+func Test_Store_Orders(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			testStoreOrders(t, backend.new)
+		})
+	}
+}
+
+func testStoreOrders(t *testing.T, new newStore) {
+	s := newTestStore(t, new)
+
+	// Sent out of time order, as closed orders are
+	orders := []*matcher.Order{
+		testOrder(3, matcher.Completed),
+		testOrder(0, matcher.Completed),
+		testOrder(4, matcher.Cancelled),
+		testOrder(1, matcher.TimedOut),
+		testOrder(2, matcher.Completed),
+	}
+	orders[4].Transaction = matcher.Sell
+	for _, o := range orders {
+		s.complete <- o
+	}
+	// A later state of an order replaces the stored one
+	replaced := *orders[1]
+	replaced.Status = matcher.Cancelled
+	s.complete <- &replaced
+	s.stop()
+
+	o, ok := s.Order(orders[0].Id)
+	assert.True(t, ok)
+	assert.Equal(t, *orders[0], o)
+	o, _ = s.Order(orders[1].Id)
+	assert.Equal(t, matcher.Cancelled, o.Status)
+	_, ok = s.Order(uuid.New())
+	assert.False(t, ok)
+
+	all, next := s.Orders(Query{})
+	assert.Nil(t, next)
+	assert.Equal(t, []matcher.Order{replaced, *orders[3], *orders[4], *orders[0], *orders[2]}, all)
+
+	got, _ := s.Orders(Query{Status: matcher.Cancelled})
+	assert.Equal(t, []matcher.Order{replaced, *orders[2]}, got)
+	got, _ = s.Orders(Query{Side: matcher.Sell})
+	assert.Equal(t, []matcher.Order{*orders[4]}, got)
+	got, _ = s.Orders(Query{From: t0.Add(time.Minute), To: t0.Add(3 * time.Minute)})
+	assert.Equal(t, []matcher.Order{*orders[3], *orders[4]}, got)
+	got, _ = s.Orders(Query{Account: "acc2"})
+	assert.Empty(t, got)
+
+	// Pages follow each other without gaps or repeats, on each index
+	pages := func(q Query) []matcher.Order {
+		var paged []matcher.Order
+		for {
+			page, next := s.Orders(q)
+			assert.LessOrEqual(t, len(page), q.Limit)
+			paged = append(paged, page...)
+			if next == nil {
+				return paged
+			}
+			q.After = next
+		}
+	}
+	assert.Equal(t, all, pages(Query{Limit: 2}))
+	assert.Equal(t, []matcher.Order{*orders[4], *orders[0]}, pages(Query{Status: matcher.Completed, Limit: 1}))
+	assert.Equal(t, all[1:], pages(Query{Account: "acc1", From: t0.Add(time.Minute), Limit: 3}))
+
+	assert.Equal(t, Summary{Orders: 5, ByStatus: map[string]int{
+		"completed": 2, "cancelled": 2, "timedout": 1,
+	}}, s.Summary())
+}
+
+func Test_Store_History(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			s := newTestStore(t, backend.new)
+			o1, o2 := testOrder(0, matcher.Completed), testOrder(1, matcher.Cancelled)
+			events := []matcher.Event{
+				{OrderId: o1.Id, Type: matcher.EventPlaced, Time: t0, Cause: "new order", Quantity: 10, Price: 100},
+				{OrderId: o2.Id, Type: matcher.EventPlaced, Time: t0, Cause: "new order", Quantity: 10, Price: 100},
+				{OrderId: o1.Id, Type: matcher.EventPartiallyFilled, Time: t0.Add(time.Second), Quantity: 4, Executed: 6, Price: 100},
+				{OrderId: o2.Id, Type: matcher.EventCancelled, Time: t0.Add(time.Second), Cause: "cancel request", Quantity: 10, Price: 100},
+				{OrderId: o1.Id, Type: matcher.EventFilled, Time: t0.Add(2 * time.Second), Executed: 10, Price: 100},
+			}
+			for _, e := range events {
+				s.events <- e
+			}
+			s.complete <- o1
+			s.stop()
+
+			assert.Equal(t, []matcher.Event{events[0], events[2], events[4]}, s.History(o1.Id))
+			assert.Equal(t, []matcher.Event{events[1], events[3]}, s.History(o2.Id))
+			assert.Empty(t, s.History(uuid.New()))
+		})
+	}
+}
+
+func Test_BoltStore_Reopen(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	path := filepath.Join(t.TempDir(), "trade.db")
+
+	complete := make(chan *matcher.Order, 1)
+	s, err := NewBoltStore(path, complete, nil, nil, log)
+	assert.NoError(t, err)
+	o := testOrder(0, matcher.Completed)
+	complete <- o
+	close(complete)
+	s.StoreCompletedOrders()
+	assert.NoError(t, s.Close())
+
+	// The orders outlive the store and the file is not migrated again
+	s, err = NewBoltStore(path, nil, nil, nil, log)
+	assert.NoError(t, err)
+	got, ok := s.Order(o.Id)
+	assert.True(t, ok)
+	assert.Equal(t, *o, got)
+	assert.NoError(t, s.Close())
+
+	// A file of a later schema is not opened
+	migrations = append(migrations, func(tx *bolt.Tx) error { return nil })
+	s, err = NewBoltStore(path, nil, nil, nil, log)
+	migrations = migrations[:len(migrations)-1]
+	assert.NoError(t, err)
+	assert.NoError(t, s.Close())
+	_, err = NewBoltStore(path, nil, nil, nil, log)
+	assert.Error(t, err)
+}
+
+func Test_AuditLog(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	dir := t.TempDir()
+	path, checkpoints := filepath.Join(dir, "audit.log"), filepath.Join(dir, "audit.checkpoints")
+	public, key, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+
+	// Each run of the store continues the chain and signs it when closed
+	run := func(orders ...*matcher.Order) {
+		audit, err := OpenAuditLog(path, checkpoints, key, time.Hour, log)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		complete := make(chan *matcher.Order, len(orders))
+		events := make(chan matcher.Event, len(orders))
+		for _, o := range orders {
+			events <- matcher.Event{OrderId: o.Id, Type: matcher.EventFilled, Time: o.OrderTime}
+			complete <- o
+		}
+		close(complete)
+		close(events)
+		s := NewStorageService(complete, events, audit, log)
+		s.StoreCompletedOrders()
+		assert.NoError(t, s.Close())
+	}
+	run(testOrder(0, matcher.Completed), testOrder(1, matcher.Completed))
+	run(testOrder(2, matcher.Cancelled))
+
+	report, err := VerifyAuditLog(path, checkpoints, public)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(6), report.Records)
+	assert.Equal(t, 2, report.Checkpoints)
+
+	broken := func(path string, line int) {
+		var e *BrokenLinkError
+		if assert.True(t, errors.As(err, &e), "%v", err) {
+			assert.Equal(t, path, e.File)
+			assert.Equal(t, line, e.Line)
+		}
+	}
+	other, _, _ := ed25519.GenerateKey(nil)
+	_, err = VerifyAuditLog(path, checkpoints, other)
+	broken(checkpoints, 1)
+
+	b, _ := ioutil.ReadFile(path)
+	lines := strings.SplitAfter(string(b), "\n")
+	rewrite := func(lines []string) {
+		assert.NoError(t, ioutil.WriteFile(path, []byte(strings.Join(lines, "")), 0600))
+	}
+
+	// A changed record breaks its own link
+	changed := append([]string(nil), lines...)
+	changed[2] = strings.Replace(changed[2], `"data":{`, `"data":{"forged":true,`, 1)
+	rewrite(changed)
+	_, err = VerifyAuditLog(path, checkpoints, public)
+	broken(path, 3)
+
+	// A removed record breaks the link of the next one
+	rewrite(append(append([]string(nil), lines[:1]...), lines[2:]...))
+	_, err = VerifyAuditLog(path, checkpoints, public)
+	broken(path, 2)
+
+	// A log cut after a checkpoint ends before the signed record
+	rewrite(lines[:5])
+	_, err = VerifyAuditLog(path, checkpoints, public)
+	broken(checkpoints, 2)
+
+	// A broken log is not continued
+	rewrite(changed)
+	_, err = OpenAuditLog(path, checkpoints, key, time.Hour, log)
+	broken(path, 3)
+
+	// A torn last line is reported, then cut off when the log is continued
+	torn := func(path string, line int) {
+		var e *BrokenLinkError
+		if assert.True(t, errors.As(err, &e), "%v", err) {
+			assert.Equal(t, path, e.File)
+			assert.Equal(t, line, e.Line)
+			assert.True(t, e.Torn)
+		}
+	}
+	rewrite(append(append([]string(nil), lines...), lines[1][:20]))
+	_, err = VerifyAuditLog(path, checkpoints, public)
+	torn(path, 7)
+	cp, _ := ioutil.ReadFile(checkpoints)
+	assert.NoError(t, ioutil.WriteFile(checkpoints, append(cp, `{"seq":`...), 0600))
+	rewrite(lines)
+	_, err = VerifyAuditLog(path, checkpoints, public)
+	torn(checkpoints, 3)
+	rewrite(append(append([]string(nil), lines...), lines[1][:20]))
+	run(testOrder(3, matcher.Completed))
+	report, err = VerifyAuditLog(path, checkpoints, public)
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(8), report.Records)
+	assert.Equal(t, 3, report.Checkpoints)
+}
+
+func Test_LoadAuditKeys(t *testing.T) {
+	dir := t.TempDir()
+	public, private, err := ed25519.GenerateKey(nil)
+	assert.NoError(t, err)
+	write := func(name, blockType string, der []byte) string {
+		path := filepath.Join(dir, name)
+		assert.NoError(t, ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600))
+		return path
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	assert.NoError(t, err)
+	privatePath := write("audit.pem", "PRIVATE KEY", der)
+	der, err = x509.MarshalPKIXPublicKey(public)
+	assert.NoError(t, err)
+	publicPath := write("audit.pub.pem", "PUBLIC KEY", der)
+
+	key, err := LoadAuditPrivateKey(privatePath)
+	assert.NoError(t, err)
+	assert.Equal(t, private, key)
+	pub, err := LoadAuditPublicKey(publicPath)
+	assert.NoError(t, err)
+	assert.Equal(t, public, pub)
+
+	// Each key is read from its own file only
+	_, err = LoadAuditPrivateKey(publicPath)
+	assert.Error(t, err)
+	_, err = LoadAuditPublicKey(privatePath)
+	assert.Error(t, err)
+}
+
+func Test_Archive(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			testArchive(t, backend.new)
+		})
+	}
+}
+
+func testArchive(t *testing.T, new newStore) {
+	s := newTestStore(t, new)
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	archive, err := NewArchive(filepath.Join(t.TempDir(), "archive"), log)
+	assert.NoError(t, err)
+
+	// Two orders on each of three days, the last of them today
+	var orders []*matcher.Order
+	for d := -2; d <= 0; d++ {
+		for _, m := range []int{0, 30} {
+			o := testOrder(m, matcher.Completed)
+			o.OrderTime = o.OrderTime.AddDate(0, 0, d)
+			orders = append(orders, o)
+			s.events <- matcher.Event{OrderId: o.Id, Type: matcher.EventFilled, Time: o.OrderTime}
+			s.complete <- o
+		}
+	}
+	s.stop()
+
+	// Keeping one day before today moves the orders of the first day
+	moved, err := archive.Retain(s, 1, t0.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+	moved, err = archive.Retain(s, 1, t0.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Zero(t, moved)
+	days, err := archive.Days()
+	assert.NoError(t, err)
+	assert.Equal(t, []time.Time{day(orders[0].OrderTime)}, days)
+	archived, err := archive.read(days[0])
+	assert.NoError(t, err)
+	if assert.Len(t, archived, 2) {
+		assert.Equal(t, *orders[0], archived[0].Order)
+		assert.Len(t, archived[0].Events, 1)
+	}
+
+	live, _ := s.Orders(Query{})
+	assert.Equal(t, []matcher.Order{*orders[2], *orders[3], *orders[4], *orders[5]}, live)
+	assert.Empty(t, s.History(orders[0].Id))
+	assert.Equal(t, 4, s.Summary().Orders)
+
+	// A time range reads the archived days it covers
+	all := NewArchivedStore(s.Store, archive, log)
+	from := t0.AddDate(0, 0, -3)
+	got, _ := all.Orders(Query{From: from})
+	want := []matcher.Order{*orders[0], *orders[1], *orders[2], *orders[3], *orders[4], *orders[5]}
+	assert.Equal(t, want, got)
+	got, _ = all.Orders(Query{From: from, To: orders[1].OrderTime})
+	assert.Equal(t, want[:1], got)
+	got, _ = all.Orders(Query{To: orders[3].OrderTime})
+	assert.Equal(t, want[:3], got)
+	got, _ = all.Orders(Query{})
+	assert.Equal(t, want[2:], got)
+
+	var paged []matcher.Order
+	for q := (Query{From: from, Limit: 4}); ; {
+		page, next := all.Orders(q)
+		paged = append(paged, page...)
+		if next == nil {
+			break
+		}
+		q.After = next
+	}
+	assert.Equal(t, want, paged)
+
+	// An archived order and its history are found by id, also when the
+	// archive is opened again or its index is built again
+	got1, ok := all.Order(orders[0].Id)
+	assert.True(t, ok)
+	assert.Equal(t, *orders[0], got1)
+	assert.Len(t, all.History(orders[0].Id), 1)
+	got1, ok = all.Order(orders[2].Id)
+	assert.True(t, ok)
+	assert.Equal(t, *orders[2], got1)
+	_, ok = all.Order(uuid.New())
+	assert.False(t, ok)
+	for _, rebuild := range []bool{false, true} {
+		if rebuild {
+			assert.NoError(t, os.Remove(filepath.Join(archive.dir, indexFile)))
+		}
+		reopened, err := NewArchive(archive.dir, log)
+		assert.NoError(t, err)
+		a, ok, err := reopened.Order(orders[1].Id)
+		assert.NoError(t, err)
+		assert.True(t, ok)
+		assert.Equal(t, *orders[1], a.Order)
+	}
+
+	// A page reads the archived days from its cursor, and no further than
+	// the day that fills it
+	moved, err = archive.Retain(s, 0, t0.Add(time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, moved)
+	got, err = archive.Orders(Query{From: from, Limit: 1})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, want[:2], got)
+	got, err = archive.Orders(Query{From: from, After: CursorOf(orders[0])})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, want[1:4], got)
+	got, err = archive.Orders(Query{From: from, After: CursorOf(orders[1])})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, want[2:4], got)
+	paged = nil
+	for q := (Query{From: from, Limit: 3}); ; {
+		page, next := all.Orders(q)
+		paged = append(paged, page...)
+		if next == nil {
+			break
+		}
+		q.After = next
+	}
+	assert.Equal(t, want, paged)
+}
+
+func Test_Page(t *testing.T) {
+	var orders []matcher.Order
+	for i := 3; i >= 0; i-- {
+		orders = append(orders, *testOrder(i, matcher.Placed))
+	}
+	// Orders at the same time are ordered by id
+	orders[0].OrderTime = orders[1].OrderTime
+
+	page, next := Page(append([]matcher.Order(nil), orders...), Query{Limit: 3})
+	assert.Len(t, page, 3)
+	if assert.NotNil(t, next) {
+		c, err := ParseCursor(next.String())
+		assert.NoError(t, err)
+		assert.Equal(t, next, c)
+		rest, next := Page(append([]matcher.Order(nil), orders...), Query{Limit: 3, After: c})
+		assert.Len(t, rest, 1)
+		assert.Nil(t, next)
+		assert.True(t, before(&page[2], &rest[0]))
+	}
+	for i := 1; i < len(page); i++ {
+		assert.True(t, before(&page[i-1], &page[i]))
+	}
+
+	_, err := ParseCursor("x")
+	assert.Error(t, err)
+}
+
+// Test_Store_Concurrent reads the store while it is written, for the race
+// detector: go test -race ./store
+func Test_Store_Concurrent(t *testing.T) {
+	for _, backend := range backends {
+		t.Run(backend.name, func(t *testing.T) {
+			testStoreConcurrent(t, backend.new)
+		})
+	}
+}
+
+func testStoreConcurrent(t *testing.T, new newStore) {
+	s := newTestStore(t, new)
+	const n = 500
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < n; i++ {
+			o := testOrder(i%60, matcher.Completed)
+			s.events <- matcher.Event{OrderId: o.Id, Type: matcher.EventFilled, Time: o.OrderTime}
+			s.complete <- o
+		}
+	}()
+
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				page, _ := s.Orders(Query{Status: matcher.Completed, Limit: 10})
+				for _, o := range page {
+					_, ok := s.Order(o.Id)
+					assert.True(t, ok)
+					assert.Len(t, s.History(o.Id), 1)
+				}
+				sum := s.Summary()
+				assert.Equal(t, sum.Orders, sum.ByStatus["completed"])
+			}
+		}()
+	}
+
+	wg.Wait()
+	s.stop()
+
+	all, _ := s.Orders(Query{})
+	assert.Len(t, all, n)
+	assert.Equal(t, n, s.Summary().Orders)
+}